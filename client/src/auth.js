@@ -2,9 +2,19 @@ import { writable } from 'svelte/store';
 
 export const isAuthenticated = writable(false);
 
-export function checkAuth()
+// The session cookie is HttpOnly, so ask the server whether it is still good.
+export async function checkAuth()
 {
-    const sessionCookie = document.cookie.split(';').find(c => c.trim().startsWith('session_token='));
-    isAuthenticated.set(sessionCookie != undefined)
-    return sessionCookie != undefined
+    let authenticated = false
+    try {
+        const response = await fetch("http://localhost:5174/userdata", {
+            method: "GET",
+            credentials: "include",
+        })
+        authenticated = response.ok
+    } catch (error) {
+        console.error("Error checking session:", error)
+    }
+    isAuthenticated.set(authenticated)
+    return authenticated
 }
@@ -4,5 +4,5 @@ setlocal
 set OUTPUT=server.exe
 
 go mod vendor
-go build -o out/%OUTPUT% src/main.go
+go build -o out/%OUTPUT% ./src
 out\server.exe
@@ -4,5 +4,5 @@ OUTPUT="TradEx"
 
 mkdir -p out
 go mod vendor
-go build -o out/$OUTPUT src/main.go
+go build -o out/$OUTPUT ./src
 out/TradEx
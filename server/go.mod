@@ -10,4 +10,6 @@ require (
 
 require github.com/rs/cors v1.11.1
 
-require github.com/robfig/cron/v3 v3.0.1 // indirect
+require github.com/robfig/cron/v3 v3.0.1
+
+require github.com/gorilla/websocket v1.5.3
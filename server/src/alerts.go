@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxActiveAlerts = 50
+const defaultAlertCooldown = time.Hour
+const minAlertCooldown = time.Minute
+const defaultAlertLifetime = 90 * 24 * time.Hour
+const maxAlertLifetime = 365 * 24 * time.Hour
+
+var alertConditions = []string{"above", "below", "percent_change", "52_week_high", "52_week_low"}
+
+// PriceAlert fires when its condition is met, then waits out its cooldown.
+// One-off alerts stop after firing once; repeating ones run until they expire.
+type PriceAlert struct {
+	Id              int        `json:"id"`
+	UserId          int        `json:"-"`
+	Symbol          string     `json:"symbol"`
+	Condition       string     `json:"condition"`
+	Price           *Money     `json:"price,omitempty"`
+	Percent         *float64   `json:"percent,omitempty"`
+	ReferencePrice  *Money     `json:"reference_price,omitempty"`
+	Repeat          bool       `json:"repeat"`
+	Cooldown        Duration   `json:"cooldown"`
+	Armed           bool       `json:"-"`
+	Status          string     `json:"status"`
+	TriggerCount    int        `json:"trigger_count"`
+	LastTriggeredAt *time.Time `json:"last_triggered_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+const alertColumns = `id, user_id, symbol, condition, threshold, percent, reference_price, repeat,
+	cooldown_seconds, armed, status, trigger_count, last_triggered_at, expires_at, created_at`
+
+func scanAlert(row rowScanner) (PriceAlert, error) {
+	var a PriceAlert
+	var threshold, reference sql.NullInt64
+	var percent sql.NullFloat64
+	var cooldown int64
+	var lastTriggered sql.NullTime
+	err := row.Scan(&a.Id, &a.UserId, &a.Symbol, &a.Condition, &threshold, &percent, &reference, &a.Repeat,
+		&cooldown, &a.Armed, &a.Status, &a.TriggerCount, &lastTriggered, &a.ExpiresAt, &a.CreatedAt)
+	if err != nil {
+		return a, err
+	}
+
+	a.Price = nullMoney(threshold)
+	a.ReferencePrice = nullMoney(reference)
+	if percent.Valid {
+		a.Percent = &percent.Float64
+	}
+	a.Cooldown = Duration{time.Duration(cooldown) * time.Second}
+	if lastTriggered.Valid {
+		a.LastTriggeredAt = &lastTriggered.Time
+	}
+	return a, nil
+}
+
+func isValidAlertCondition(condition string) bool {
+	for _, c := range alertConditions {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
+
+// fiftyTwoWeekRange is the highest high and lowest low of the daily bars in
+// the year before day. ok is false when there is no history to go on.
+func fiftyTwoWeekRange(symbol string, day time.Time) (high, low Money, ok bool, err error) {
+	var maxHigh, minLow sql.NullFloat64
+	err = db.QueryRow(`
+		SELECT MAX(high), MIN(low) FROM historical_prices
+		WHERE symbol = ? AND date >= ? AND date < ?
+	`, symbol, day.AddDate(-1, 0, 0).Format(dateLayout), day.Format(dateLayout)).Scan(&maxHigh, &minLow)
+	if err != nil || !maxHigh.Valid {
+		return 0, 0, false, err
+	}
+	return MoneyFromFloat(maxHigh.Float64), MoneyFromFloat(minLow.Float64), true, nil
+}
+
+// alertMessage says why an alert fired, or is empty if it shouldn't.
+// Above and below alerts only fire while armed; the others are measured from
+// the reference price, which moves on every time they fire.
+func alertMessage(a PriceAlert, price Money, now time.Time) (string, error) {
+	switch a.Condition {
+	case "above":
+		if a.Armed && price >= *a.Price {
+			return fmt.Sprintf("%s rose above $%s and is at $%s", a.Symbol, *a.Price, price), nil
+		}
+	case "below":
+		if a.Armed && price <= *a.Price {
+			return fmt.Sprintf("%s fell below $%s and is at $%s", a.Symbol, *a.Price, price), nil
+		}
+	case "percent_change":
+		reference := *a.ReferencePrice
+		change := (price.Float64() - reference.Float64()) / reference.Float64() * 100
+		if (*a.Percent > 0 && change >= *a.Percent) || (*a.Percent < 0 && change <= *a.Percent) {
+			return fmt.Sprintf("%s moved %+.2f%% from $%s and is at $%s", a.Symbol, change, reference, price), nil
+		}
+	case "52_week_high", "52_week_low":
+		high, low, ok, err := fiftyTwoWeekRange(a.Symbol, truncateToDate(now))
+		if err != nil || !ok {
+			return "", err
+		}
+		if a.Condition == "52_week_high" {
+			if a.ReferencePrice != nil {
+				high = max(high, *a.ReferencePrice)
+			}
+			if price > high {
+				return fmt.Sprintf("%s hit a 52-week high of $%s", a.Symbol, price), nil
+			}
+		} else {
+			if a.ReferencePrice != nil {
+				low = min(low, *a.ReferencePrice)
+			}
+			if price < low {
+				return fmt.Sprintf("%s hit a 52-week low of $%s", a.Symbol, price), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// evaluatePriceAlerts expires old alerts, then checks the rest against the
+// quote cache, one quote per symbol.
+func evaluatePriceAlerts() {
+	now := time.Now().UTC()
+
+	if _, err := db.Exec(`
+		UPDATE price_alerts SET status = 'expired' WHERE status = 'active' AND expires_at <= ?
+	`, now); err != nil {
+		fmt.Println("Error expiring price alerts:", err)
+		return
+	}
+
+	rows, err := db.Query("SELECT " + alertColumns + " FROM price_alerts WHERE status = 'active' ORDER BY symbol, id")
+	if err != nil {
+		fmt.Println("Error querying price alerts:", err)
+		return
+	}
+	var alerts []PriceAlert
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			fmt.Println("Error scanning price alert:", err)
+			rows.Close()
+			return
+		}
+		alerts = append(alerts, a)
+	}
+	rows.Close()
+
+	prices := make(map[string]Money)
+	for _, a := range alerts {
+		price, ok := prices[a.Symbol]
+		if !ok {
+			quote, err := fetchQuote(a.Symbol)
+			if err != nil {
+				fmt.Printf("Error fetching price for %s: %v\n", a.Symbol, err)
+				continue
+			}
+			price = quote.Price
+			prices[a.Symbol] = price
+		}
+
+		if err := evaluatePriceAlert(a, price, now); err != nil {
+			fmt.Printf("Error evaluating price alert %d: %v\n", a.Id, err)
+		}
+	}
+}
+
+func evaluatePriceAlert(a PriceAlert, price Money, now time.Time) error {
+	// Re-arm above and below alerts once the price is back across the line.
+	if !a.Armed && ((a.Condition == "above" && price < *a.Price) || (a.Condition == "below" && price > *a.Price)) {
+		_, err := db.Exec("UPDATE price_alerts SET armed = 1 WHERE id = ?", a.Id)
+		return err
+	}
+
+	if a.LastTriggeredAt != nil && now.Sub(*a.LastTriggeredAt) < a.Cooldown.Duration {
+		return nil
+	}
+
+	message, err := alertMessage(a, price, now)
+	if err != nil || message == "" {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := "active"
+	if !a.Repeat {
+		status = "triggered"
+	}
+	result, err := tx.Exec(`
+		UPDATE price_alerts
+		SET status = ?, armed = 0, reference_price = CASE WHEN threshold IS NULL THEN ? END,
+			trigger_count = trigger_count + 1, last_triggered_at = ?
+		WHERE id = ? AND status = 'active'
+	`, status, price, now, a.Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil // deleted in the meantime
+	}
+
+	notification, err := createNotification(tx, a.UserId, "price_alert", message, map[string]interface{}{
+		"alert_id":  a.Id,
+		"symbol":    a.Symbol,
+		"condition": a.Condition,
+		"price":     price,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	publishNotification(a.UserId, notification)
+	return nil
+}
+
+func GetAlerts(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "active"
+	}
+
+	query := "SELECT " + alertColumns + " FROM price_alerts WHERE user_id = ?"
+	args := []interface{}{getUserIdFromSession(r)}
+	if status != "all" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch alerts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	alerts := []PriceAlert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			http.Error(w, "Failed to scan alert row", http.StatusInternalServerError)
+			return
+		}
+		alerts = append(alerts, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// CreateAlert sets up an alert. Above and below alerts take a price and
+// percent_change ones a signed percent, measured from the price now. 52-week
+// alerts fetch a year of history for the symbol if there isn't any yet.
+func CreateAlert(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	var req struct {
+		Symbol    string     `json:"symbol"`
+		Condition string     `json:"condition"`
+		Price     *Money     `json:"price"`
+		Percent   *float64   `json:"percent"`
+		Repeat    bool       `json:"repeat"`
+		Cooldown  *Duration  `json:"cooldown"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	symbol := normalizeSymbol(req.Symbol)
+	if !isValidAlertCondition(req.Condition) {
+		http.Error(w, "Condition must be above, below, percent_change, 52_week_high or 52_week_low", http.StatusBadRequest)
+		return
+	}
+
+	needsPrice := req.Condition == "above" || req.Condition == "below"
+	needsPercent := req.Condition == "percent_change"
+	if needsPrice && (req.Price == nil || *req.Price <= 0) {
+		http.Error(w, "price must be greater than 0 for "+req.Condition+" alerts", http.StatusBadRequest)
+		return
+	}
+	if !needsPrice && req.Price != nil {
+		http.Error(w, "price is not allowed for "+req.Condition+" alerts", http.StatusBadRequest)
+		return
+	}
+	if needsPercent && (req.Percent == nil || *req.Percent == 0 || *req.Percent <= -100) {
+		http.Error(w, "percent must be non-zero and above -100 for percent_change alerts", http.StatusBadRequest)
+		return
+	}
+	if !needsPercent && req.Percent != nil {
+		http.Error(w, "percent is not allowed for "+req.Condition+" alerts", http.StatusBadRequest)
+		return
+	}
+
+	cooldown := defaultAlertCooldown
+	if req.Cooldown != nil {
+		cooldown = req.Cooldown.Duration
+	}
+	if cooldown < minAlertCooldown {
+		http.Error(w, "cooldown must be at least "+minAlertCooldown.String(), http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := now.Add(defaultAlertLifetime)
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC()
+	}
+	if !expiresAt.After(now) || expiresAt.After(now.Add(maxAlertLifetime)) {
+		http.Error(w, "expires_at must be in the future and within a year", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := resolveInstrument(symbol); err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		fmt.Println("Error resolving instrument:", err)
+		http.Error(w, "Failed to create alert", http.StatusInternalServerError)
+		return
+	}
+
+	var reference *Money
+	if needsPercent {
+		quote, err := fetchQuote(symbol)
+		if err != nil {
+			http.Error(w, "Failed to fetch stock price", http.StatusInternalServerError)
+			return
+		}
+		reference = &quote.Price
+	}
+
+	var active int
+	if err := db.QueryRow("SELECT COUNT(*) FROM price_alerts WHERE user_id = ? AND status = 'active'", userId).Scan(&active); err != nil {
+		http.Error(w, "Failed to create alert", http.StatusInternalServerError)
+		return
+	}
+	if active >= maxActiveAlerts {
+		http.Error(w, fmt.Sprintf("You can have at most %d active alerts", maxActiveAlerts), http.StatusConflict)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO price_alerts (user_id, symbol, condition, threshold, percent, reference_price, repeat,
+			cooldown_seconds, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userId, symbol, req.Condition, req.Price, req.Percent, reference, req.Repeat,
+		int64(cooldown/time.Second), expiresAt)
+	if err != nil {
+		fmt.Println("Error creating alert:", err)
+		http.Error(w, "Failed to create alert", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	if req.Condition == "52_week_high" || req.Condition == "52_week_low" {
+		if _, _, ok, err := fiftyTwoWeekRange(symbol, truncateToDate(now)); err == nil && !ok {
+			go func() {
+				to := truncateToDate(time.Now().UTC())
+				if _, err := backfillSymbol(symbol, to.AddDate(-1, 0, 0), to); err != nil {
+					fmt.Printf("Error backfilling %s for 52-week alerts: %v\n", symbol, err)
+				}
+			}()
+		}
+	}
+
+	alert, err := scanAlert(db.QueryRow("SELECT "+alertColumns+" FROM price_alerts WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, "Failed to fetch alert", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(alert)
+}
+
+func DeleteAlert(w http.ResponseWriter, r *http.Request) {
+	alertId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid alert id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM price_alerts WHERE id = ? AND user_id = ?", alertId, getUserIdFromSession(r))
+	if err != nil {
+		http.Error(w, "Failed to delete alert", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Alert deleted",
+		"alert_id": alertId,
+	})
+}
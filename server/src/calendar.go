@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata"
+)
+
+type MarketOptions struct {
+	// Calendar is "nyse", or "always_open" to trade around the clock.
+	Calendar string `json:"calendar"`
+	// ExtraHolidays are further dates, like "2025-01-09", the exchange
+	// closed for at short notice.
+	ExtraHolidays []string `json:"extra_holidays"`
+	// DailyPricesDelay is how long after each session's close the daily
+	// price job runs, unless schedules.daily_prices overrides it.
+	DailyPricesDelay Duration `json:"daily_prices_delay"`
+}
+
+func (o MarketOptions) Validate() error {
+	if o.Calendar != "nyse" && o.Calendar != "always_open" {
+		return fmt.Errorf("unknown calendar %q", o.Calendar)
+	}
+	for _, day := range o.ExtraHolidays {
+		if _, err := time.Parse(dateLayout, day); err != nil {
+			return fmt.Errorf("extra_holidays: invalid date %q", day)
+		}
+	}
+	if o.DailyPricesDelay.Duration < 0 {
+		return fmt.Errorf("daily_prices_delay must not be negative")
+	}
+	return nil
+}
+
+// TradingCalendar knows when an exchange trades. Sessions are given as
+// minutes after local midnight so they keep their wall-clock times across
+// daylight saving changes.
+type TradingCalendar struct {
+	Name       string
+	Location   *time.Location
+	Open       int
+	Close      int
+	EarlyClose int
+	Weekends   bool
+	// holiday and earlyClose are the exchange's rules for a local date.
+	holiday       func(day time.Time) (string, bool)
+	earlyClose    func(day time.Time) bool
+	extraHolidays map[string]bool
+}
+
+type MarketSession struct {
+	Date       string    `json:"date"`
+	OpensAt    time.Time `json:"opens_at"`
+	ClosesAt   time.Time `json:"closes_at"`
+	EarlyClose bool      `json:"early_close"`
+}
+
+var marketCalendar *TradingCalendar
+
+func newTradingCalendar(opts MarketOptions) (*TradingCalendar, error) {
+	var c *TradingCalendar
+	switch opts.Calendar {
+	case "nyse":
+		location, err := time.LoadLocation("America/New_York")
+		if err != nil {
+			return nil, err
+		}
+		c = &TradingCalendar{
+			Name:       "nyse",
+			Location:   location,
+			Open:       9*60 + 30,
+			Close:      16 * 60,
+			EarlyClose: 13 * 60,
+			holiday:    nyseHoliday,
+			earlyClose: nyseEarlyClose,
+		}
+	case "always_open":
+		c = &TradingCalendar{Name: "always_open", Location: time.UTC, Close: 24 * 60, Weekends: true}
+	default:
+		return nil, fmt.Errorf("unknown calendar %q", opts.Calendar)
+	}
+
+	c.extraHolidays = make(map[string]bool)
+	for _, day := range opts.ExtraHolidays {
+		c.extraHolidays[day] = true
+	}
+	return c, nil
+}
+
+// Holiday names the reason the exchange is shut on a weekday it would
+// normally trade.
+func (c *TradingCalendar) Holiday(day time.Time) (string, bool) {
+	y, m, d := day.In(c.Location).Date()
+	day = time.Date(y, m, d, 0, 0, 0, 0, c.Location)
+	if c.extraHolidays[day.Format(dateLayout)] {
+		return "Exchange closed", true
+	}
+	if c.holiday == nil {
+		return "", false
+	}
+	return c.holiday(day)
+}
+
+// Session is the trading session on the local date of day, if there is one.
+func (c *TradingCalendar) Session(day time.Time) (MarketSession, bool) {
+	day = day.In(c.Location)
+	y, m, d := day.Date()
+	date := time.Date(y, m, d, 0, 0, 0, 0, c.Location)
+
+	if !c.Weekends && (date.Weekday() == time.Saturday || date.Weekday() == time.Sunday) {
+		return MarketSession{}, false
+	}
+	if _, ok := c.Holiday(date); ok {
+		return MarketSession{}, false
+	}
+
+	closeAt := c.Close
+	early := c.earlyClose != nil && c.earlyClose(date)
+	if early {
+		closeAt = c.EarlyClose
+	}
+	return MarketSession{
+		Date:       date.Format(dateLayout),
+		OpensAt:    time.Date(y, m, d, 0, c.Open, 0, 0, c.Location).UTC(),
+		ClosesAt:   time.Date(y, m, d, 0, closeAt, 0, 0, c.Location).UTC(),
+		EarlyClose: early,
+	}, true
+}
+
+func (c *TradingCalendar) IsOpen(t time.Time) bool {
+	s, ok := c.Session(t)
+	return ok && !t.Before(s.OpensAt) && t.Before(s.ClosesAt)
+}
+
+// NextSession is the session in progress at t, or else the next to open.
+func (c *TradingCalendar) NextSession(t time.Time) MarketSession {
+	local := t.In(c.Location)
+	for i := 0; ; i++ {
+		s, ok := c.Session(local.AddDate(0, 0, i))
+		if ok && t.Before(s.ClosesAt) {
+			return s
+		}
+	}
+}
+
+// closeSchedule runs a cron job a fixed delay after every session's close.
+type closeSchedule struct {
+	calendar *TradingCalendar
+	delay    time.Duration
+}
+
+func (s closeSchedule) Next(t time.Time) time.Time {
+	// The run due next belongs to the first session still open delay ago.
+	session := s.calendar.NextSession(t.Add(-s.delay))
+	return session.ClosesAt.Add(s.delay).In(t.Location())
+}
+
+// nyseHoliday follows the NYSE's rules: a holiday on a Sunday is observed the
+// Monday after and one on a Saturday the Friday before, except New Year's Day,
+// which isn't made up when it falls on a Saturday.
+func nyseHoliday(day time.Time) (string, bool) {
+	y, m, d := day.Date()
+	observed := func(month time.Month, date int) bool {
+		holiday := time.Date(y, month, date, 0, 0, 0, 0, day.Location())
+		switch holiday.Weekday() {
+		case time.Saturday:
+			holiday = holiday.AddDate(0, 0, -1)
+		case time.Sunday:
+			holiday = holiday.AddDate(0, 0, 1)
+		}
+		return holiday.Month() == m && holiday.Day() == d
+	}
+	// nthWeekday is the nth given weekday of the month, or the last for n = -1.
+	nthWeekday := func(month time.Month, weekday time.Weekday, n int) bool {
+		if m != month || day.Weekday() != weekday {
+			return false
+		}
+		if n < 0 {
+			return day.AddDate(0, 0, 7).Month() != month
+		}
+		return (d-1)/7+1 == n
+	}
+
+	switch {
+	case m == time.January && d == 1, m == time.January && d == 2 && day.Weekday() == time.Monday:
+		return "New Year's Day", true
+	case nthWeekday(time.January, time.Monday, 3):
+		return "Martin Luther King, Jr. Day", true
+	case nthWeekday(time.February, time.Monday, 3):
+		return "Washington's Birthday", true
+	case day.Equal(easter(y, day.Location()).AddDate(0, 0, -2)):
+		return "Good Friday", true
+	case nthWeekday(time.May, time.Monday, -1):
+		return "Memorial Day", true
+	case y >= 2022 && observed(time.June, 19):
+		return "Juneteenth National Independence Day", true
+	case observed(time.July, 4):
+		return "Independence Day", true
+	case nthWeekday(time.September, time.Monday, 1):
+		return "Labor Day", true
+	case nthWeekday(time.November, time.Thursday, 4):
+		return "Thanksgiving Day", true
+	case observed(time.December, 25):
+		return "Christmas Day", true
+	}
+	return "", false
+}
+
+// nyseEarlyClose covers the 1 p.m. closes on July 3, the day after
+// Thanksgiving and Christmas Eve, when those are trading days.
+func nyseEarlyClose(day time.Time) bool {
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return false
+	}
+	if _, holiday := nyseHoliday(day); holiday {
+		return false
+	}
+
+	_, m, d := day.Date()
+	switch {
+	case m == time.July && d == 3, m == time.December && d == 24:
+		return true
+	case m == time.November && day.Weekday() == time.Friday:
+		_, thanksgiving := nyseHoliday(day.AddDate(0, 0, -1))
+		return thanksgiving
+	}
+	return false
+}
+
+// easter is Easter Sunday in the Gregorian calendar (the anonymous
+// Meeus/Jones/Butcher algorithm).
+func easter(year int, location *time.Location) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, location)
+}
+
+// GetMarketStatus reports whether the market is open now, the current or
+// next session, and why it's shut today if it is a holiday.
+func GetMarketStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	session := marketCalendar.NextSession(now)
+	open := marketCalendar.IsOpen(now)
+
+	status := map[string]interface{}{
+		"calendar": marketCalendar.Name,
+		"timezone": marketCalendar.Location.String(),
+		"now":      now,
+		"is_open":  open,
+		"session":  session,
+	}
+	if open {
+		status["next_close"] = session.ClosesAt
+	} else {
+		status["next_open"] = session.OpensAt
+	}
+	if holiday, ok := marketCalendar.Holiday(now); ok {
+		status["holiday"] = holiday
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// queuesClosedMarketOrders reports whether the user wants market orders sent
+// while the market is closed kept for the next open rather than rejected.
+func queuesClosedMarketOrders(userId int) (bool, error) {
+	var mode string
+	err := db.QueryRow("SELECT closed_market_orders FROM users WHERE id = ?", userId).Scan(&mode)
+	return mode == "queue", err
+}
+
+// SetClosedMarketOrders picks what happens to market orders sent while the
+// market is closed. Like trades, it applies to a competition account with
+// ?competition=.
+func SetClosedMarketOrders(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.Mode != "reject" && req.Mode != "queue" {
+		http.Error(w, "Mode must be reject or queue", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET closed_market_orders = ? WHERE id = ?", req.Mode, userId); err != nil {
+		http.Error(w, "Failed to update closed market order handling", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"closed_market_orders": req.Mode})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func nyseCalendar(t *testing.T, extraHolidays ...string) *TradingCalendar {
+	t.Helper()
+
+	c, err := newTradingCalendar(MarketOptions{Calendar: "nyse", ExtraHolidays: extraHolidays})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNYSEHoliday(t *testing.T) {
+	c := nyseCalendar(t)
+
+	tests := []struct {
+		date string
+		want string
+	}{
+		{"2025-01-01", "New Year's Day"},
+		{"2023-01-02", "New Year's Day"}, // Jan 1 was a Sunday
+		{"2021-12-31", ""},               // Jan 1, 2022 was a Saturday and isn't made up
+		{"2025-01-20", "Martin Luther King, Jr. Day"},
+		{"2025-02-17", "Washington's Birthday"},
+		{"2024-03-29", "Good Friday"},
+		{"2025-04-18", "Good Friday"},
+		{"2025-04-21", ""}, // Easter Monday
+		{"2025-05-26", "Memorial Day"},
+		{"2024-05-20", ""}, // not the last Monday of May
+		{"2021-06-18", ""}, // before Juneteenth was observed
+		{"2022-06-20", "Juneteenth National Independence Day"},
+		{"2025-06-19", "Juneteenth National Independence Day"},
+		{"2025-07-04", "Independence Day"},
+		{"2026-07-03", "Independence Day"}, // July 4 is a Saturday
+		{"2025-09-01", "Labor Day"},
+		{"2025-11-27", "Thanksgiving Day"},
+		{"2025-11-20", ""}, // third Thursday
+		{"2025-12-25", "Christmas Day"},
+		{"2022-12-26", "Christmas Day"}, // Dec 25 was a Sunday
+		{"2025-03-12", ""},
+	}
+	for _, tt := range tests {
+		day, err := time.ParseInLocation(dateLayout, tt.date, c.Location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := nyseHoliday(day)
+		if got != tt.want {
+			t.Errorf("nyseHoliday(%s) = %q, want %q", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestNYSEEarlyClose(t *testing.T) {
+	c := nyseCalendar(t)
+
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"2025-07-03", true},
+		{"2025-11-28", true},
+		{"2025-12-24", true},
+		{"2026-07-03", false}, // the observed Independence Day
+		{"2022-12-24", false}, // a Saturday
+		{"2025-11-21", false},
+		{"2025-12-23", false},
+	}
+	for _, tt := range tests {
+		day, err := time.ParseInLocation(dateLayout, tt.date, c.Location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nyseEarlyClose(day); got != tt.want {
+			t.Errorf("nyseEarlyClose(%s) = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestEaster(t *testing.T) {
+	tests := map[int]string{
+		2000: "2000-04-23",
+		2019: "2019-04-21",
+		2024: "2024-03-31",
+		2025: "2025-04-20",
+		2038: "2038-04-25",
+	}
+	for year, want := range tests {
+		if got := easter(year, time.UTC).Format(dateLayout); got != want {
+			t.Errorf("easter(%d) = %s, want %s", year, got, want)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	c := nyseCalendar(t, "2025-01-09")
+
+	tests := []struct {
+		name    string
+		day     string
+		ok      bool
+		opensAt string
+		closes  string
+		early   bool
+	}{
+		{"standard time", "2025-03-07", true, "2025-03-07T14:30:00Z", "2025-03-07T21:00:00Z", false},
+		{"daylight saving time", "2025-03-10", true, "2025-03-10T13:30:00Z", "2025-03-10T20:00:00Z", false},
+		{"early close in summer", "2025-07-03", true, "2025-07-03T13:30:00Z", "2025-07-03T17:00:00Z", true},
+		{"early close in winter", "2025-11-28", true, "2025-11-28T14:30:00Z", "2025-11-28T18:00:00Z", true},
+		{"weekend", "2025-03-08", false, "", "", false},
+		{"holiday", "2025-12-25", false, "", "", false},
+		{"extra holiday", "2025-01-09", false, "", "", false},
+	}
+	for _, tt := range tests {
+		day, err := time.ParseInLocation(dateLayout, tt.day, c.Location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, ok := c.Session(day)
+		if ok != tt.ok {
+			t.Errorf("%s: Session(%s) ok = %v, want %v", tt.name, tt.day, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := s.OpensAt.Format(time.RFC3339); got != tt.opensAt {
+			t.Errorf("%s: opens at %s, want %s", tt.name, got, tt.opensAt)
+		}
+		if got := s.ClosesAt.Format(time.RFC3339); got != tt.closes {
+			t.Errorf("%s: closes at %s, want %s", tt.name, got, tt.closes)
+		}
+		if s.EarlyClose != tt.early {
+			t.Errorf("%s: early close = %v, want %v", tt.name, s.EarlyClose, tt.early)
+		}
+	}
+}
+
+func TestNextSession(t *testing.T) {
+	c := nyseCalendar(t)
+
+	tests := []struct {
+		name string
+		at   string
+		want string
+		open bool
+	}{
+		{"during a session", "2025-03-10T15:00:00Z", "2025-03-10", true},
+		{"before the open", "2025-03-10T13:00:00Z", "2025-03-10", false},
+		{"at the close", "2025-03-10T20:00:00Z", "2025-03-11", false},
+		{"over a weekend", "2025-03-08T12:00:00Z", "2025-03-10", false},
+		{"over Good Friday", "2025-04-17T21:00:00Z", "2025-04-21", false},
+		{"after an early close", "2025-11-28T18:30:00Z", "2025-12-01", false},
+	}
+	for _, tt := range tests {
+		at, err := time.Parse(time.RFC3339, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.NextSession(at).Date; got != tt.want {
+			t.Errorf("%s: NextSession(%s) = %s, want %s", tt.name, tt.at, got, tt.want)
+		}
+		if got := c.IsOpen(at); got != tt.open {
+			t.Errorf("%s: IsOpen(%s) = %v, want %v", tt.name, tt.at, got, tt.open)
+		}
+	}
+}
+
+func TestClosedMarketOrdersFollowTheAccount(t *testing.T) {
+	setupTestDB(t)
+	// A calendar whose sessions open and close at midnight is never open.
+	marketCalendar = &TradingCalendar{Name: "closed", Location: time.UTC}
+
+	userId := createTestUser(t, "trader")
+	competitionId, accounts := createTestCompetition(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), userId)
+	competition := fmt.Sprintf("?competition=%d", competitionId)
+
+	steps := []struct {
+		method, target, body string
+		status               int
+	}{
+		// The main account queues while the competition account still rejects.
+		{"PUT", "/closed-market-orders", `{"mode":"queue"}`, http.StatusOK},
+		{"POST", "/trade" + competition, `{"symbol":"AAPL","quantity":1,"trade_type":"buy","order_type":"market"}`, http.StatusConflict},
+		{"POST", "/trade", `{"symbol":"AAPL","quantity":1,"trade_type":"buy","order_type":"market"}`, http.StatusCreated},
+		// Then the other way around.
+		{"PUT", "/closed-market-orders", `{"mode":"reject"}`, http.StatusOK},
+		{"PUT", "/closed-market-orders" + competition, `{"mode":"queue"}`, http.StatusOK},
+		{"POST", "/trade", `{"symbol":"AAPL","quantity":1,"trade_type":"buy","order_type":"market"}`, http.StatusConflict},
+		{"POST", "/trade" + competition, `{"symbol":"AAPL","quantity":1,"trade_type":"buy","order_type":"market"}`, http.StatusCreated},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		r := asUser(userId, step.method, step.target, step.body)
+		if step.method == "PUT" {
+			SetClosedMarketOrders(w, r)
+		} else {
+			MakeTrade(w, r)
+		}
+		if w.Code != step.status {
+			t.Errorf("%s %s %s: status %d, want %d: %s", step.method, step.target, step.body, w.Code, step.status, w.Body.String())
+		}
+	}
+
+	var queued int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orders WHERE user_id = ? AND status = 'open'", accounts[0]).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("%d orders queued on the competition account, want 1", queued)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxCommentLength = 2000
+	// commentEditWindow is how long after posting a comment its author may
+	// still change it.
+	commentEditWindow = 15 * time.Minute
+)
+
+type Comment struct {
+	Id          int        `json:"id"`
+	PostId      int        `json:"post_id"`
+	ParentId    *int       `json:"parent_id"`
+	UserId      int        `json:"-"`
+	Username    string     `json:"username"`
+	Body        string     `json:"body"`
+	CreatedAt   time.Time  `json:"created_at"`
+	EditedAt    *time.Time `json:"edited_at"`
+	Deleted     bool       `json:"deleted"`
+	Likes       int        `json:"likes"`
+	LikedByUser bool       `json:"liked_by_user"`
+	Replies     []Comment  `json:"replies,omitempty"`
+}
+
+// commentColumns take the viewer's id as their one parameter, for
+// liked_by_user.
+const commentColumns = `c.id, c.post_id, c.parent_id, c.user_id, u.username, c.body, c.created_at, c.edited_at,
+	c.deleted_at IS NOT NULL,
+	(SELECT COUNT(*) FROM comments_likes WHERE comment_id = c.id),
+	EXISTS(SELECT 1 FROM comments_likes WHERE comment_id = c.id AND user_id = ?)`
+
+func scanComment(row rowScanner) (Comment, error) {
+	var c Comment
+	var parentId sql.NullInt64
+	var editedAt sql.NullTime
+	err := row.Scan(&c.Id, &c.PostId, &parentId, &c.UserId, &c.Username, &c.Body, &c.CreatedAt, &editedAt,
+		&c.Deleted, &c.Likes, &c.LikedByUser)
+	if err != nil {
+		return c, err
+	}
+	if parentId.Valid {
+		id := int(parentId.Int64)
+		c.ParentId = &id
+	}
+	if editedAt.Valid {
+		c.EditedAt = &editedAt.Time
+	}
+	// Deleted comments stay in their thread without saying who wrote what.
+	if c.Deleted {
+		c.Username, c.Body = "", ""
+	}
+	return c, nil
+}
+
+func getComment(viewerId, commentId int) (Comment, error) {
+	return scanComment(db.QueryRow(`
+		SELECT `+commentColumns+` FROM comments c JOIN users u ON u.id = c.user_id WHERE c.id = ?
+	`, viewerId, commentId))
+}
+
+func postExists(postId int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ?)", postId).Scan(&exists)
+	return exists, err
+}
+
+func commentBody(body string) (string, bool) {
+	body = strings.TrimSpace(body)
+	return body, body != "" && len([]rune(body)) <= maxCommentLength
+}
+
+// GetComments returns a post's comments oldest first, with replies nested
+// under the comment they answer. Deleted comments only show up as
+// placeholders for replies that are still there.
+func GetComments(w http.ResponseWriter, r *http.Request) {
+	postId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid post id", http.StatusBadRequest)
+		return
+	}
+	if exists, err := postExists(postId); err != nil {
+		http.Error(w, "Failed to get post", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+commentColumns+` FROM comments c JOIN users u ON u.id = c.user_id
+		WHERE c.post_id = ? ORDER BY c.id
+	`, getUserIdFromSession(r), postId)
+	if err != nil {
+		fmt.Println("Error fetching comments:", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var threads []Comment
+	index := make(map[int]int)
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			http.Error(w, "Failed to scan comment row", http.StatusInternalServerError)
+			return
+		}
+		if c.ParentId == nil {
+			index[c.Id] = len(threads)
+			threads = append(threads, c)
+		} else if i, ok := index[*c.ParentId]; ok && !c.Deleted {
+			threads[i].Replies = append(threads[i].Replies, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+
+	comments := []Comment{}
+	for _, c := range threads {
+		if c.Deleted && len(c.Replies) == 0 {
+			continue
+		}
+		comments = append(comments, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+// CreateComment comments on a post, or replies to a comment on it with
+// parent_id. Replies to a reply join the thread of the comment it answers.
+func CreateComment(w http.ResponseWriter, r *http.Request) {
+	postId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid post id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Body     string `json:"body"`
+		ParentId *int   `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	body, ok := commentBody(req.Body)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Comment must be between 1 and %d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	var postAuthorId int
+	var symbol string
+	err = db.QueryRow("SELECT user_id, symbol FROM posts WHERE id = ?", postId).Scan(&postAuthorId, &symbol)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get post", http.StatusInternalServerError)
+		return
+	}
+
+	userId := getUserIdFromSession(r)
+	var parent *Comment
+	if req.ParentId != nil {
+		p, err := getComment(userId, *req.ParentId)
+		if err == sql.ErrNoRows || err == nil && (p.PostId != postId || p.Deleted) {
+			http.Error(w, "Parent comment not found", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get parent comment", http.StatusInternalServerError)
+			return
+		}
+		parent = &p
+		if p.ParentId != nil {
+			req.ParentId = p.ParentId
+		}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO comments (post_id, user_id, parent_id, body) VALUES (?, ?, ?, ?)
+	`, postId, userId, req.ParentId, body)
+	if err != nil {
+		fmt.Println("Error creating comment:", err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	comment, err := getComment(userId, int(id))
+	if err != nil {
+		http.Error(w, "Failed to get comment", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"post_id":    postId,
+		"comment_id": comment.Id,
+		"user_id":    userId,
+		"username":   comment.Username,
+	}
+	if parent != nil && parent.UserId != userId {
+		notify(parent.UserId, "comment_replied", comment.Username+" replied to your comment", data)
+	}
+	if postAuthorId != userId && (parent == nil || parent.UserId != postAuthorId) {
+		notify(postAuthorId, "post_commented", fmt.Sprintf("%s commented on your %s post", comment.Username, symbol), data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// ownComment loads a comment the signed-in user wrote and hasn't deleted.
+// Otherwise it writes the error response and returns false.
+func ownComment(w http.ResponseWriter, r *http.Request) (Comment, bool) {
+	commentId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid comment id", http.StatusBadRequest)
+		return Comment{}, false
+	}
+
+	userId := getUserIdFromSession(r)
+	c, err := getComment(userId, commentId)
+	if err == sql.ErrNoRows || err == nil && c.Deleted {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return c, false
+	} else if err != nil {
+		http.Error(w, "Failed to get comment", http.StatusInternalServerError)
+		return c, false
+	}
+	if c.UserId != userId {
+		http.Error(w, "You can only change your own comments", http.StatusForbidden)
+		return c, false
+	}
+	return c, true
+}
+
+func UpdateComment(w http.ResponseWriter, r *http.Request) {
+	c, ok := ownComment(w, r)
+	if !ok {
+		return
+	}
+	if time.Since(c.CreatedAt) > commentEditWindow {
+		http.Error(w, fmt.Sprintf("Comments can only be edited within %d minutes of posting", int(commentEditWindow.Minutes())), http.StatusConflict)
+		return
+	}
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	body, valid := commentBody(req.Body)
+	if !valid {
+		http.Error(w, fmt.Sprintf("Comment must be between 1 and %d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	if body != c.Body {
+		_, err := db.Exec(`
+			UPDATE comments SET body = ?, edited_at = ? WHERE id = ? AND deleted_at IS NULL
+		`, body, time.Now().UTC(), c.Id)
+		if err != nil {
+			http.Error(w, "Failed to update comment", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	updated, err := getComment(c.UserId, c.Id)
+	if err != nil {
+		http.Error(w, "Failed to get comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteComment soft-deletes a comment so that its replies keep their place.
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+	c, ok := ownComment(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("UPDATE comments SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), c.Id)
+	if err != nil {
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Comment deleted",
+		"comment_id": c.Id,
+	})
+}
+
+// ToggleCommentLike likes or unlikes a comment the same way ToggleLike does a
+// post.
+func ToggleCommentLike(w http.ResponseWriter, r *http.Request) {
+	commentId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid comment id", http.StatusBadRequest)
+		return
+	}
+	userId := getUserIdFromSession(r)
+
+	c, err := getComment(userId, commentId)
+	if err == sql.ErrNoRows || err == nil && c.Deleted && !c.LikedByUser {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get comment", http.StatusInternalServerError)
+		return
+	}
+
+	liked, likesCount, err := toggleLike("comments_likes", "comment_id", commentId, userId)
+	if err != nil {
+		fmt.Println("Error toggling comment like:", err)
+		http.Error(w, "Failed to toggle like", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"likes":         likesCount,
+		"liked_by_user": liked,
+	})
+}
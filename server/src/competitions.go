@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrCompetitionNotFound = errors.New("competition not found")
+var ErrNotInCompetition = errors.New("not a participant in this competition")
+var ErrAlreadyJoined = errors.New("already joined this competition")
+var ErrCompetitionClosed = errors.New("competition is not open")
+
+const maxCompetitionNameLength = 100
+
+// Invite codes skip characters that are easy to misread, like 0 and O.
+const inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const inviteCodeLength = 8
+
+type Competition struct {
+	Id              int        `json:"id"`
+	Name            string     `json:"name"`
+	CreatedBy       int        `json:"-"`
+	StartingBalance Money      `json:"starting_balance"`
+	AllowedSymbols  []string   `json:"allowed_symbols"`
+	StartsAt        time.Time  `json:"starts_at"`
+	EndsAt          time.Time  `json:"ends_at"`
+	InviteCode      string     `json:"invite_code"`
+	FinalizedAt     *time.Time `json:"finalized_at"`
+	Participants    int        `json:"participants"`
+	Status          string     `json:"status"`
+	Joined          bool       `json:"joined"`
+	IsCreator       bool       `json:"is_creator"`
+}
+
+const competitionColumns = `c.id, c.name, c.created_by, c.starting_balance, c.starts_at, c.ends_at,
+	c.invite_code, c.finalized_at, (SELECT COUNT(*) FROM competition_entries WHERE competition_id = c.id)`
+
+func scanCompetition(row rowScanner) (Competition, error) {
+	var c Competition
+	var finalizedAt sql.NullTime
+	err := row.Scan(&c.Id, &c.Name, &c.CreatedBy, &c.StartingBalance, &c.StartsAt, &c.EndsAt,
+		&c.InviteCode, &finalizedAt, &c.Participants)
+	if err != nil {
+		return c, err
+	}
+	if finalizedAt.Valid {
+		c.FinalizedAt = &finalizedAt.Time
+	}
+	c.Status = c.status(time.Now().UTC())
+	return c, nil
+}
+
+func loadCompetition(q queryer, competitionId int) (Competition, error) {
+	c, err := scanCompetition(q.QueryRow("SELECT "+competitionColumns+" FROM competitions c WHERE c.id = ?", competitionId))
+	if err == sql.ErrNoRows {
+		return c, ErrCompetitionNotFound
+	} else if err != nil {
+		return c, err
+	}
+
+	c.AllowedSymbols, err = competitionSymbols(q, competitionId)
+	return c, err
+}
+
+func competitionSymbols(q queryer, competitionId int) ([]string, error) {
+	rows, err := q.Query("SELECT symbol FROM competition_symbols WHERE competition_id = ? ORDER BY symbol", competitionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	symbols := []string{}
+	for rows.Next() {
+		var symbol string
+		if err := rows.Scan(&symbol); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, symbol)
+	}
+	return symbols, rows.Err()
+}
+
+// status is upcoming, active, ended (past its end but not yet finalized) or
+// final once the standings are frozen.
+func (c Competition) status(now time.Time) string {
+	switch {
+	case c.FinalizedAt != nil:
+		return "final"
+	case now.Before(c.StartsAt):
+		return "upcoming"
+	case now.Before(c.EndsAt):
+		return "active"
+	}
+	return "ended"
+}
+
+func (c Competition) isOpen(now time.Time) bool {
+	return c.status(now) == "active"
+}
+
+// allowsSymbol is true for every symbol when the competition doesn't limit
+// them.
+func (c Competition) allowsSymbol(symbol string) bool {
+	if len(c.AllowedSymbols) == 0 {
+		return true
+	}
+	symbol = normalizeSymbol(symbol)
+	for _, allowed := range c.AllowedSymbols {
+		if allowed == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+// competitionAccount finds the account userId trades with in a competition.
+func competitionAccount(competitionId, userId int) (Competition, int, error) {
+	competition, err := loadCompetition(db, competitionId)
+	if err != nil {
+		return competition, 0, err
+	}
+
+	var accountId int
+	err = db.QueryRow(`
+		SELECT account_id FROM competition_entries WHERE competition_id = ? AND user_id = ?
+	`, competitionId, userId).Scan(&accountId)
+	if err == sql.ErrNoRows {
+		return competition, 0, ErrNotInCompetition
+	}
+	return competition, accountId, err
+}
+
+// accountOwner is the user behind an account: the account itself for a main
+// account, the participant for a competition account. competitionId is 0 for
+// main accounts.
+func accountOwner(q queryer, accountId int) (ownerId, competitionId int, err error) {
+	err = q.QueryRow(`
+		SELECT COALESCE(ce.user_id, u.id), COALESCE(ce.competition_id, 0)
+		FROM users u
+		LEFT JOIN competition_entries ce ON ce.account_id = u.id
+		WHERE u.id = ?
+	`, accountId).Scan(&ownerId, &competitionId)
+	return ownerId, competitionId, err
+}
+
+// accountForRequest picks the account a request acts on: the signed-in user's
+// own, or their account in the competition named by ?competition=. When there
+// is no such account it writes the error response and returns false.
+func accountForRequest(w http.ResponseWriter, r *http.Request) (int, *Competition, bool) {
+	userId := getUserIdFromSession(r)
+
+	value := r.URL.Query().Get("competition")
+	if value == "" {
+		return userId, nil, true
+	}
+
+	competitionId, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, "Invalid competition id", http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	competition, accountId, err := competitionAccount(competitionId, userId)
+	if err == ErrCompetitionNotFound {
+		http.Error(w, "Competition not found", http.StatusNotFound)
+		return 0, nil, false
+	} else if err == ErrNotInCompetition {
+		http.Error(w, "You have not joined this competition", http.StatusForbidden)
+		return 0, nil, false
+	} else if err != nil {
+		fmt.Println("Error getting competition account:", err)
+		http.Error(w, "Failed to get competition", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+
+	return accountId, &competition, true
+}
+
+// closedCompetitionAccounts selects the accounts of competitions that have
+// ended, which must not trade any more. Its one parameter is the current time.
+const closedCompetitionAccounts = `
+	SELECT e.account_id FROM competition_entries e
+	JOIN competitions c ON c.id = e.competition_id
+	WHERE c.finalized_at IS NOT NULL OR c.ends_at <= ?`
+
+func newInviteCode() (string, error) {
+	buf := make([]byte, inviteCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i := range buf {
+		buf[i] = inviteCodeAlphabet[int(buf[i])%len(inviteCodeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+func CreateCompetition(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	var req struct {
+		Name            string     `json:"name"`
+		StartingBalance *Money     `json:"starting_balance"`
+		AllowedSymbols  []string   `json:"allowed_symbols"`
+		StartsAt        *time.Time `json:"starts_at"`
+		EndsAt          time.Time  `json:"ends_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxCompetitionNameLength {
+		http.Error(w, fmt.Sprintf("Name must be between 1 and %d characters", maxCompetitionNameLength), http.StatusBadRequest)
+		return
+	}
+
+	startingBalance := cfg.StartingBalance
+	if req.StartingBalance != nil {
+		startingBalance = *req.StartingBalance
+	}
+	if startingBalance <= 0 {
+		http.Error(w, "Starting balance must be greater than 0", http.StatusBadRequest)
+		return
+	}
+
+	startsAt := now
+	if req.StartsAt != nil {
+		startsAt = req.StartsAt.UTC()
+	}
+	endsAt := req.EndsAt.UTC()
+	if !endsAt.After(startsAt) || !endsAt.After(now) {
+		http.Error(w, "ends_at must be in the future and after starts_at", http.StatusBadRequest)
+		return
+	}
+
+	var symbols []string
+	seen := make(map[string]bool)
+	for _, symbol := range req.AllowedSymbols {
+		symbol = normalizeSymbol(symbol)
+		if symbol == "" {
+			http.Error(w, "Allowed symbols must not be blank", http.StatusBadRequest)
+			return
+		}
+		if _, err := resolveInstrument(symbol); err == ErrUnknownSymbol {
+			http.Error(w, "Unknown symbol "+symbol, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			fmt.Println("Error resolving instrument:", err)
+			http.Error(w, "Failed to create competition", http.StatusInternalServerError)
+			return
+		}
+		if !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	inviteCode, err := newInviteCode()
+	if err != nil {
+		http.Error(w, "Failed to create invite code", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO competitions (name, created_by, starting_balance, starts_at, ends_at, invite_code)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, req.Name, userId, startingBalance, startsAt, endsAt, inviteCode)
+	if err != nil {
+		fmt.Println("Error creating competition:", err)
+		http.Error(w, "Failed to create competition", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	for _, symbol := range symbols {
+		if _, err := tx.Exec("INSERT INTO competition_symbols (competition_id, symbol) VALUES (?, ?)", id, symbol); err != nil {
+			http.Error(w, "Failed to create competition", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	competition, err := loadCompetition(tx, int(id))
+	if err != nil {
+		http.Error(w, "Failed to get competition", http.StatusInternalServerError)
+		return
+	}
+	competition.IsCreator = true
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(competition)
+}
+
+// GetCompetitions lists the competitions the user created or joined, newest
+// first.
+func GetCompetitions(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	rows, err := db.Query(`
+		SELECT `+competitionColumns+`,
+			EXISTS (SELECT 1 FROM competition_entries WHERE competition_id = c.id AND user_id = ?)
+		FROM competitions c
+		WHERE c.created_by = ? OR c.id IN (SELECT competition_id FROM competition_entries WHERE user_id = ?)
+		ORDER BY c.starts_at DESC, c.id DESC
+	`, userId, userId, userId)
+	if err != nil {
+		http.Error(w, "Failed to fetch competitions", http.StatusInternalServerError)
+		return
+	}
+
+	competitions := []Competition{}
+	for rows.Next() {
+		var c Competition
+		var finalizedAt sql.NullTime
+		err := rows.Scan(&c.Id, &c.Name, &c.CreatedBy, &c.StartingBalance, &c.StartsAt, &c.EndsAt,
+			&c.InviteCode, &finalizedAt, &c.Participants, &c.Joined)
+		if err != nil {
+			rows.Close()
+			http.Error(w, "Failed to scan competition row", http.StatusInternalServerError)
+			return
+		}
+		if finalizedAt.Valid {
+			c.FinalizedAt = &finalizedAt.Time
+		}
+		c.Status = c.status(time.Now().UTC())
+		c.IsCreator = c.CreatedBy == userId
+		competitions = append(competitions, c)
+	}
+	rows.Close()
+
+	for i := range competitions {
+		if competitions[i].AllowedSymbols, err = competitionSymbols(db, competitions[i].Id); err != nil {
+			http.Error(w, "Failed to fetch competition symbols", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(competitions)
+}
+
+// viewCompetition loads a competition for its creator or one of its
+// participants; anyone else gets ErrCompetitionNotFound. accountId is 0 when
+// the viewer hasn't joined.
+func viewCompetition(competitionId, userId int) (Competition, int, error) {
+	competition, accountId, err := competitionAccount(competitionId, userId)
+	if err == ErrNotInCompetition && competition.CreatedBy == userId {
+		err = nil
+	} else if err == ErrNotInCompetition {
+		err = ErrCompetitionNotFound
+	}
+	competition.Joined = accountId != 0
+	competition.IsCreator = competition.CreatedBy == userId
+	return competition, accountId, err
+}
+
+func GetCompetition(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	competitionId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid competition id", http.StatusBadRequest)
+		return
+	}
+
+	competition, _, err := viewCompetition(competitionId, userId)
+	if err == ErrCompetitionNotFound {
+		http.Error(w, "Competition not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get competition", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(competition)
+}
+
+// joinCompetition opens the user's account in the competition with the
+// invite code, funded with the competition's starting balance. The account is
+// a users row of its own that nobody can log in to.
+func joinCompetition(userId int, inviteCode string) (Competition, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Competition{}, err
+	}
+	defer tx.Rollback()
+
+	var competitionId int
+	err = tx.QueryRow("SELECT id FROM competitions WHERE invite_code = ?", inviteCode).Scan(&competitionId)
+	if err == sql.ErrNoRows {
+		return Competition{}, ErrCompetitionNotFound
+	} else if err != nil {
+		return Competition{}, err
+	}
+
+	competition, err := loadCompetition(tx, competitionId)
+	if err != nil {
+		return competition, err
+	}
+	if status := competition.status(time.Now().UTC()); status == "ended" || status == "final" {
+		return competition, ErrCompetitionClosed
+	}
+
+	var joined bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM competition_entries WHERE competition_id = ? AND user_id = ?)
+	`, competitionId, userId).Scan(&joined)
+	if err != nil {
+		return competition, err
+	}
+	if joined {
+		return competition, ErrAlreadyJoined
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO users (first_name, last_name, email, username, password, balance)
+		SELECT first_name, last_name, ?, ?, '', 0 FROM users WHERE id = ?
+	`, fmt.Sprintf("competition-%d-user-%d@competitions.invalid", competitionId, userId),
+		fmt.Sprintf("competition:%d:user:%d", competitionId, userId), userId)
+	if err != nil {
+		return competition, fmt.Errorf("create competition account: %w", err)
+	}
+	accountId, _ := result.LastInsertId()
+
+	if err := postCash(tx, int(accountId), ledgerOpeningBalance, accountCapital, competition.StartingBalance, 0, "Competition starting balance"); err != nil {
+		return competition, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO competition_entries (competition_id, user_id, account_id) VALUES (?, ?, ?)
+	`, competitionId, userId, accountId)
+	if err != nil {
+		return competition, fmt.Errorf("record competition entry: %w", err)
+	}
+
+	competition.Participants++
+	competition.Joined = true
+	competition.IsCreator = competition.CreatedBy == userId
+	return competition, tx.Commit()
+}
+
+func JoinCompetition(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	var req struct {
+		InviteCode string `json:"invite_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	competition, err := joinCompetition(userId, strings.ToUpper(strings.TrimSpace(req.InviteCode)))
+	if err == ErrCompetitionNotFound {
+		http.Error(w, "Invalid invite code", http.StatusNotFound)
+		return
+	} else if err == ErrCompetitionClosed {
+		http.Error(w, "Competition has ended", http.StatusConflict)
+		return
+	} else if err == ErrAlreadyJoined {
+		http.Error(w, "You have already joined this competition", http.StatusConflict)
+		return
+	} else if err != nil {
+		fmt.Println("Error joining competition:", err)
+		http.Error(w, "Failed to join competition", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(competition)
+}
+
+// finalStandings are the entries frozen when the competition was finalized,
+// in final rank order.
+func finalStandings(competition Competition) ([]LeaderboardEntry, error) {
+	rows, err := db.Query(`
+		SELECT e.account_id, u.username, e.final_rank, e.final_equity
+		FROM competition_entries e
+		JOIN users u ON u.id = e.user_id
+		WHERE e.competition_id = ?
+		ORDER BY e.final_rank, u.username
+	`, competition.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.UserId, &e.Username, &e.Rank, &e.Equity); err != nil {
+			return nil, err
+		}
+		all := percentReturn(competition.StartingBalance, e.Equity)
+		e.Returns = map[string]*float64{"all": all}
+		if all != nil {
+			e.GainLoss = *all
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// finalizeCompetitions freezes the standings of every competition that has
+// ended. Open orders in it are cancelled first so nothing fills afterwards.
+func finalizeCompetitions() {
+	now := time.Now().UTC()
+	rows, err := db.Query("SELECT id FROM competitions WHERE finalized_at IS NULL AND ends_at <= ?", now)
+	if err != nil {
+		fmt.Println("Error querying ended competitions:", err)
+		return
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			fmt.Println("Error scanning competition:", err)
+			rows.Close()
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := finalizeCompetition(id, now); err != nil {
+			fmt.Printf("Error finalizing competition %d: %v\n", id, err)
+			continue
+		}
+		fmt.Printf("Finalized competition %d\n", id)
+	}
+}
+
+func finalizeCompetition(competitionId int, now time.Time) error {
+	competition, err := loadCompetition(db, competitionId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', status_reason = 'competition ended', reserved_cash = 0,
+			reserved_shares = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE status = 'open' AND user_id IN (SELECT account_id FROM competition_entries WHERE competition_id = ?)
+	`, competitionId)
+	if err != nil {
+		return fmt.Errorf("cancel open orders: %w", err)
+	}
+
+	// The standings are read through the transaction, which holds the write
+	// lock, so no account in the competition can change while they are worked
+	// out.
+	entries, err := buildLeaderboard(tx, now, competitionId, competition.StartingBalance)
+	if err != nil {
+		return fmt.Errorf("build standings: %w", err)
+	}
+	rankLeaderboard(entries, "equity")
+
+	for _, e := range entries {
+		_, err := tx.Exec(`
+			UPDATE competition_entries SET final_rank = ?, final_equity = ?
+			WHERE competition_id = ? AND account_id = ?
+		`, e.Rank, e.Equity, competitionId, e.UserId)
+		if err != nil {
+			return fmt.Errorf("record standing: %w", err)
+		}
+	}
+
+	result, err := tx.Exec("UPDATE competitions SET finalized_at = ? WHERE id = ? AND finalized_at IS NULL", now, competitionId)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil // finalized in the meantime
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinalizeCompetition(t *testing.T) {
+	setupTestDB(t)
+	winner := createTestUser(t, "winner")
+	loser := createTestUser(t, "loser")
+	idle := createTestUser(t, "idle")
+	competitionId, accounts := createTestCompetition(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), winner, loser, idle)
+
+	// The winner takes $500 of profit; the loser only pays fees. An order
+	// left open when the competition ends must not fill afterwards.
+	tradeAt(t, accounts[0], "AAPL", 10, "buy", 10000)
+	tradeAt(t, accounts[0], "AAPL", 10, "sell", 15000)
+	tradeAt(t, accounts[1], "MSFT", 10, "buy", 10000)
+	limit := Money(100)
+	order, err := placeOrder(accounts[1], "MSFT", 1, "buy", "limit", &limit, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.Exec("UPDATE competitions SET ends_at = ? WHERE id = ?", now.Add(-time.Minute), competitionId); err != nil {
+		t.Fatal(err)
+	}
+	if err := finalizeCompetition(competitionId, now); err != nil {
+		t.Fatal(err)
+	}
+
+	competition, err := loadCompetition(db, competitionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standings, err := finalStandings(competition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fees := func(tradeType string, quantity int, price Money) Money {
+		return cfg.Fees.feesFor(tradeType, quantity, price).Total()
+	}
+	want := []struct {
+		account int
+		rank    int
+		equity  Money
+	}{
+		{accounts[0], 1, cfg.StartingBalance + 50000 - fees("buy", 10, 10000) - fees("sell", 10, 15000)},
+		{accounts[2], 2, cfg.StartingBalance},
+		{accounts[1], 3, cfg.StartingBalance - fees("buy", 10, 10000)},
+	}
+	if len(standings) != len(want) {
+		t.Fatalf("%d final standings, want %d", len(standings), len(want))
+	}
+	for i, w := range want {
+		got := standings[i]
+		if got.UserId != w.account || got.Rank != w.rank || got.Equity != w.equity {
+			t.Errorf("standing %d: account %d rank %d at $%s, want account %d rank %d at $%s",
+				i, got.UserId, got.Rank, got.Equity, w.account, w.rank, w.equity)
+		}
+	}
+
+	var status string
+	var reserved Money
+	if err := db.QueryRow("SELECT status, reserved_cash FROM orders WHERE id = ?", order.Id).Scan(&status, &reserved); err != nil {
+		t.Fatal(err)
+	}
+	if status != "cancelled" || reserved != 0 {
+		t.Errorf("open order is %s holding $%s, want cancelled holding nothing", status, reserved)
+	}
+
+	// Finalizing again, as an overlapping run would, leaves the standings be.
+	tradeAt(t, accounts[1], "MSFT", 10, "sell", 50000)
+	if err := finalizeCompetition(competitionId, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	again, err := finalStandings(competition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range again {
+		if again[i].UserId != standings[i].UserId || again[i].Equity != standings[i].Equity {
+			t.Errorf("standing %d changed after a second finalize: %+v, was %+v", i, again[i], standings[i])
+		}
+	}
+}
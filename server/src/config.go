@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Config is everything that differs between deployments. It is loaded once at
+// startup from an optional JSON file, then environment variables override
+// individual values, so one binary can run staging and production.
+type Config struct {
+	Addr              string               `json:"addr"`
+	DatabasePath      string               `json:"database_path"`
+	CORSOrigins       []string             `json:"cors_origins"`
+	StartingBalance   Money                `json:"starting_balance"`
+	PriceTickInterval Duration             `json:"price_tick_interval"`
+	Quotes            QuoteProviderOptions `json:"quotes"`
+	QuoteCache        QuoteCacheOptions    `json:"quote_cache"`
+	Margin            MarginSettings       `json:"margin"`
+	Fees              FeeSchedule          `json:"fees"`
+	Market            MarketOptions        `json:"market"`
+	Schedules         Schedules            `json:"schedules"`
+	// SecureCookies should be on wherever the server sits behind HTTPS.
+	SecureCookies bool `json:"secure_cookies"`
+	// DebugAddr serves operator-only endpoints such as quote cache stats. It
+	// is off when empty and should only ever be bound to loopback.
+	DebugAddr string `json:"debug_addr"`
+}
+
+// Schedules are standard five-field cron specs or descriptors like "@hourly".
+type Schedules struct {
+	// DailyPrices is empty to follow the trading calendar; see MarketOptions.
+	DailyPrices      string `json:"daily_prices"`
+	PriceHistory     string `json:"price_history"`
+	EquitySnapshots  string `json:"equity_snapshots"`
+	OpenOrders       string `json:"open_orders"`
+	MarginCalls      string `json:"margin_calls"`
+	BorrowFees       string `json:"borrow_fees"`
+	ExpiredSessions  string `json:"expired_sessions"`
+	IdempotencyKeys  string `json:"idempotency_keys"`
+	Competitions     string `json:"competitions"`
+	CorporateActions string `json:"corporate_actions"`
+	PriceAlerts      string `json:"price_alerts"`
+	LeaderboardRanks string `json:"leaderboard_ranks"`
+}
+
+// Duration reads and writes durations as strings like "15s" or "24h".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations must be strings like \"30s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+var cfg Config
+
+const redacted = "[redacted]"
+
+const defaultConfigFile = "config.json"
+
+func defaultConfig() Config {
+	return Config{
+		Addr:              ":5174",
+		DatabasePath:      "./data.db",
+		CORSOrigins:       []string{"http://localhost:5173"},
+		StartingBalance:   1000000, // $10,000.00
+		PriceTickInterval: Duration{15 * time.Second},
+		Quotes: QuoteProviderOptions{
+			Provider:    "simulated",
+			ReplaySpeed: 1,
+		},
+		QuoteCache: QuoteCacheOptions{
+			MaxEntries: 1000,
+			DefaultTTL: Duration{5 * time.Minute},
+			SymbolTTLs: make(map[string]Duration),
+		},
+		Margin: MarginSettings{
+			InitialMargin:     0.5,
+			MaintenanceMargin: 0.25,
+			BorrowRate:        0.03,
+			InterestRate:      0.08,
+			CallGracePeriod:   Duration{24 * time.Hour},
+		},
+		Market: MarketOptions{
+			Calendar:         "nyse",
+			DailyPricesDelay: Duration{10 * time.Minute},
+		},
+		Schedules: Schedules{
+			PriceHistory:    "0 23 * * 1-5",
+			EquitySnapshots: "30 23 * * 1-5",
+			OpenOrders:      "@every 1m",
+			MarginCalls:     "@every 5m",
+			BorrowFees:      "0 0 * * *",
+			ExpiredSessions: "@hourly",
+			IdempotencyKeys: "@hourly",
+			Competitions:    "@every 1m",
+			// Before the US open, so splits land before anyone trades at the
+			// new price.
+			CorporateActions: "0 12 * * *",
+			PriceAlerts:      "@every 1m",
+			LeaderboardRanks: "@every 15m",
+		},
+	}
+}
+
+// loadConfig layers defaults, the config file and the environment, in that
+// order. path falls back to $TRADEX_CONFIG and then ./config.json; only an
+// explicitly named file has to exist.
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+
+	if path == "" {
+		path = os.Getenv("TRADEX_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+
+	file, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return config, fmt.Errorf("%s: %w", path, err)
+		}
+	case explicit || !errors.Is(err, os.ErrNotExist):
+		return config, err
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// envOverrides maps each environment variable onto the config value it
+// replaces.
+var envOverrides = []struct {
+	name  string
+	apply func(c *Config, value string) error
+}{
+	{"TRADEX_ADDR", func(c *Config, v string) error { c.Addr = v; return nil }},
+	{"TRADEX_DEBUG_ADDR", func(c *Config, v string) error { c.DebugAddr = v; return nil }},
+	{"TRADEX_DATABASE_PATH", func(c *Config, v string) error { c.DatabasePath = v; return nil }},
+	{"TRADEX_CORS_ORIGINS", func(c *Config, v string) error {
+		c.CORSOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.CORSOrigins = append(c.CORSOrigins, origin)
+			}
+		}
+		return nil
+	}},
+	{"TRADEX_SECURE_COOKIES", func(c *Config, v string) error {
+		secure, err := strconv.ParseBool(v)
+		c.SecureCookies = secure
+		return err
+	}},
+	{"TRADEX_STARTING_BALANCE", moneyOverride(func(c *Config) *Money { return &c.StartingBalance })},
+	{"TRADEX_PRICE_TICK_INTERVAL", durationOverride(func(c *Config) *Duration { return &c.PriceTickInterval })},
+
+	{"QUOTE_PROVIDER", func(c *Config, v string) error { c.Quotes.Provider = v; return nil }},
+	{"ALPHAVANTAGE_API_KEY", func(c *Config, v string) error { c.Quotes.AlphaVantageKey = v; return nil }},
+	{"QUOTE_SIM_SEED", func(c *Config, v string) error {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		c.Quotes.SimulatedSeed = seed
+		return err
+	}},
+	{"QUOTE_REPLAY_FILE", func(c *Config, v string) error { c.Quotes.ReplayFile = v; return nil }},
+	{"QUOTE_REPLAY_SPEED", floatOverride(func(c *Config) *float64 { return &c.Quotes.ReplaySpeed })},
+
+	{"QUOTE_CACHE_SIZE", func(c *Config, v string) error {
+		size, err := strconv.Atoi(v)
+		c.QuoteCache.MaxEntries = size
+		return err
+	}},
+	{"QUOTE_CACHE_TTL", durationOverride(func(c *Config) *Duration { return &c.QuoteCache.DefaultTTL })},
+	// QUOTE_CACHE_SYMBOL_TTLS looks like "SPY=30s,BRK.A=15m" and is merged
+	// into any per-symbol TTLs from the file.
+	{"QUOTE_CACHE_SYMBOL_TTLS", func(c *Config, v string) error {
+		if c.QuoteCache.SymbolTTLs == nil {
+			c.QuoteCache.SymbolTTLs = make(map[string]Duration)
+		}
+		for _, pair := range strings.Split(v, ",") {
+			symbol, ttlValue, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return fmt.Errorf("expected SYMBOL=duration, got %q", pair)
+			}
+			ttl, err := time.ParseDuration(ttlValue)
+			if err != nil {
+				return fmt.Errorf("%s: %w", symbol, err)
+			}
+			c.QuoteCache.SymbolTTLs[symbol] = Duration{ttl}
+		}
+		return nil
+	}},
+
+	{"MARGIN_INITIAL", floatOverride(func(c *Config) *float64 { return &c.Margin.InitialMargin })},
+	{"MARGIN_MAINTENANCE", floatOverride(func(c *Config) *float64 { return &c.Margin.MaintenanceMargin })},
+	{"MARGIN_BORROW_RATE", floatOverride(func(c *Config) *float64 { return &c.Margin.BorrowRate })},
+	{"MARGIN_INTEREST_RATE", floatOverride(func(c *Config) *float64 { return &c.Margin.InterestRate })},
+	{"MARGIN_CALL_GRACE", durationOverride(func(c *Config) *Duration { return &c.Margin.CallGracePeriod })},
+
+	{"FEE_PER_TRADE", moneyOverride(func(c *Config) *Money { return &c.Fees.PerTrade })},
+	{"FEE_PER_SHARE", floatOverride(func(c *Config) *float64 { return &c.Fees.PerShare })},
+	{"FEE_NOTIONAL_RATE", floatOverride(func(c *Config) *float64 { return &c.Fees.NotionalRate })},
+	{"FEE_MINIMUM", moneyOverride(func(c *Config) *Money { return &c.Fees.Minimum })},
+	{"FEE_SELL_RATE", floatOverride(func(c *Config) *float64 { return &c.Fees.Regulatory.SellRate })},
+	{"FEE_SELL_PER_SHARE", floatOverride(func(c *Config) *float64 { return &c.Fees.Regulatory.SellPerShare })},
+	{"FEE_SELL_PER_SHARE_MAX", moneyOverride(func(c *Config) *Money { return &c.Fees.Regulatory.SellPerShareMax })},
+
+	{"MARKET_CALENDAR", func(c *Config, v string) error { c.Market.Calendar = v; return nil }},
+	{"MARKET_EXTRA_HOLIDAYS", func(c *Config, v string) error {
+		c.Market.ExtraHolidays = nil
+		for _, day := range strings.Split(v, ",") {
+			if day = strings.TrimSpace(day); day != "" {
+				c.Market.ExtraHolidays = append(c.Market.ExtraHolidays, day)
+			}
+		}
+		return nil
+	}},
+	{"MARKET_DAILY_PRICES_DELAY", durationOverride(func(c *Config) *Duration { return &c.Market.DailyPricesDelay })},
+
+	{"TRADEX_SCHEDULE_DAILY_PRICES", func(c *Config, v string) error { c.Schedules.DailyPrices = v; return nil }},
+	{"TRADEX_SCHEDULE_PRICE_HISTORY", func(c *Config, v string) error { c.Schedules.PriceHistory = v; return nil }},
+	{"TRADEX_SCHEDULE_EQUITY_SNAPSHOTS", func(c *Config, v string) error { c.Schedules.EquitySnapshots = v; return nil }},
+	{"TRADEX_SCHEDULE_OPEN_ORDERS", func(c *Config, v string) error { c.Schedules.OpenOrders = v; return nil }},
+	{"TRADEX_SCHEDULE_MARGIN_CALLS", func(c *Config, v string) error { c.Schedules.MarginCalls = v; return nil }},
+	{"TRADEX_SCHEDULE_BORROW_FEES", func(c *Config, v string) error { c.Schedules.BorrowFees = v; return nil }},
+	{"TRADEX_SCHEDULE_EXPIRED_SESSIONS", func(c *Config, v string) error { c.Schedules.ExpiredSessions = v; return nil }},
+	{"TRADEX_SCHEDULE_IDEMPOTENCY_KEYS", func(c *Config, v string) error { c.Schedules.IdempotencyKeys = v; return nil }},
+	{"TRADEX_SCHEDULE_COMPETITIONS", func(c *Config, v string) error { c.Schedules.Competitions = v; return nil }},
+	{"TRADEX_SCHEDULE_CORPORATE_ACTIONS", func(c *Config, v string) error { c.Schedules.CorporateActions = v; return nil }},
+	{"TRADEX_SCHEDULE_PRICE_ALERTS", func(c *Config, v string) error { c.Schedules.PriceAlerts = v; return nil }},
+	{"TRADEX_SCHEDULE_LEADERBOARD_RANKS", func(c *Config, v string) error { c.Schedules.LeaderboardRanks = v; return nil }},
+}
+
+func floatOverride(field func(c *Config) *float64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		parsed, err := strconv.ParseFloat(value, 64)
+		*field(c) = parsed
+		return err
+	}
+}
+
+func moneyOverride(field func(c *Config) *Money) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		parsed, err := ParseMoney(value)
+		*field(c) = parsed
+		return err
+	}
+}
+
+func durationOverride(field func(c *Config) *Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		field(c).Duration = parsed
+		return err
+	}
+}
+
+func (c *Config) applyEnv() error {
+	for _, override := range envOverrides {
+		value, ok := os.LookupEnv(override.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := override.apply(c, value); err != nil {
+			return fmt.Errorf("%s: %w", override.name, err)
+		}
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	if c.Addr == "" {
+		return fmt.Errorf("addr is required")
+	}
+	if c.DatabasePath == "" {
+		return fmt.Errorf("database_path is required")
+	}
+	if len(c.CORSOrigins) == 0 {
+		return fmt.Errorf("at least one CORS origin is required")
+	}
+	for _, origin := range c.CORSOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid CORS origin %q", origin)
+		}
+	}
+	if c.DebugAddr != "" {
+		host, _, err := net.SplitHostPort(c.DebugAddr)
+		if ip := net.ParseIP(host); err != nil || host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("debug_addr must be a loopback address like 127.0.0.1:6060")
+		}
+	}
+	if c.StartingBalance <= 0 {
+		return fmt.Errorf("starting_balance must be positive")
+	}
+	if c.PriceTickInterval.Duration <= 0 {
+		return fmt.Errorf("price_tick_interval must be positive")
+	}
+
+	switch c.Quotes.Provider {
+	case "alphavantage":
+		if c.Quotes.AlphaVantageKey == "" {
+			return fmt.Errorf("quotes.alphavantage_key is required for the alphavantage provider")
+		}
+	case "simulated":
+	case "replay":
+		if c.Quotes.ReplayFile == "" {
+			return fmt.Errorf("quotes.replay_file is required for the replay provider")
+		}
+		if c.Quotes.ReplaySpeed <= 0 {
+			return fmt.Errorf("quotes.replay_speed must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown quote provider %q", c.Quotes.Provider)
+	}
+
+	if c.QuoteCache.MaxEntries <= 0 {
+		return fmt.Errorf("quote_cache.max_entries must be positive")
+	}
+	if c.QuoteCache.DefaultTTL.Duration <= 0 {
+		return fmt.Errorf("quote_cache.default_ttl must be positive")
+	}
+	for symbol, ttl := range c.QuoteCache.SymbolTTLs {
+		if ttl.Duration <= 0 {
+			return fmt.Errorf("quote_cache.symbol_ttls.%s must be positive", symbol)
+		}
+	}
+
+	if err := c.Margin.Validate(); err != nil {
+		return fmt.Errorf("margin: %w", err)
+	}
+
+	if err := c.Fees.Validate(); err != nil {
+		return fmt.Errorf("fees: %w", err)
+	}
+
+	if err := c.Market.Validate(); err != nil {
+		return fmt.Errorf("market: %w", err)
+	}
+
+	schedules := map[string]string{
+		"daily_prices":      c.Schedules.DailyPrices,
+		"price_history":     c.Schedules.PriceHistory,
+		"equity_snapshots":  c.Schedules.EquitySnapshots,
+		"open_orders":       c.Schedules.OpenOrders,
+		"margin_calls":      c.Schedules.MarginCalls,
+		"borrow_fees":       c.Schedules.BorrowFees,
+		"expired_sessions":  c.Schedules.ExpiredSessions,
+		"idempotency_keys":  c.Schedules.IdempotencyKeys,
+		"competitions":      c.Schedules.Competitions,
+		"corporate_actions": c.Schedules.CorporateActions,
+		"price_alerts":      c.Schedules.PriceAlerts,
+		"leaderboard_ranks": c.Schedules.LeaderboardRanks,
+	}
+	for name, spec := range schedules {
+		if name == "daily_prices" && spec == "" {
+			continue
+		}
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return fmt.Errorf("schedules.%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Redacted returns a copy that is safe to print or log.
+func (c Config) Redacted() Config {
+	if c.Quotes.AlphaVantageKey != "" {
+		c.Quotes.AlphaVantageKey = redacted
+	}
+	return c
+}
+
+func runConfigCommand(config Config) error {
+	out, err := json.MarshalIndent(config.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
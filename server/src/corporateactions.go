@@ -0,0 +1,718 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CorporateAction is a cash dividend of Amount dollars a share, or a split
+// that turns every SplitFrom shares into SplitTo.
+type CorporateAction struct {
+	Id         int
+	Symbol     string
+	Type       string
+	ExDate     time.Time
+	RecordDate time.Time
+	PayDate    time.Time
+	Amount     float64
+	SplitTo    int
+	SplitFrom  int
+	Source     string
+}
+
+// CorporateActionProvider is implemented by quote providers that also know
+// about a symbol's dividends and splits, past and announced.
+type CorporateActionProvider interface {
+	CorporateActions(symbol string) ([]CorporateAction, error)
+}
+
+// Ledger transaction kinds for corporate actions. They're income, not
+// external flows, so they count towards returns.
+const (
+	ledgerDividend   = "dividend"
+	ledgerCashInLieu = "cash_in_lieu"
+)
+
+const corporateActionKinds = "('dividend', 'cash_in_lieu')"
+
+func (a CorporateAction) Validate() error {
+	if a.Symbol == "" {
+		return fmt.Errorf("symbol is required")
+	}
+	if a.ExDate.IsZero() {
+		return fmt.Errorf("ex_date is required")
+	}
+	switch a.Type {
+	case "dividend":
+		if a.Amount <= 0 {
+			return fmt.Errorf("dividend amount must be greater than 0")
+		}
+		if a.PayDate.Before(a.RecordDate) {
+			return fmt.Errorf("pay_date must not be before record_date")
+		}
+	case "split":
+		if a.SplitTo <= 0 || a.SplitFrom <= 0 || a.SplitTo == a.SplitFrom {
+			return fmt.Errorf("split ratio must be two different positive numbers")
+		}
+	default:
+		return fmt.Errorf("type must be dividend or split")
+	}
+	return nil
+}
+
+// ratioFromFactor turns a split factor like 1.5 or 0.1 into the smallest
+// whole-share ratio, 3:2 or 1:10.
+func ratioFromFactor(factor float64) (to, from int, ok bool) {
+	if factor <= 0 || math.IsInf(factor, 0) || math.IsNaN(factor) {
+		return 0, 0, false
+	}
+	for d := 1; d <= 1000; d++ {
+		n := factor * float64(d)
+		if math.Abs(n-math.Round(n)) < 1e-6*float64(d) && math.Round(n) > 0 {
+			return int(math.Round(n)), d, true
+		}
+	}
+	return 0, 0, false
+}
+
+// parseSplitRatio reads "3:2" (new:old) or a factor like "1.5".
+func parseSplitRatio(value string) (to, from int, err error) {
+	if left, right, found := strings.Cut(value, ":"); found {
+		to, err1 := strconv.Atoi(strings.TrimSpace(left))
+		from, err2 := strconv.Atoi(strings.TrimSpace(right))
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("invalid split ratio %q", value)
+		}
+		return to, from, nil
+	}
+
+	factor, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid split ratio %q", value)
+	}
+	to, from, ok := ratioFromFactor(factor)
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid split ratio %q", value)
+	}
+	return to, from, nil
+}
+
+// storeCorporateAction records an action, replacing one for the same symbol,
+// type and ex-date as long as that one hasn't been processed yet.
+func storeCorporateAction(a CorporateAction) error {
+	if a.Type == "dividend" {
+		if a.RecordDate.IsZero() {
+			a.RecordDate = a.ExDate
+		}
+		if a.PayDate.IsZero() {
+			a.PayDate = a.RecordDate
+		}
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	var recordDate, payDate, amount, splitTo, splitFrom interface{}
+	if a.Type == "dividend" {
+		recordDate, payDate, amount = a.RecordDate.Format(dateLayout), a.PayDate.Format(dateLayout), a.Amount
+	} else {
+		splitTo, splitFrom = a.SplitTo, a.SplitFrom
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO corporate_actions (symbol, action_type, ex_date, record_date, pay_date, amount, split_to, split_from, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(symbol, action_type, ex_date) DO UPDATE SET
+			record_date = excluded.record_date, pay_date = excluded.pay_date, amount = excluded.amount,
+			split_to = excluded.split_to, split_from = excluded.split_from, source = excluded.source
+		WHERE processed_at IS NULL
+	`, a.Symbol, a.Type, a.ExDate.Format(dateLayout), recordDate, payDate, amount, splitTo, splitFrom, a.Source)
+	return err
+}
+
+// importCorporateActionsCSV loads actions from a CSV file with a header row
+// naming its columns: symbol, type, ex_date and, as needed, record_date,
+// pay_date, amount (dividends) and ratio (splits, as new:old or a factor).
+func importCorporateActionsCSV(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("%s: read header: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"symbol", "type", "ex_date"} {
+		if _, ok := columns[required]; !ok {
+			return 0, fmt.Errorf("%s: missing %s column", path, required)
+		}
+	}
+
+	imported := 0
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		date := func(name string) (time.Time, error) {
+			if value := field(name); value != "" {
+				return time.Parse(dateLayout, value)
+			}
+			return time.Time{}, nil
+		}
+
+		a := CorporateAction{
+			Symbol: normalizeSymbol(field("symbol")),
+			Type:   strings.ToLower(field("type")),
+			Source: "csv",
+		}
+		if a.ExDate, err = date("ex_date"); err != nil {
+			return imported, fmt.Errorf("%s:%d: ex_date must be a YYYY-MM-DD date", path, line)
+		}
+		if a.RecordDate, err = date("record_date"); err != nil {
+			return imported, fmt.Errorf("%s:%d: record_date must be a YYYY-MM-DD date", path, line)
+		}
+		if a.PayDate, err = date("pay_date"); err != nil {
+			return imported, fmt.Errorf("%s:%d: pay_date must be a YYYY-MM-DD date", path, line)
+		}
+		switch a.Type {
+		case "dividend":
+			if a.Amount, err = strconv.ParseFloat(field("amount"), 64); err != nil {
+				return imported, fmt.Errorf("%s:%d: invalid amount %q", path, line, field("amount"))
+			}
+		case "split":
+			if a.SplitTo, a.SplitFrom, err = parseSplitRatio(field("ratio")); err != nil {
+				return imported, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+
+		if err := storeCorporateAction(a); err != nil {
+			return imported, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		imported++
+	}
+
+	return imported, nil
+}
+
+func (p *AlphaVantageProvider) corporateActionData(function, symbol string) ([]map[string]string, error) {
+	params := url.Values{}
+	params.Set("function", function)
+	params.Set("symbol", symbol)
+	params.Set("apikey", p.APIKey)
+
+	resp, err := p.Client.Get("https://www.alphavantage.co/query?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("alphavantage: unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Data         []map[string]string `json:"data"`
+		Note         string              `json:"Note"`
+		Information  string              `json:"Information"`
+		ErrorMessage string              `json:"Error Message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("alphavantage: invalid response: %w", err)
+	}
+
+	switch {
+	case result.ErrorMessage != "":
+		return nil, ErrUnknownSymbol
+	case result.Note != "":
+		return nil, fmt.Errorf("alphavantage: %s", result.Note)
+	case result.Information != "":
+		return nil, fmt.Errorf("alphavantage: %s", result.Information)
+	}
+	return result.Data, nil
+}
+
+func (p *AlphaVantageProvider) CorporateActions(symbol string) ([]CorporateAction, error) {
+	// Missing dates come back as "None".
+	date := func(value string) time.Time {
+		t, _ := time.Parse(dateLayout, value)
+		return t
+	}
+
+	dividends, err := p.corporateActionData("DIVIDENDS", symbol)
+	if err != nil {
+		return nil, err
+	}
+	var actions []CorporateAction
+	for _, d := range dividends {
+		amount, err := strconv.ParseFloat(d["amount"], 64)
+		if err != nil {
+			return nil, fmt.Errorf("alphavantage: invalid dividend amount %q", d["amount"])
+		}
+		actions = append(actions, CorporateAction{
+			Symbol:     symbol,
+			Type:       "dividend",
+			ExDate:     date(d["ex_dividend_date"]),
+			RecordDate: date(d["record_date"]),
+			PayDate:    date(d["payment_date"]),
+			Amount:     amount,
+		})
+	}
+
+	splits, err := p.corporateActionData("SPLITS", symbol)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range splits {
+		to, from, err := parseSplitRatio(s["split_factor"])
+		if err != nil {
+			return nil, fmt.Errorf("alphavantage: %w", err)
+		}
+		actions = append(actions, CorporateAction{
+			Symbol:    symbol,
+			Type:      "split",
+			ExDate:    date(s["effective_date"]),
+			SplitTo:   to,
+			SplitFrom: from,
+		})
+	}
+
+	return actions, nil
+}
+
+// fetchCorporateActions stores the provider's dividends and splits for the
+// symbols we hold or track. Splits are only taken before they happen, since
+// one applied late would also rescale shares bought after it at the new price.
+// Dividends are taken up to a week after their record date, because holdings
+// on that date can still be worked out from the trades since.
+func fetchCorporateActions(symbols []string) (int, error) {
+	provider, ok := quoteProvider.(CorporateActionProvider)
+	if !ok {
+		return 0, fmt.Errorf("%s quote provider does not supply corporate actions", quoteProvider.Name())
+	}
+
+	today := truncateToDate(time.Now().UTC())
+	stored := 0
+	for _, symbol := range symbols {
+		actions, err := provider.CorporateActions(symbol)
+		if err != nil {
+			fmt.Printf("Error fetching corporate actions for %s: %v\n", symbol, err)
+			continue
+		}
+
+		for _, a := range actions {
+			a.Source = quoteProvider.Name()
+			recordDate := a.RecordDate
+			if recordDate.IsZero() {
+				recordDate = a.ExDate
+			}
+			if a.Type == "split" && a.ExDate.Before(today) || a.Type == "dividend" && recordDate.Before(today.AddDate(0, 0, -7)) {
+				continue
+			}
+			if err := storeCorporateAction(a); err != nil {
+				fmt.Printf("Error storing %s %s on %s: %v\n", symbol, a.Type, a.ExDate.Format(dateLayout), err)
+				continue
+			}
+			stored++
+		}
+	}
+	return stored, nil
+}
+
+// pendingCorporateActions are the actions due by today: splits on their
+// ex-date, dividends once the record date is over and the pay date has come.
+func pendingCorporateActions(today time.Time) ([]CorporateAction, error) {
+	day := today.Format(dateLayout)
+	rows, err := db.Query(`
+		SELECT id, symbol, action_type, ex_date, record_date, pay_date,
+			COALESCE(amount, 0), COALESCE(split_to, 0), COALESCE(split_from, 0), source
+		FROM corporate_actions
+		WHERE processed_at IS NULL AND (
+			action_type = 'split' AND ex_date <= ? OR
+			action_type = 'dividend' AND record_date < ? AND pay_date <= ?
+		)
+		ORDER BY ex_date, id
+	`, day, day, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []CorporateAction
+	for rows.Next() {
+		var a CorporateAction
+		var recordDate, payDate sql.NullTime
+		err := rows.Scan(&a.Id, &a.Symbol, &a.Type, &a.ExDate, &recordDate, &payDate, &a.Amount, &a.SplitTo, &a.SplitFrom, &a.Source)
+		if err != nil {
+			return nil, err
+		}
+		a.RecordDate, a.PayDate = recordDate.Time, payDate.Time
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// holdingsAt is every account's position in symbol at the end of day, worked
+// back from the current portfolio through the trades and corporate actions
+// since.
+func holdingsAt(tx *sql.Tx, symbol string, day time.Time) (map[int]int, error) {
+	since := day.AddDate(0, 0, 1).Format(sqliteTimeLayout)
+	rows, err := tx.Query(`
+		SELECT user_id, SUM(quantity)
+		FROM (
+			SELECT user_id, quantity FROM portfolio WHERE symbol = ?
+			UNION ALL
+			SELECT user_id, CASE trade_type WHEN 'buy' THEN -quantity ELSE quantity END
+			FROM trades WHERE symbol = ? AND trade_date >= ?
+			UNION ALL
+			SELECT user_id, quantity_before - quantity_after
+			FROM corporate_action_events WHERE symbol = ? AND created_at >= ?
+		)
+		GROUP BY user_id
+		HAVING SUM(quantity) != 0
+		ORDER BY user_id
+	`, symbol, symbol, since, symbol, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holdings := make(map[int]int)
+	for rows.Next() {
+		var userId, quantity int
+		if err := rows.Scan(&userId, &quantity); err != nil {
+			return nil, err
+		}
+		holdings[userId] = quantity
+	}
+	return holdings, rows.Err()
+}
+
+func recordCorporateActionEvent(tx *sql.Tx, a CorporateAction, userId, before, after int, cash Money) error {
+	_, err := tx.Exec(`
+		INSERT INTO corporate_action_events (action_id, user_id, symbol, quantity_before, quantity_after, cash)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, a.Id, userId, a.Symbol, before, after, cash)
+	if err != nil {
+		return fmt.Errorf("record corporate action event: %w", err)
+	}
+	return nil
+}
+
+// applyDividend pays holders as of the record date. Shorts owe the dividend
+// to whoever lent them the shares, so they're charged it.
+func applyDividend(tx *sql.Tx, a CorporateAction) (int, error) {
+	holdings, err := holdingsAt(tx, a.Symbol, a.RecordDate)
+	if err != nil {
+		return 0, fmt.Errorf("get holdings on record date: %w", err)
+	}
+
+	for userId, quantity := range holdings {
+		cash := MoneyFromFloat(a.Amount * float64(quantity))
+		memo := fmt.Sprintf("Dividend of $%s a share on %d %s", strconv.FormatFloat(a.Amount, 'f', -1, 64), quantity, a.Symbol)
+		if quantity < 0 {
+			memo = fmt.Sprintf("Dividend of $%s a share owed on %d %s sold short", strconv.FormatFloat(a.Amount, 'f', -1, 64), -quantity, a.Symbol)
+		}
+		if cash != 0 {
+			if err := postCash(tx, userId, ledgerDividend, accountMarket, cash, 0, memo); err != nil {
+				return 0, err
+			}
+		}
+		if err := recordCorporateActionEvent(tx, a, userId, quantity, quantity, cash); err != nil {
+			return 0, err
+		}
+	}
+	return len(holdings), nil
+}
+
+// applySplit rescales every open position and its lots, keeping each lot's
+// total cost, and pays cash in lieu of the fractional share a position can't
+// hold. Open orders in the symbol are cancelled since their prices and
+// quantities no longer mean what they did. price is the post-split price
+// fractional shares are paid out at.
+func applySplit(tx *sql.Tx, a CorporateAction, price Money) (int, error) {
+	_, err := tx.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', status_reason = 'stock split', reserved_cash = 0,
+			reserved_shares = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE symbol = ? AND status = 'open'
+	`, a.Symbol)
+	if err != nil {
+		return 0, fmt.Errorf("cancel open orders: %w", err)
+	}
+
+	rows, err := tx.Query("SELECT user_id, quantity FROM portfolio WHERE symbol = ? AND quantity != 0 ORDER BY user_id", a.Symbol)
+	if err != nil {
+		return 0, err
+	}
+	positions := make(map[int]int)
+	var userIds []int
+	for rows.Next() {
+		var userId, quantity int
+		if err := rows.Scan(&userId, &quantity); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		positions[userId] = quantity
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+
+	for _, userId := range userIds {
+		before := positions[userId]
+		shares := before
+		if shares < 0 {
+			shares = -shares
+		}
+		after := shares * a.SplitTo / a.SplitFrom
+		fraction := shares * a.SplitTo % a.SplitFrom
+
+		if err := splitLots(tx, userId, a, after); err != nil {
+			return 0, err
+		}
+
+		if before < 0 {
+			after = -after
+		}
+		if after == 0 {
+			_, err = tx.Exec("DELETE FROM portfolio WHERE user_id = ? AND symbol = ?", userId, a.Symbol)
+		} else {
+			var average Money
+			if average, err = lotCostBasis(tx, userId, a.Symbol); err == nil {
+				_, err = tx.Exec("UPDATE portfolio SET quantity = ?, average_price = ? WHERE user_id = ? AND symbol = ?",
+					after, average, userId, a.Symbol)
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("update portfolio: %w", err)
+		}
+
+		// A long position is paid for its fractional share; a short one has
+		// to buy its fraction back.
+		cash := price.MulRate(float64(fraction) / float64(a.SplitFrom))
+		if before < 0 {
+			cash = -cash
+		}
+		if cash != 0 {
+			memo := fmt.Sprintf("Cash in lieu of %d/%d %s share in %d-for-%d split", fraction, a.SplitFrom, a.Symbol, a.SplitTo, a.SplitFrom)
+			if err := postCash(tx, userId, ledgerCashInLieu, accountMarket, cash, 0, memo); err != nil {
+				return 0, err
+			}
+		} else if err := bumpAccountVersion(tx, userId); err != nil {
+			return 0, err
+		}
+
+		if err := recordCorporateActionEvent(tx, a, userId, before, after, cash); err != nil {
+			return 0, err
+		}
+	}
+	return len(userIds), nil
+}
+
+// splitLots rescales a position's open lots so they add up to total shares.
+// Each lot keeps its cost; its price per share is rounded to the cent. The
+// whole shares left over from rounding each lot down go to the lots with the
+// largest fractions, oldest first. A lot's already closed shares are rescaled
+// too, to the nearest share, so its quantity is counted in the same shares as
+// its price.
+func splitLots(tx *sql.Tx, userId int, a CorporateAction, total int) error {
+	var lots []Lot
+	for _, side := range []string{"long", "short"} {
+		open, err := openLots(tx, userId, a.Symbol, side)
+		if err != nil {
+			return fmt.Errorf("get open lots: %w", err)
+		}
+		lots = append(lots, open...)
+	}
+
+	remaining := make([]int, len(lots))
+	fractions := make([]int, len(lots))
+	order := make([]int, len(lots))
+	assigned := 0
+	for i, lot := range lots {
+		remaining[i] = lot.Remaining * a.SplitTo / a.SplitFrom
+		fractions[i] = lot.Remaining * a.SplitTo % a.SplitFrom
+		order[i] = i
+		assigned += remaining[i]
+	}
+	sort.SliceStable(order, func(i, j int) bool { return fractions[order[i]] > fractions[order[j]] })
+	for _, i := range order {
+		if assigned >= total {
+			break
+		}
+		remaining[i]++
+		assigned++
+	}
+
+	for i, lot := range lots {
+		price := lot.Price.Times(a.SplitFrom).Prorate(1, a.SplitTo)
+		closed := lot.Quantity - lot.Remaining
+		quantity := (closed*a.SplitTo*2+a.SplitFrom)/(a.SplitFrom*2) + remaining[i]
+		var err error
+		if remaining[i] == 0 {
+			_, err = tx.Exec("UPDATE lots SET quantity = ?, remaining = 0, price = ?, closed_at = CURRENT_TIMESTAMP WHERE id = ?", quantity, price, lot.Id)
+		} else {
+			_, err = tx.Exec("UPDATE lots SET quantity = ?, remaining = ?, price = ? WHERE id = ?", quantity, remaining[i], price, lot.Id)
+		}
+		if err != nil {
+			return fmt.Errorf("update lot: %w", err)
+		}
+	}
+	return nil
+}
+
+// splitPrice is the post-split price to pay fractional shares at. A quote
+// from before the ex-date is still in pre-split shares.
+func splitPrice(a CorporateAction) (Money, error) {
+	quote, err := fetchQuote(a.Symbol)
+	if err != nil {
+		return 0, err
+	}
+	if quote.Time.Before(a.ExDate) {
+		return quote.Price.Times(a.SplitFrom).Prorate(1, a.SplitTo), nil
+	}
+	return quote.Price, nil
+}
+
+func processCorporateAction(a CorporateAction) (int, error) {
+	var price Money
+	if a.Type == "split" {
+		var err error
+		if price, err = splitPrice(a); err != nil {
+			return 0, fmt.Errorf("price %s: %w", a.Symbol, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var accounts int
+	if a.Type == "split" {
+		accounts, err = applySplit(tx, a, price)
+	} else {
+		accounts, err = applyDividend(tx, a)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE corporate_actions SET processed_at = CURRENT_TIMESTAMP WHERE id = ?", a.Id); err != nil {
+		return 0, err
+	}
+	return accounts, tx.Commit()
+}
+
+// processCorporateActions applies every action that has come due, oldest
+// first, so a dividend after a split pays on the split-adjusted holdings.
+func processCorporateActions() {
+	actions, err := pendingCorporateActions(truncateToDate(time.Now().UTC()))
+	if err != nil {
+		fmt.Println("Error querying corporate actions:", err)
+		return
+	}
+
+	for _, a := range actions {
+		accounts, err := processCorporateAction(a)
+		if err != nil {
+			// Later actions in the same symbol have to wait for this one.
+			fmt.Printf("Error processing %s %s on %s: %v\n", a.Symbol, a.Type, a.ExDate.Format(dateLayout), err)
+			return
+		}
+		fmt.Printf("Processed %s %s on %s for %d accounts\n", a.Symbol, a.Type, a.ExDate.Format(dateLayout), accounts)
+	}
+}
+
+// updateCorporateActions pulls new dividends and splits from the provider,
+// when it has them, and applies whatever is due.
+func updateCorporateActions() {
+	fmt.Printf("Updating corporate actions at %s\n", time.Now().Format(time.RFC3339))
+
+	if _, ok := quoteProvider.(CorporateActionProvider); ok {
+		symbols, err := historySymbols()
+		if err != nil {
+			fmt.Println("Error getting symbols for corporate actions:", err)
+		} else if n, err := fetchCorporateActions(symbols); err != nil {
+			fmt.Println("Error fetching corporate actions:", err)
+		} else {
+			fmt.Printf("Stored %d corporate actions\n", n)
+		}
+	}
+
+	processCorporateActions()
+}
+
+// runCorporateActionsCommand handles `corporate-actions import <file.csv>`,
+// `corporate-actions fetch [symbols...]` and `corporate-actions process`.
+func runCorporateActionsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: corporate-actions import <file.csv> | fetch [symbols...] | process")
+	}
+
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: corporate-actions import <file.csv>")
+		}
+		n, err := importCorporateActionsCSV(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d corporate actions from %s\n", n, args[1])
+	case "fetch":
+		symbols := args[1:]
+		if len(symbols) == 0 {
+			var err error
+			if symbols, err = historySymbols(); err != nil {
+				return err
+			}
+		}
+		n, err := fetchCorporateActions(symbols)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Stored %d corporate actions\n", n)
+	case "process":
+		processCorporateActions()
+	default:
+		return fmt.Errorf("unknown corporate-actions command %q", args[0])
+	}
+	return nil
+}
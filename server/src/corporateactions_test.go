@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSplitRatio(t *testing.T) {
+	tests := []struct {
+		value    string
+		to, from int
+		wantErr  bool
+	}{
+		{"2:1", 2, 1, false},
+		{"3 : 2", 3, 2, false},
+		{"1:10", 1, 10, false},
+		{"2", 2, 1, false},
+		{"1.5", 3, 2, false},
+		{"0.1", 1, 10, false},
+		{"0.333333", 1, 3, false},
+		{"a:b", 0, 0, true},
+		{"0", 0, 0, true},
+		{"-2", 0, 0, true},
+		{"split", 0, 0, true},
+	}
+	for _, tt := range tests {
+		to, from, err := parseSplitRatio(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSplitRatio(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if to != tt.to || from != tt.from {
+			t.Errorf("parseSplitRatio(%q) = %d:%d, want %d:%d", tt.value, to, from, tt.to, tt.from)
+		}
+	}
+}
+
+func TestApplySplit(t *testing.T) {
+	type buy struct {
+		quantity int
+		price    Money
+	}
+	tests := []struct {
+		name     string
+		symbol   string
+		short    bool
+		buys     []buy
+		to, from int
+		price    Money
+		want     int
+		lots     []int
+		cash     Money
+	}{
+		{"2-for-1", "AAPL", false, []buy{{10, 10000}, {5, 20000}}, 2, 1, 5000, 30, []int{20, 10}, 0},
+		{"3-for-2 with a fraction", "MSFT", false, []buy{{15, 10000}}, 3, 2, 6000, 22, []int{22}, 3000},
+		{"1-for-10 reverse", "NVDA", false, []buy{{25, 1000}}, 1, 10, 10000, 2, []int{2}, 5000},
+		{"3-for-2 on a short", "AMZN", true, []buy{{15, 10000}}, 3, 2, 6000, -22, []int{22}, -3000},
+		{"leftover share goes to the oldest lot", "TSLA", false, []buy{{5, 10000}, {5, 10000}}, 3, 2, 6000, 15, []int{8, 7}, 0},
+	}
+
+	setupTestDB(t)
+	for _, tt := range tests {
+		userId := createTestUser(t, tt.symbol)
+		if tt.short {
+			if _, err := db.Exec("INSERT INTO margin_accounts (user_id) VALUES (?)", userId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, b := range tt.buys {
+			tradeType := "buy"
+			if tt.short {
+				tradeType = "sell"
+			}
+			tradeAt(t, userId, tt.symbol, b.quantity, tradeType, b.price)
+		}
+
+		a := CorporateAction{Symbol: tt.symbol, Type: "split", ExDate: time.Now().UTC(), SplitTo: tt.to, SplitFrom: tt.from, Source: "test"}
+		if err := storeCorporateAction(a); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow("SELECT id FROM corporate_actions WHERE symbol = ?", tt.symbol).Scan(&a.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		var before Money
+		if err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&before); err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := applySplit(tx, a, tt.price); err != nil {
+			tx.Rollback()
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var quantity int
+		var after Money
+		err = db.QueryRow(`
+			SELECT p.quantity, u.balance FROM portfolio p JOIN users u ON u.id = p.user_id
+			WHERE p.user_id = ? AND p.symbol = ?
+		`, userId, tt.symbol).Scan(&quantity, &after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quantity != tt.want {
+			t.Errorf("%s: position %d, want %d", tt.name, quantity, tt.want)
+		}
+		if after-before != tt.cash {
+			t.Errorf("%s: cash in lieu $%s, want $%s", tt.name, after-before, tt.cash)
+		}
+
+		side := "long"
+		if tt.short {
+			side = "short"
+		}
+		lots, err := openLots(db, userId, tt.symbol, side)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lots) != len(tt.lots) {
+			t.Fatalf("%s: %d open lots, want %d", tt.name, len(lots), len(tt.lots))
+		}
+		for i, lot := range lots {
+			if lot.Remaining != tt.lots[i] {
+				t.Errorf("%s: lot %d has %d shares, want %d", tt.name, i, lot.Remaining, tt.lots[i])
+			}
+		}
+		for i, lot := range lots {
+			if want := tt.buys[i].price.Times(tt.from).Prorate(1, tt.to); lot.Price != want {
+				t.Errorf("%s: lot %d at $%s a share, want $%s", tt.name, i, lot.Price, want)
+			}
+		}
+	}
+}
+
+func TestSplitPartlyClosedLot(t *testing.T) {
+	tests := []struct {
+		symbol          string
+		bought, sold    int
+		price           Money
+		to, from        int
+		quantity, open  int
+		priceAfterSplit Money
+	}{
+		{"AAPL", 10, 4, 10000, 2, 1, 20, 12, 5000},
+		{"MSFT", 10, 4, 10000, 3, 2, 15, 9, 6667},
+		{"NVDA", 100, 40, 100, 1, 10, 10, 6, 1000},
+	}
+
+	setupTestDB(t)
+	for _, tt := range tests {
+		userId := createTestUser(t, tt.symbol)
+		tradeAt(t, userId, tt.symbol, tt.bought, "buy", tt.price)
+		tradeAt(t, userId, tt.symbol, tt.sold, "sell", tt.price)
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := CorporateAction{Symbol: tt.symbol, Type: "split", SplitTo: tt.to, SplitFrom: tt.from}
+		if err := splitLots(tx, userId, a, (tt.bought-tt.sold)*tt.to/tt.from); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		var quantity, open int
+		var price Money
+		err = db.QueryRow("SELECT quantity, remaining, price FROM lots WHERE user_id = ?", userId).Scan(&quantity, &open, &price)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quantity != tt.quantity || open != tt.open || price != tt.priceAfterSplit {
+			t.Errorf("%d-for-%d split of %d %s with %d sold: lot of %d with %d open at $%s, want %d with %d open at $%s",
+				tt.to, tt.from, tt.bought, tt.symbol, tt.sold, quantity, open, price, tt.quantity, tt.open, tt.priceAfterSplit)
+		}
+	}
+}
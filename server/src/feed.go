@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFeedLimit = 20
+	maxFeedLimit     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+type Post struct {
+	Id          int       `json:"id"`
+	Username    string    `json:"username"`
+	Symbol      string    `json:"symbol"`
+	Quantity    int       `json:"quantity"`
+	TradeType   string    `json:"trade_type"`
+	Rationale   string    `json:"rationale"`
+	TradeDate   time.Time `json:"trade_date"`
+	Likes       int       `json:"likes"`
+	LikedByUser bool      `json:"liked_by_user"`
+	Comments    int       `json:"comments"`
+}
+
+// feedCursor is the last post of a page. The next page starts after it in
+// (trade_date, id) order, so posts made while paging don't shift it.
+type feedCursor struct {
+	TradeDate time.Time
+	Id        int
+}
+
+func (c feedCursor) String() string {
+	raw := c.TradeDate.UTC().Format(sqliteTimeLayout) + "|" + strconv.Itoa(c.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseFeedCursor(value string) (feedCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return feedCursor{}, errInvalidCursor
+	}
+	date, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return feedCursor{}, errInvalidCursor
+	}
+	var c feedCursor
+	if c.TradeDate, err = time.Parse(sqliteTimeLayout, date); err != nil {
+		return feedCursor{}, errInvalidCursor
+	}
+	if c.Id, err = strconv.Atoi(id); err != nil {
+		return feedCursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+type feedQuery struct {
+	// Following limits the feed to the viewer and the users they follow.
+	Following bool
+	Symbol    string
+	UserId    int
+	TradeType string
+	After     *feedCursor
+	Limit     int
+}
+
+// queryPosts returns a page of posts, newest first, as seen by viewerId.
+func queryPosts(viewerId int, f feedQuery) ([]Post, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{viewerId}
+	if f.Following {
+		where = append(where, "(p.user_id = ? OR p.user_id IN (SELECT followee_id FROM follows WHERE follower_id = ?))")
+		args = append(args, viewerId, viewerId)
+	}
+	if f.Symbol != "" {
+		where = append(where, "p.symbol = ?")
+		args = append(args, f.Symbol)
+	}
+	if f.UserId != 0 {
+		where = append(where, "p.user_id = ?")
+		args = append(args, f.UserId)
+	}
+	if f.TradeType != "" {
+		where = append(where, "p.trade_type = ?")
+		args = append(args, f.TradeType)
+	}
+	if f.After != nil {
+		date := f.After.TradeDate.UTC().Format(sqliteTimeLayout)
+		where = append(where, "(p.trade_date < ? OR (p.trade_date = ? AND p.id < ?))")
+		args = append(args, date, date, f.After.Id)
+	}
+	args = append(args, f.Limit)
+
+	rows, err := db.Query(`
+		SELECT p.id, u.username, p.symbol, p.quantity, p.trade_type, COALESCE(p.rationale, ''), p.trade_date,
+			   (SELECT COUNT(*) FROM posts_likes WHERE post_id = p.id) AS likes_count,
+			   EXISTS(SELECT 1 FROM posts_likes WHERE post_id = p.id AND user_id = ?) AS liked_by_user,
+			   (SELECT COUNT(*) FROM comments WHERE post_id = p.id AND deleted_at IS NULL) AS comments_count
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY p.trade_date DESC, p.id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var p Post
+		err := rows.Scan(&p.Id, &p.Username, &p.Symbol, &p.Quantity, &p.TradeType, &p.Rationale, &p.TradeDate, &p.Likes, &p.LikedByUser, &p.Comments)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// GetFeed pages through posts from everyone (?mode=global, the default) or
+// from the signed-in user and the people they follow (?mode=following).
+// ?symbol=, ?user= and ?trade_type= narrow it down. Pass next_cursor back as
+// ?cursor= for the following page; it is null on the last one.
+func GetFeed(w http.ResponseWriter, r *http.Request) {
+	viewerId := getUserIdFromSession(r)
+	query := r.URL.Query()
+
+	f := feedQuery{Limit: defaultFeedLimit}
+	switch query.Get("mode") {
+	case "", "global":
+	case "following":
+		f.Following = true
+	default:
+		http.Error(w, "mode must be following or global", http.StatusBadRequest)
+		return
+	}
+
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxFeedLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxFeedLimit), http.StatusBadRequest)
+			return
+		}
+		f.Limit = parsed
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := parseFeedCursor(value)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		f.After = &cursor
+	}
+
+	if value := query.Get("symbol"); value != "" {
+		f.Symbol = normalizeSymbol(value)
+	}
+
+	switch tradeType := query.Get("trade_type"); tradeType {
+	case "", "buy", "sell":
+		f.TradeType = tradeType
+	default:
+		http.Error(w, "trade_type must be buy or sell", http.StatusBadRequest)
+		return
+	}
+
+	if username := query.Get("user"); username != "" {
+		userId, err := userIdByUsername(username)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get user", http.StatusInternalServerError)
+			return
+		}
+		f.UserId = userId
+	}
+
+	// One extra post tells whether there is another page.
+	limit := f.Limit
+	f.Limit++
+	posts, err := queryPosts(viewerId, f)
+	if err != nil {
+		fmt.Println("Error fetching feed:", err)
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor *string
+	if len(posts) > limit {
+		posts = posts[:limit]
+		last := posts[limit-1]
+		cursor := feedCursor{last.TradeDate, last.Id}.String()
+		nextCursor = &cursor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"posts":       posts,
+		"next_cursor": nextCursor,
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseFeedCursor(t *testing.T) {
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+
+	c := feedCursor{time.Date(2025, 3, 10, 14, 30, 5, 0, time.UTC), 42}
+	got, err := parseFeedCursor(c.String())
+	if err != nil || got != c {
+		t.Errorf("parseFeedCursor(%v.String()) = %v, %v", c, got, err)
+	}
+
+	for _, value := range []string{
+		"",
+		"not base64!",
+		encode("2025-03-10 14:30:05"),
+		encode("2025-03-10T14:30:05Z|42"),
+		encode("2025-03-10 14:30:05|forty-two"),
+	} {
+		if _, err := parseFeedCursor(value); err != errInvalidCursor {
+			t.Errorf("parseFeedCursor(%q) error = %v, want %v", value, err, errInvalidCursor)
+		}
+	}
+}
+
+func TestFeedPaging(t *testing.T) {
+	setupTestDB(t)
+	viewer := createTestUser(t, "viewer")
+	followed := createTestUser(t, "followed")
+	stranger := createTestUser(t, "stranger")
+	if _, err := db.Exec("INSERT INTO follows (follower_id, followee_id) VALUES (?, ?)", viewer, followed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Posts share trade_dates down to the second, so only the id keeps pages
+	// from overlapping or skipping posts.
+	addPost := func(userId int, symbol, tradeType, date string) int {
+		result, err := db.Exec(`
+			INSERT INTO posts (user_id, symbol, quantity, trade_type, trade_date) VALUES (?, ?, 1, ?, ?)
+		`, userId, symbol, tradeType, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		return int(id)
+	}
+	p1 := addPost(viewer, "AAPL", "buy", "2025-03-10 14:00:00")
+	p2 := addPost(stranger, "AAPL", "sell", "2025-03-10 14:00:00")
+	p3 := addPost(followed, "MSFT", "buy", "2025-03-10 14:00:00")
+	p4 := addPost(stranger, "MSFT", "buy", "2025-03-10 15:00:00")
+	p5 := addPost(followed, "AAPL", "sell", "2025-03-10 15:00:00")
+	p6 := addPost(followed, "AAPL", "buy", "2025-03-09 09:00:00")
+
+	page := func(query url.Values) ([]int, string) {
+		w := httptest.NewRecorder()
+		GetFeed(w, asUser(viewer, "GET", "/feed?"+query.Encode(), ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /feed?%s: status %d: %s", query.Encode(), w.Code, w.Body.String())
+		}
+		var response struct {
+			Posts      []Post  `json:"posts"`
+			NextCursor *string `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, p := range response.Posts {
+			ids = append(ids, p.Id)
+		}
+		if response.NextCursor == nil {
+			return ids, ""
+		}
+		return ids, *response.NextCursor
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []int
+	}{
+		{"global", url.Values{}, []int{p5, p4, p3, p2, p1, p6}},
+		{"following", url.Values{"mode": {"following"}}, []int{p5, p3, p1, p6}},
+		{"symbol", url.Values{"symbol": {"aapl"}}, []int{p5, p2, p1, p6}},
+		{"trade type", url.Values{"trade_type": {"sell"}}, []int{p5, p2}},
+		{"user", url.Values{"user": {"followed"}, "trade_type": {"buy"}}, []int{p3, p6}},
+	}
+	for _, tt := range tests {
+		for _, limit := range []string{"1", "2", "4", "100"} {
+			query := url.Values{"limit": {limit}}
+			for k, v := range tt.query {
+				query[k] = v
+			}
+			ids := []int{}
+			for pages := 0; ; pages++ {
+				if pages > len(tt.want) {
+					t.Fatalf("%s, limit %s: cursor never ran out", tt.name, limit)
+				}
+				got, next := page(query)
+				ids = append(ids, got...)
+				if next == "" {
+					break
+				}
+				query.Set("cursor", next)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("%s, limit %s: posts %v, want %v", tt.name, limit, ids, tt.want)
+			}
+		}
+	}
+
+	// A post made while paging lands before the cursor and doesn't shift the
+	// rest of the pages.
+	first, next := page(url.Values{"limit": {"2"}})
+	addPost(stranger, "AAPL", "buy", "2025-03-10 15:00:00")
+	rest, _ := page(url.Values{"limit": {"10"}, "cursor": {next}})
+	if got := append(first, rest...); !reflect.DeepEqual(got, []int{p5, p4, p3, p2, p1, p6}) {
+		t.Errorf("paging across a new post: %v", got)
+	}
+
+	for _, query := range []url.Values{
+		{"cursor": {"bogus"}},
+		{"limit": {"0"}},
+		{"limit": {strconv.Itoa(maxFeedLimit + 1)}},
+		{"mode": {"friends"}},
+		{"trade_type": {"short"}},
+	} {
+		w := httptest.NewRecorder()
+		GetFeed(w, asUser(viewer, "GET", "/feed?"+query.Encode(), ""))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /feed?%s: status %d, want %d", query.Encode(), w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// FeeSchedule prices a trade. Commission is charged on every trade as
+// per_trade + per_share * shares + notional_rate * notional, but never less
+// than minimum. Regulatory fees only apply to sells, the way the SEC fee and
+// FINRA TAF do. Per-share amounts are in dollars and may be fractions of a
+// cent; rates are fractions of notional.
+type FeeSchedule struct {
+	PerTrade     Money          `json:"per_trade"`
+	PerShare     float64        `json:"per_share"`
+	NotionalRate float64        `json:"notional_rate"`
+	Minimum      Money          `json:"minimum"`
+	Regulatory   RegulatoryFees `json:"regulatory"`
+}
+
+type RegulatoryFees struct {
+	SellRate        float64 `json:"sell_rate"`
+	SellPerShare    float64 `json:"sell_per_share"`
+	SellPerShareMax Money   `json:"sell_per_share_max"`
+}
+
+func (s FeeSchedule) Validate() error {
+	if s.PerTrade < 0 || s.PerShare < 0 || s.NotionalRate < 0 || s.Minimum < 0 {
+		return fmt.Errorf("commission fees must not be negative")
+	}
+	if s.NotionalRate >= 1 {
+		return fmt.Errorf("notional rate must be below 1")
+	}
+	r := s.Regulatory
+	if r.SellRate < 0 || r.SellPerShare < 0 || r.SellPerShareMax < 0 {
+		return fmt.Errorf("regulatory fees must not be negative")
+	}
+	if r.SellRate >= 1 {
+		return fmt.Errorf("regulatory sell rate must be below 1")
+	}
+	return nil
+}
+
+type tradeFees struct {
+	Commission Money
+	Regulatory Money
+}
+
+func (f tradeFees) Total() Money {
+	return f.Commission + f.Regulatory
+}
+
+// feesFor works out what a trade costs under the schedule. Commission rounds
+// to the nearest cent, halves away from zero; regulatory fees round up to the
+// next cent like the real ones do.
+func (s FeeSchedule) feesFor(tradeType string, quantity int, price Money) tradeFees {
+	notional := price.Times(quantity)
+
+	var fees tradeFees
+	fees.Commission = s.PerTrade + MoneyFromFloat(s.PerShare*float64(quantity)) + notional.MulRate(s.NotionalRate)
+	if fees.Commission < s.Minimum {
+		fees.Commission = s.Minimum
+	}
+
+	if tradeType == "sell" {
+		r := s.Regulatory
+		fees.Regulatory = ceilCents(float64(notional) * r.SellRate)
+		perShare := ceilCents(r.SellPerShare * float64(quantity) * 100)
+		if r.SellPerShareMax > 0 && perShare > r.SellPerShareMax {
+			perShare = r.SellPerShareMax
+		}
+		fees.Regulatory += perShare
+	}
+
+	return fees
+}
+
+// ceilCents rounds a cent amount up, ignoring float noise far below a cent so
+// an exact 2 cents doesn't become 3.
+func ceilCents(cents float64) Money {
+	return Money(math.Ceil(cents - 1e-6))
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestFeesFor(t *testing.T) {
+	schedule := FeeSchedule{
+		PerTrade:     100,
+		PerShare:     0.005,
+		NotionalRate: 0.001,
+		Minimum:      200,
+		Regulatory:   RegulatoryFees{SellRate: 0.0000278, SellPerShare: 0.000166, SellPerShareMax: 830},
+	}
+
+	tests := []struct {
+		name       string
+		schedule   FeeSchedule
+		tradeType  string
+		quantity   int
+		price      Money
+		commission Money
+		regulatory Money
+	}{
+		{"free", FeeSchedule{}, "sell", 100, 10000, 0, 0},
+		{"minimum applies", schedule, "buy", 1, 1000, 200, 0},
+		{"per trade, share and notional", schedule, "buy", 1000, 10000, 100 + 500 + 10000, 0},
+		{"sell fees round up", schedule, "sell", 100, 10000, 100 + 50 + 1000, 28 + 2},
+		{"per-share regulatory fee is capped", schedule, "sell", 10000000, 1, 100 + 5000000 + 10000, 278 + 830},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fees := tt.schedule.feesFor(tt.tradeType, tt.quantity, tt.price)
+			if fees.Commission != tt.commission || fees.Regulatory != tt.regulatory {
+				t.Errorf("got commission %s and regulatory %s, want %s and %s",
+					fees.Commission, fees.Regulatory, tt.commission, tt.regulatory)
+			}
+		})
+	}
+}
+
+// A sale that brings in less than its minimum commission must not take a cash
+// account below zero.
+func TestSellFeesNeedCash(t *testing.T) {
+	setupTestDB(t)
+	cfg.Fees = FeeSchedule{Minimum: 500}
+	userId := createTestUser(t, "penny")
+	tradeAt(t, userId, "AAPL", 1, "buy", 100)
+
+	if _, err := db.Exec("UPDATE users SET balance = 300 WHERE id = ?", userId); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = executeTrade(tx, userId, "AAPL", 1, "sell", 100, "", nil, true)
+	tx.Rollback()
+	if err != ErrInsufficientBalance {
+		t.Fatalf("selling with $3 of cash for a $4 shortfall: got %v, want ErrInsufficientBalance", err)
+	}
+
+	if _, err := db.Exec("UPDATE users SET balance = 400 WHERE id = ?", userId); err != nil {
+		t.Fatal(err)
+	}
+	fill := tradeAt(t, userId, "AAPL", 1, "sell", 100)
+	if fill.NewBalance != 0 {
+		t.Errorf("new balance %s, want 0.00", fill.NewBalance)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultFollowListLimit = 50
+	maxFollowListLimit     = 200
+)
+
+// userIdByUsername finds a user's main account; competition accounts share
+// their owner's username and can't be followed.
+func userIdByUsername(username string) (int, error) {
+	var userId int
+	err := db.QueryRow(`
+		SELECT id FROM users
+		WHERE username = ? AND id NOT IN (SELECT account_id FROM competition_entries)
+	`, username).Scan(&userId)
+	return userId, err
+}
+
+func followCounts(userId int) (followers, following int, err error) {
+	err = db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM follows WHERE followee_id = ?),
+			(SELECT COUNT(*) FROM follows WHERE follower_id = ?)
+	`, userId, userId).Scan(&followers, &following)
+	return followers, following, err
+}
+
+// GetUserProfile shows a user's follower and following counts and whether the
+// signed-in user follows them.
+func GetUserProfile(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	userId, err := userIdByUsername(username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	followers, following, err := followCounts(userId)
+	if err != nil {
+		http.Error(w, "Failed to count followers", http.StatusInternalServerError)
+		return
+	}
+
+	viewerId := getUserIdFromSession(r)
+	var isFollowing, followsYou bool
+	var posts int
+	err = db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM follows WHERE follower_id = ? AND followee_id = ?),
+			EXISTS(SELECT 1 FROM follows WHERE follower_id = ? AND followee_id = ?),
+			(SELECT COUNT(*) FROM posts WHERE user_id = ?)
+	`, viewerId, userId, userId, viewerId, userId).Scan(&isFollowing, &followsYou, &posts)
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":     username,
+		"followers":    followers,
+		"following":    following,
+		"posts":        posts,
+		"is_following": isFollowing,
+		"follows_you":  followsYou,
+	})
+}
+
+func FollowUser(w http.ResponseWriter, r *http.Request) {
+	setFollowing(w, r, true)
+}
+
+func UnfollowUser(w http.ResponseWriter, r *http.Request) {
+	setFollowing(w, r, false)
+}
+
+// setFollowing follows or unfollows the user named in the path. Both are
+// idempotent.
+func setFollowing(w http.ResponseWriter, r *http.Request, follow bool) {
+	followerId := getUserIdFromSession(r)
+	username := mux.Vars(r)["username"]
+	followeeId, err := userIdByUsername(username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if followeeId == followerId {
+		http.Error(w, "You can't follow yourself", http.StatusBadRequest)
+		return
+	}
+
+	var result sql.Result
+	if follow {
+		result, err = db.Exec(`
+			INSERT OR IGNORE INTO follows (follower_id, followee_id) VALUES (?, ?)
+		`, followerId, followeeId)
+	} else {
+		result, err = db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerId, followeeId)
+	}
+	if err != nil {
+		fmt.Println("Error updating follow:", err)
+		http.Error(w, "Failed to update follow", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n > 0 && follow {
+		var follower string
+		if err := db.QueryRow("SELECT username FROM users WHERE id = ?", followerId).Scan(&follower); err == nil {
+			notify(followeeId, "new_follower", follower+" started following you", map[string]interface{}{
+				"follower_id": followerId,
+				"follower":    follower,
+			})
+		}
+	}
+
+	followers, _, err := followCounts(followeeId)
+	if err != nil {
+		http.Error(w, "Failed to count followers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":     username,
+		"is_following": follow,
+		"followers":    followers,
+	})
+}
+
+type FollowEntry struct {
+	Username   string    `json:"username"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+func GetFollowers(w http.ResponseWriter, r *http.Request) {
+	listFollows(w, r, true)
+}
+
+func GetFollowing(w http.ResponseWriter, r *http.Request) {
+	listFollows(w, r, false)
+}
+
+// listFollows pages through who follows the user named in the path, or who
+// they follow, most recent first.
+func listFollows(w http.ResponseWriter, r *http.Request, followers bool) {
+	userId, err := userIdByUsername(mux.Vars(r)["username"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultFollowListLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxFollowListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxFollowListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+
+	// Followers are the rows pointing at the user; following, the rows from them.
+	match, other := "f.followee_id", "f.follower_id"
+	if !followers {
+		match, other = other, match
+	}
+	rows, err := db.Query(`
+		SELECT u.username, f.created_at FROM follows f
+		JOIN users u ON u.id = `+other+`
+		WHERE `+match+` = ?
+		ORDER BY f.created_at DESC, u.username
+		LIMIT ? OFFSET ?
+	`, userId, limit, offset)
+	if err != nil {
+		http.Error(w, "Failed to fetch follows", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []FollowEntry{}
+	for rows.Next() {
+		var e FollowEntry
+		if err := rows.Scan(&e.Username, &e.FollowedAt); err != nil {
+			http.Error(w, "Failed to scan follow row", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
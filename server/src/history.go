@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Bar struct {
+	Date   time.Time `json:"date"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Volume int64     `json:"volume"`
+}
+
+// HistoryProvider is implemented by quote providers that can also supply
+// daily OHLCV bars. from and to are inclusive calendar dates.
+type HistoryProvider interface {
+	DailyBars(symbol string, from, to time.Time) ([]Bar, error)
+}
+
+const dateLayout = "2006-01-02"
+
+// parseDateRange reads the from/to/days query parameters shared by the history
+// endpoints. to defaults to today and from to days before to.
+func parseDateRange(query url.Values, defaultDays int) (from, to time.Time, err error) {
+	to = truncateToDate(time.Now().UTC())
+	if toParam := query.Get("to"); toParam != "" {
+		if to, err = time.Parse(dateLayout, toParam); err != nil {
+			return from, to, fmt.Errorf("to must be a YYYY-MM-DD date")
+		}
+	}
+
+	days := defaultDays
+	if daysParam := query.Get("days"); daysParam != "" {
+		if parsedDays, err := strconv.Atoi(daysParam); err == nil {
+			days = parsedDays
+		}
+	}
+	from = to.AddDate(0, 0, -days)
+	if fromParam := query.Get("from"); fromParam != "" {
+		if from, err = time.Parse(dateLayout, fromParam); err != nil {
+			return from, to, fmt.Errorf("from must be a YYYY-MM-DD date")
+		}
+	}
+
+	if from.After(to) {
+		return from, to, fmt.Errorf("from must not be after to")
+	}
+	return from, to, nil
+}
+
+func fetchDailyBars(symbol string, from, to time.Time) ([]Bar, error) {
+	history, ok := quoteProvider.(HistoryProvider)
+	if !ok {
+		return nil, fmt.Errorf("%s quote provider does not supply price history", quoteProvider.Name())
+	}
+	return history.DailyBars(symbol, from, to)
+}
+
+func truncateToDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (p *AlphaVantageProvider) DailyBars(symbol string, from, to time.Time) ([]Bar, error) {
+	params := url.Values{}
+	params.Set("function", "TIME_SERIES_DAILY")
+	params.Set("symbol", symbol)
+	params.Set("apikey", p.APIKey)
+	// compact only covers the last 100 trading days.
+	if time.Since(from) > 140*24*time.Hour {
+		params.Set("outputsize", "full")
+	}
+
+	resp, err := p.Client.Get("https://www.alphavantage.co/query?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("alphavantage: unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Series map[string]struct {
+			Open   string `json:"1. open"`
+			High   string `json:"2. high"`
+			Low    string `json:"3. low"`
+			Close  string `json:"4. close"`
+			Volume string `json:"5. volume"`
+		} `json:"Time Series (Daily)"`
+		Note         string `json:"Note"`
+		Information  string `json:"Information"`
+		ErrorMessage string `json:"Error Message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("alphavantage: invalid response: %w", err)
+	}
+
+	switch {
+	case result.ErrorMessage != "":
+		return nil, ErrUnknownSymbol
+	case result.Note != "":
+		return nil, fmt.Errorf("alphavantage: %s", result.Note)
+	case result.Information != "":
+		return nil, fmt.Errorf("alphavantage: %s", result.Information)
+	}
+
+	var bars []Bar
+	for day, values := range result.Series {
+		date, err := time.Parse(dateLayout, day)
+		if err != nil || date.Before(from) || date.After(to) {
+			continue
+		}
+
+		bar := Bar{Date: date}
+		fields := []struct {
+			raw    string
+			target *float64
+		}{{values.Open, &bar.Open}, {values.High, &bar.High}, {values.Low, &bar.Low}, {values.Close, &bar.Close}}
+		for _, field := range fields {
+			if *field.target, err = strconv.ParseFloat(field.raw, 64); err != nil {
+				return nil, fmt.Errorf("alphavantage: invalid price %q for %s", field.raw, day)
+			}
+		}
+		if bar.Volume, err = strconv.ParseInt(values.Volume, 10, 64); err != nil {
+			return nil, fmt.Errorf("alphavantage: invalid volume %q for %s", values.Volume, day)
+		}
+
+		bars = append(bars, bar)
+	}
+
+	sort.Slice(bars, func(i, j int) bool { return bars[i].Date.Before(bars[j].Date) })
+	return bars, nil
+}
+
+// DailyBars samples the simulated price every half hour of a 14:30-21:00 UTC
+// session on weekdays, matching what Quote returns at those times.
+func (p *SimulatedProvider) DailyBars(symbol string, from, to time.Time) ([]Bar, error) {
+	if symbol == "" {
+		return nil, ErrUnknownSymbol
+	}
+
+	var bars []Bar
+	for day := truncateToDate(from); !day.After(to); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+
+		open := day.Add(14*time.Hour + 30*time.Minute)
+		bar := Bar{Date: day, Open: p.priceAt(symbol, open), Low: math.Inf(1)}
+		for t := open; !t.After(day.Add(21 * time.Hour)); t = t.Add(30 * time.Minute) {
+			price := p.priceAt(symbol, t)
+			bar.High = math.Max(bar.High, price)
+			bar.Low = math.Min(bar.Low, price)
+			bar.Close = price
+		}
+
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d:%s:%s", p.Seed, symbol, day.Format(dateLayout))
+		bar.Volume = 100000 + int64(h.Sum64()%4900000)
+
+		bars = append(bars, bar)
+	}
+
+	return bars, nil
+}
+
+// DailyBars rolls the recorded quotes up into one bar per calendar day.
+func (p *ReplayProvider) DailyBars(symbol string, from, to time.Time) ([]Bar, error) {
+	series, ok := p.quotes[symbol]
+	if !ok {
+		return nil, ErrUnknownSymbol
+	}
+
+	var bars []Bar
+	for _, quote := range series {
+		day := truncateToDate(quote.Time)
+		if day.Before(from) || day.After(to) {
+			continue
+		}
+
+		price := quote.Price.Float64()
+		if len(bars) == 0 || !bars[len(bars)-1].Date.Equal(day) {
+			bars = append(bars, Bar{Date: day, Open: price, High: price, Low: price})
+		}
+		bar := &bars[len(bars)-1]
+		bar.High = math.Max(bar.High, price)
+		bar.Low = math.Min(bar.Low, price)
+		bar.Close = price
+	}
+
+	return bars, nil
+}
+
+func storeDailyBars(symbol string, bars []Bar) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO historical_prices (symbol, date, open, high, low, close, volume)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(symbol, date) DO UPDATE SET
+			open = excluded.open, high = excluded.high, low = excluded.low,
+			close = excluded.close, volume = excluded.volume
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, bar := range bars {
+		_, err := stmt.Exec(symbol, bar.Date.Format(dateLayout), bar.Open, bar.High, bar.Low, bar.Close, bar.Volume)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func backfillSymbol(symbol string, from, to time.Time) (int, error) {
+	bars, err := fetchDailyBars(symbol, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return len(bars), storeDailyBars(symbol, bars)
+}
+
+func historySymbols() ([]string, error) {
+	rows, err := db.Query(`
+		SELECT symbol FROM portfolio
+		UNION SELECT symbol FROM orders WHERE status = 'open'
+		UNION SELECT symbol FROM watchlist_items
+		UNION SELECT symbol FROM price_alerts WHERE status = 'active'
+		UNION SELECT DISTINCT symbol FROM historical_prices
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var symbols []string
+	for rows.Next() {
+		var symbol string
+		if err := rows.Scan(&symbol); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, symbol)
+	}
+	return symbols, rows.Err()
+}
+
+// updateHistoricalPrices refreshes the last week of bars for every symbol we
+// hold or track, which also repairs any nights the job missed.
+func updateHistoricalPrices() {
+	fmt.Printf("Updating historical prices at %s\n", time.Now().Format(time.RFC3339))
+
+	symbols, err := historySymbols()
+	if err != nil {
+		fmt.Println("Error getting symbols for price history:", err)
+		return
+	}
+
+	to := truncateToDate(time.Now().UTC())
+	from := to.AddDate(0, 0, -7)
+	for _, symbol := range symbols {
+		n, err := backfillSymbol(symbol, from, to)
+		if err != nil {
+			fmt.Printf("Error updating price history for %s: %v\n", symbol, err)
+			continue
+		}
+		fmt.Printf("Stored %d daily bars for %s\n", n, symbol)
+	}
+}
+
+func runBackfillCommand(args []string) error {
+	days := 365
+	var symbols []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-days" && i+1 < len(args) {
+			parsed, err := strconv.Atoi(args[i+1])
+			if err != nil || parsed <= 0 {
+				return fmt.Errorf("-days must be a positive number")
+			}
+			days = parsed
+			i++
+			continue
+		}
+		symbols = append(symbols, args[i])
+	}
+
+	if len(symbols) == 0 {
+		var err error
+		if symbols, err = historySymbols(); err != nil {
+			return err
+		}
+	}
+	if len(symbols) == 0 {
+		return fmt.Errorf("no symbols to backfill; pass them as arguments")
+	}
+
+	to := truncateToDate(time.Now().UTC())
+	from := to.AddDate(0, 0, -days)
+	for _, symbol := range symbols {
+		n, err := backfillSymbol(symbol, from, to)
+		if err != nil {
+			fmt.Printf("%s: %v\n", symbol, err)
+			continue
+		}
+		fmt.Printf("%s: stored %d daily bars from %s to %s\n", symbol, n, from.Format(dateLayout), to.Format(dateLayout))
+	}
+
+	return nil
+}
+
+// aggregateBars rolls daily bars up into weekly (Monday-start) or monthly bars,
+// each dated by its first trading day.
+func aggregateBars(bars []Bar, interval string) []Bar {
+	if interval == "daily" {
+		return bars
+	}
+
+	periodOf := func(t time.Time) time.Time {
+		if interval == "weekly" {
+			offset := (int(t.Weekday()) + 6) % 7
+			return t.AddDate(0, 0, -offset)
+		}
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	var result []Bar
+	var current time.Time
+	for _, bar := range bars {
+		period := periodOf(bar.Date)
+		if len(result) == 0 || !period.Equal(current) {
+			current = period
+			result = append(result, bar)
+			continue
+		}
+
+		last := &result[len(result)-1]
+		last.High = math.Max(last.High, bar.High)
+		last.Low = math.Min(last.Low, bar.Low)
+		last.Close = bar.Close
+		last.Volume += bar.Volume
+	}
+
+	return result
+}
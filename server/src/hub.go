@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Topics are plain strings: "price:<SYMBOL>" for ticks, "user:<id>" for a
+// user's own order and fill events, and "feed" for new posts.
+const feedTopic = "feed"
+
+func priceTopic(symbol string) string {
+	return "price:" + symbol
+}
+
+func userTopic(userId int) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+type Event struct {
+	Type  string      `json:"type"`
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+	Time  time.Time   `json:"time"`
+}
+
+const subscriberBufferSize = 64
+
+// Subscriber is one connected client. Publishing never blocks: if a client
+// falls a full buffer behind it is disconnected and has to reconnect.
+type Subscriber struct {
+	userId    int
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSubscriber(userId int) *Subscriber {
+	return &Subscriber{
+		userId: userId,
+		send:   make(chan []byte, subscriberBufferSize),
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *Subscriber) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+type Hub struct {
+	mu     sync.RWMutex
+	topics map[string]map[*Subscriber]bool
+}
+
+var hub = newHub()
+
+func newHub() *Hub {
+	return &Hub{topics: make(map[string]map[*Subscriber]bool)}
+}
+
+func (h *Hub) Subscribe(s *Subscriber, topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*Subscriber]bool)
+	}
+	h.topics[topic][s] = true
+}
+
+// SubscribePrices subscribes s to the price topics of symbols unless that
+// would leave its user following more than max symbols over all their
+// connections, in which case it subscribes to none of them.
+func (h *Hub) SubscribePrices(s *Subscriber, symbols []string, max int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	following := make(map[string]bool)
+	for topic, subscribers := range h.topics {
+		if !strings.HasPrefix(topic, "price:") {
+			continue
+		}
+		for other := range subscribers {
+			if other.userId == s.userId {
+				following[topic] = true
+				break
+			}
+		}
+	}
+	for _, symbol := range symbols {
+		following[priceTopic(symbol)] = true
+	}
+	if len(following) > max {
+		return false
+	}
+
+	for _, symbol := range symbols {
+		topic := priceTopic(symbol)
+		if h.topics[topic] == nil {
+			h.topics[topic] = make(map[*Subscriber]bool)
+		}
+		h.topics[topic][s] = true
+	}
+	return true
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber, topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.topics[topic], s)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+}
+
+func (h *Hub) Remove(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for topic, subscribers := range h.topics {
+		delete(subscribers, s)
+		if len(subscribers) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+func (h *Hub) TopicsWithPrefix(prefix string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var topics []string
+	for topic := range h.topics {
+		if strings.HasPrefix(topic, prefix) {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+func (h *Hub) Publish(topic, eventType string, data interface{}) {
+	message, err := json.Marshal(Event{Type: eventType, Topic: topic, Data: data, Time: time.Now().UTC()})
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %v\n", eventType, err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.topics[topic] {
+		select {
+		case s.send <- message:
+		default:
+			fmt.Printf("Disconnecting slow websocket client for user %d\n", s.userId)
+			s.Close()
+		}
+	}
+}
+
+func publishPrice(symbol string, price Money, at time.Time) {
+	hub.Publish(priceTopic(symbol), "price", map[string]interface{}{
+		"symbol": symbol,
+		"price":  price,
+		"time":   at,
+	})
+}
+
+// publishOrder tells the account's owner about a change to one of its orders.
+func publishOrder(order Order) {
+	ownerId, competitionId, err := accountOwner(db, order.UserId)
+	if err != nil {
+		fmt.Println("Error looking up account owner for order event:", err)
+		return
+	}
+	order.CompetitionId = competitionId
+	hub.Publish(userTopic(ownerId), "order", order)
+}
+
+// publishFill announces a committed fill to the trader and the new post, if
+// there is one, to the feed. orderId is 0 for market orders.
+func publishFill(fill tradeFill, orderId int) {
+	event := map[string]interface{}{
+		"trade_id":    fill.TradeId,
+		"order_id":    orderId,
+		"symbol":      fill.Symbol,
+		"quantity":    fill.Quantity,
+		"trade_type":  fill.TradeType,
+		"price":       fill.Price,
+		"fees":        fill.Fees.Total(),
+		"new_balance": fill.NewBalance,
+	}
+	if fill.ClosedQuantity > 0 {
+		event["realized_pnl"] = fill.RealizedPnL
+	}
+	if fill.CompetitionId != 0 {
+		event["competition_id"] = fill.CompetitionId
+	}
+	hub.Publish(userTopic(fill.OwnerId), "fill", event)
+
+	if fill.PostId == 0 {
+		return
+	}
+
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", fill.UserId).Scan(&username); err != nil {
+		fmt.Println("Error looking up username for feed event:", err)
+		return
+	}
+
+	hub.Publish(feedTopic, "post", map[string]interface{}{
+		"id":            fill.PostId,
+		"username":      username,
+		"symbol":        fill.Symbol,
+		"quantity":      fill.Quantity,
+		"trade_type":    fill.TradeType,
+		"rationale":     fill.Rationale,
+		"trade_date":    time.Now().UTC(),
+		"likes":         0,
+		"liked_by_user": false,
+	})
+}
+
+// startPriceTicker keeps every symbol somebody is watching fresh, publishing a
+// tick whenever the cached quote changes. Symbols nobody watches any more are
+// forgotten.
+func startPriceTicker(interval time.Duration) {
+	lastPrices := make(map[string]Money)
+
+	go func() {
+		for range time.Tick(interval) {
+			watched := make(map[string]bool)
+			for _, topic := range hub.TopicsWithPrefix("price:") {
+				watched[strings.TrimPrefix(topic, "price:")] = true
+			}
+			for symbol := range lastPrices {
+				if !watched[symbol] {
+					delete(lastPrices, symbol)
+				}
+			}
+
+			for symbol := range watched {
+				quote, err := fetchQuote(symbol)
+				if err != nil {
+					continue
+				}
+				if lastPrices[symbol] != quote.Price {
+					lastPrices[symbol] = quote.Price
+					publishPrice(symbol, quote.Price, quote.Time)
+				}
+			}
+		}
+	}()
+}
+
+// maxSubscribedSymbols caps the price topics one user can follow across all
+// their connections, since the ticker polls the quote provider for every
+// symbol anyone follows.
+const maxSubscribedSymbols = 50
+
+// unknownSymbol returns the first of the normalized symbols that isn't a real
+// instrument, or "" when they all are. Only symbols that pass ever become
+// price topics, so the ticker never asks the provider about anything else.
+func unknownSymbol(symbols []string) (string, error) {
+	for _, symbol := range symbols {
+		if _, err := resolveInstrument(symbol); err == ErrUnknownSymbol {
+			return symbol, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+type wsCommand struct {
+	Action  string   `json:"action"`
+	Symbols []string `json:"symbols"`
+	Channel string   `json:"channel"`
+}
+
+func ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+
+	sub := newSubscriber(getUserIdFromSession(r))
+	hub.Subscribe(sub, userTopic(sub.userId))
+
+	defer func() {
+		hub.Remove(sub)
+		sub.Close()
+		conn.Close()
+	}()
+
+	go writeWebSocketEvents(conn, sub)
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var cmd wsCommand
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			sendToSubscriber(sub, "error", map[string]string{"error": "Invalid message"})
+			continue
+		}
+
+		if cmd.Action != "subscribe" && cmd.Action != "unsubscribe" {
+			sendToSubscriber(sub, "error", map[string]string{"error": "Unknown action"})
+			continue
+		}
+		tooMany := fmt.Sprintf("You can follow at most %d symbols at once", maxSubscribedSymbols)
+		if len(cmd.Symbols) > maxSubscribedSymbols {
+			sendToSubscriber(sub, "error", map[string]string{"error": tooMany})
+			continue
+		}
+
+		var requested []string
+		for _, symbol := range cmd.Symbols {
+			if symbol = normalizeSymbol(symbol); symbol != "" {
+				requested = append(requested, symbol)
+			}
+		}
+		if cmd.Action == "subscribe" {
+			unknown, err := unknownSymbol(requested)
+			if err != nil {
+				sendToSubscriber(sub, "error", map[string]string{"error": "Failed to look up symbols"})
+				continue
+			} else if unknown != "" {
+				sendToSubscriber(sub, "error", map[string]string{"error": "Unknown symbol " + unknown})
+				continue
+			}
+			if !hub.SubscribePrices(sub, requested, maxSubscribedSymbols) {
+				sendToSubscriber(sub, "error", map[string]string{"error": tooMany})
+				continue
+			}
+		} else {
+			for _, symbol := range requested {
+				hub.Unsubscribe(sub, priceTopic(symbol))
+			}
+		}
+
+		var topics []string
+		for _, symbol := range requested {
+			topics = append(topics, priceTopic(symbol))
+		}
+		if cmd.Channel == feedTopic {
+			if cmd.Action == "subscribe" {
+				hub.Subscribe(sub, feedTopic)
+			} else {
+				hub.Unsubscribe(sub, feedTopic)
+			}
+			topics = append(topics, feedTopic)
+		}
+
+		sendToSubscriber(sub, cmd.Action+"d", map[string]interface{}{"topics": topics})
+	}
+}
+
+func sendToSubscriber(s *Subscriber, eventType string, data interface{}) {
+	message, err := json.Marshal(Event{Type: eventType, Data: data, Time: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	select {
+	case s.send <- message:
+	default:
+		s.Close()
+	}
+}
+
+// writeWebSocketEvents is the connection's only writer apart from the pongs
+// and close replies the library sends from the read loop.
+func writeWebSocketEvents(conn *websocket.Conn, s *Subscriber) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case message := <-s.send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				s.Close()
+				conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				s.Close()
+				conn.Close()
+				return
+			}
+		case <-s.done:
+			closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(wsWriteTimeout))
+			conn.Close()
+			return
+		}
+	}
+}
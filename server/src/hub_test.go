@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUnknownSymbol(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		symbols []string
+		want    string
+	}{
+		{[]string{"AAPL", "MSFT"}, ""},
+		{[]string{"AAPL", "NOTAREALCO", "ALSOFAKE"}, "NOTAREALCO"},
+		{[]string{"../../etc"}, "../../etc"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := unknownSymbol(tt.symbols)
+		if err != nil || got != tt.want {
+			t.Errorf("unknownSymbol(%v) = %q, %v, want %q", tt.symbols, got, err, tt.want)
+		}
+	}
+}
+
+func TestSubscribePricesCapsEachUser(t *testing.T) {
+	h := newHub()
+	first, second, other := newSubscriber(1), newSubscriber(1), newSubscriber(2)
+
+	symbols := func(from, to int) []string {
+		var s []string
+		for i := from; i < to; i++ {
+			s = append(s, fmt.Sprintf("SYM%d", i))
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		sub     *Subscriber
+		symbols []string
+		want    bool
+	}{
+		{"first connection", first, symbols(0, 30), true},
+		{"second connection shares the cap", second, symbols(30, 51), false},
+		{"second connection up to the cap", second, symbols(30, 50), true},
+		{"symbols already followed count once", second, symbols(0, 10), true},
+		{"one more symbol", first, symbols(50, 51), false},
+		{"another user has their own cap", other, symbols(0, 50), true},
+	}
+	for _, tt := range tests {
+		if got := h.SubscribePrices(tt.sub, tt.symbols, 50); got != tt.want {
+			t.Errorf("%s: SubscribePrices = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if n := len(h.TopicsWithPrefix("price:")); n != 50 {
+		t.Errorf("%d price topics, want 50", n)
+	}
+
+	// Once a connection goes away its symbols stop counting.
+	h.Remove(first)
+	if !h.SubscribePrices(second, symbols(50, 60), 50) {
+		t.Error("SubscribePrices after the first connection closed = false, want true")
+	}
+}
+
+func TestServeWebSocket(t *testing.T) {
+	setupTestDB(t)
+	cfg.CORSOrigins = []string{"http://app.example"}
+	userId := createTestUser(t, "listener")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWebSocket(w, r.WithContext(context.WithValue(r.Context(), userIdContextKey, userId)))
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.example"}})
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("dial from a foreign origin: %v, want a 403", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://app.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		command string
+		want    string
+		data    string
+	}{
+		{`{"action":"subscribe","symbols":[" aapl ","MSFT"],"channel":"feed"}`, "subscribed", `{"topics":["price:AAPL","price:MSFT","feed"]}`},
+		{`{"action":"subscribe","symbols":["NOTAREALCO"]}`, "error", `{"error":"Unknown symbol NOTAREALCO"}`},
+		{`{"action":"unsubscribe","symbols":["msft"]}`, "unsubscribed", `{"topics":["price:MSFT"]}`},
+		{`{"action":"shout"}`, "error", `{"error":"Unknown action"}`},
+		{`not json`, "error", `{"error":"Invalid message"}`},
+	}
+	for _, tt := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.command)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var event struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != tt.want || string(event.Data) != tt.data {
+			t.Errorf("%s: got %s %s, want %s %s", tt.command, event.Type, event.Data, tt.want, tt.data)
+		}
+	}
+
+	topics := strings.Join(hub.TopicsWithPrefix("price:"), ",")
+	if topics != "price:AAPL" {
+		t.Errorf("price topics %q, want just price:AAPL", topics)
+	}
+}
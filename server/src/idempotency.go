@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// Responses are replayed for idempotencyWindow. A request that never finished
+// (the server died mid-trade) holds its key for idempotencyPendingTimeout
+// before a retry may run it again.
+const idempotencyWindow = 24 * time.Hour
+const idempotencyPendingTimeout = time.Minute
+const maxIdempotencyKeyLength = 255
+
+var errIdempotencyMismatch = errors.New("idempotency key reused with a different request")
+var errIdempotencyInProgress = errors.New("idempotency key in use by a request still running")
+
+type storedResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// claimIdempotencyKey returns the stored response for a key that already
+// finished, or marks the key as in progress and returns nil so the caller runs
+// the request.
+func claimIdempotencyKey(scope, key, requestHash string) (*storedResponse, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	var storedHash string
+	var statusCode sql.NullInt64
+	var stored storedResponse
+	err = tx.QueryRow(`
+		SELECT request_hash, status_code, content_type, response_body FROM idempotency_keys
+		WHERE scope = ? AND key = ? AND expires_at > ?
+	`, scope, key, now).Scan(&storedHash, &statusCode, &stored.ContentType, &stored.Body)
+	if err == nil {
+		if storedHash != requestHash {
+			return nil, errIdempotencyMismatch
+		}
+		if !statusCode.Valid {
+			return nil, errIdempotencyInProgress
+		}
+		stored.StatusCode = int(statusCode.Int64)
+		return &stored, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND key = ?", scope, key); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO idempotency_keys (scope, key, request_hash, expires_at)
+		VALUES (?, ?, ?, ?)
+	`, scope, key, requestHash, now.Add(idempotencyPendingTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, tx.Commit()
+}
+
+func saveIdempotentResponse(scope, key string, response storedResponse) error {
+	_, err := db.Exec(`
+		UPDATE idempotency_keys
+		SET status_code = ?, content_type = ?, response_body = ?, expires_at = ?
+		WHERE scope = ? AND key = ?
+	`, response.StatusCode, response.ContentType, response.Body, time.Now().UTC().Add(idempotencyWindow), scope, key)
+	return err
+}
+
+func releaseIdempotencyKey(scope, key string) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND key = ?", scope, key)
+	return err
+}
+
+func purgeExpiredIdempotencyKeys() {
+	result, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		fmt.Println("Error purging idempotency keys:", err)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		fmt.Printf("Purged %d expired idempotency keys\n", n)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware makes a POST safe to retry when the client sends an
+// Idempotency-Key. Keys belong to the signed-in user (or to nobody, before
+// signup) and the route, query string included since it can pick the
+// account; reusing one with the same body replays the stored response, with a
+// different body gets a 422. Server errors aren't stored, so those can be
+// retried for real.
+func IdempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := fmt.Sprintf("%s %s user:%d", r.Method, r.URL.RequestURI(), getUserIdFromSession(r))
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		stored, err := claimIdempotencyKey(scope, key, requestHash)
+		if err == errIdempotencyMismatch {
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			return
+		} else if err == errIdempotencyInProgress {
+			http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		} else if err != nil {
+			fmt.Println("Error claiming idempotency key:", err)
+			http.Error(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+
+		if stored != nil {
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(idempotentReplayHeader, "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		if rec.status >= http.StatusInternalServerError {
+			err = releaseIdempotencyKey(scope, key)
+		} else {
+			err = saveIdempotentResponse(scope, key, storedResponse{
+				StatusCode:  rec.status,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			})
+		}
+		if err != nil {
+			fmt.Println("Error storing idempotent response:", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyReplay(t *testing.T) {
+	setupTestDB(t)
+
+	// The handler answers with how many times it has run, and fails with a
+	// server error whenever the body asks it to.
+	calls := 0
+	handler := IdempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var body [64]byte
+		n, _ := r.Body.Read(body[:])
+		if string(body[:n]) == "fail" {
+			http.Error(w, "Failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"call":%d}`, calls)
+	})
+
+	steps := []struct {
+		name     string
+		userId   int
+		target   string
+		key      string
+		body     string
+		status   int
+		replayed bool
+		response string
+	}{
+		{"no key runs every time", 1, "/trade", "", "buy", http.StatusCreated, false, `{"call":1}`},
+		{"no key again", 1, "/trade", "", "buy", http.StatusCreated, false, `{"call":2}`},
+		{"first use of a key", 1, "/trade", "k1", "buy", http.StatusCreated, false, `{"call":3}`},
+		{"retry replays", 1, "/trade", "k1", "buy", http.StatusCreated, true, `{"call":3}`},
+		{"different body", 1, "/trade", "k1", "sell", http.StatusUnprocessableEntity, false, ""},
+		{"another user's key", 2, "/trade", "k1", "buy", http.StatusCreated, false, `{"call":4}`},
+		{"another route's key", 1, "/trade?account=2", "k1", "buy", http.StatusCreated, false, `{"call":5}`},
+		{"server error", 1, "/trade", "k2", "fail", http.StatusInternalServerError, false, ""},
+		{"server error isn't stored", 1, "/trade", "k2", "buy", http.StatusCreated, false, `{"call":7}`},
+		{"replay after the retry", 1, "/trade", "k2", "buy", http.StatusCreated, true, `{"call":7}`},
+		{"key too long", 1, "/trade", strings.Repeat("k", maxIdempotencyKeyLength+1), "buy", http.StatusBadRequest, false, ""},
+	}
+	for _, step := range steps {
+		r := asUser(step.userId, "POST", step.target, step.body)
+		if step.key != "" {
+			r.Header.Set(idempotencyKeyHeader, step.key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != step.status {
+			t.Errorf("%s: status %d, want %d", step.name, w.Code, step.status)
+		}
+		if replayed := w.Header().Get(idempotentReplayHeader) == "true"; replayed != step.replayed {
+			t.Errorf("%s: replayed %v, want %v", step.name, replayed, step.replayed)
+		}
+		if step.response != "" && w.Body.String() != step.response {
+			t.Errorf("%s: body %s, want %s", step.name, w.Body.String(), step.response)
+		}
+		if step.replayed && w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: replay lost its content type", step.name)
+		}
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	setupTestDB(t)
+
+	ran := false
+	handler := IdempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) { ran = true })
+
+	// Another request with the same body holds the key without having finished.
+	sum := sha256.Sum256([]byte("buy"))
+	if _, err := claimIdempotencyKey("POST /trade user:1", "k", hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{"buy", http.StatusConflict},
+		{"sell", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		r := asUser(1, "POST", "/trade", tt.body)
+		r.Header.Set(idempotencyKeyHeader, "k")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s while in progress: status %d, want %d", tt.body, w.Code, tt.status)
+		}
+	}
+	if ran {
+		t.Error("handler ran while the key was in progress")
+	}
+}
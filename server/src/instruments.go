@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrInstrumentHalted = errors.New("instrument is halted")
+
+// Instrument is a row of the symbol master. Symbols are stored upper case,
+// and only tradable instruments accept new trades and orders.
+type Instrument struct {
+	Symbol     string `json:"symbol"`
+	Name       string `json:"name"`
+	Exchange   string `json:"exchange"`
+	AssetType  string `json:"asset_type"`
+	Currency   string `json:"currency"`
+	Tradable   bool   `json:"tradable"`
+	HaltReason string `json:"halt_reason,omitempty"`
+}
+
+const instrumentColumns = "symbol, name, exchange, asset_type, currency, tradable, COALESCE(halt_reason, '')"
+
+// InstrumentProvider is implemented by quote providers that can look up a
+// listing, so symbols missing from the master can be added on first use.
+type InstrumentProvider interface {
+	LookupInstrument(symbol string) (Instrument, error)
+}
+
+var symbolPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9.\-]{0,14}$`)
+
+// normalizeSymbol gives the canonical spelling of what a user typed. It
+// doesn't check that the symbol exists; see resolveInstrument.
+func normalizeSymbol(symbol string) string {
+	return strings.ToUpper(strings.TrimSpace(symbol))
+}
+
+func scanInstrument(row rowScanner) (Instrument, error) {
+	var i Instrument
+	err := row.Scan(&i.Symbol, &i.Name, &i.Exchange, &i.AssetType, &i.Currency, &i.Tradable, &i.HaltReason)
+	return i, err
+}
+
+// getInstrument looks a normalized symbol up in the master only.
+func getInstrument(q queryer, symbol string) (Instrument, error) {
+	i, err := scanInstrument(q.QueryRow("SELECT "+instrumentColumns+" FROM instruments WHERE symbol = ?", symbol))
+	if err == sql.ErrNoRows {
+		return Instrument{}, ErrUnknownSymbol
+	}
+	return i, err
+}
+
+// checkTradable is run by the trade and order paths themselves rather than the
+// handler, so a halt also stops requests already on their way through.
+func checkTradable(q queryer, symbol string) error {
+	i, err := getInstrument(q, symbol)
+	if err != nil {
+		return err
+	}
+	if !i.Tradable {
+		return ErrInstrumentHalted
+	}
+	return nil
+}
+
+// resolveInstrument finds a normalized symbol in the master, asking the quote
+// provider about symbols it hasn't seen before and remembering the answer.
+func resolveInstrument(symbol string) (Instrument, error) {
+	if !symbolPattern.MatchString(symbol) {
+		return Instrument{}, ErrUnknownSymbol
+	}
+
+	i, err := getInstrument(db, symbol)
+	if err != ErrUnknownSymbol {
+		return i, err
+	}
+
+	provider, ok := quoteProvider.(InstrumentProvider)
+	if !ok {
+		return Instrument{}, ErrUnknownSymbol
+	}
+	i, err = provider.LookupInstrument(symbol)
+	if err != nil {
+		return Instrument{}, err
+	}
+	if err := storeInstrument(i, false); err != nil {
+		return Instrument{}, err
+	}
+	return getInstrument(db, symbol)
+}
+
+// storeInstrument adds an instrument to the master. With replace set it also
+// overwrites the listing details of one that exists, but never its halt.
+func storeInstrument(i Instrument, replace bool) error {
+	if i.Name == "" {
+		i.Name = i.Symbol
+	}
+	if i.AssetType == "" {
+		i.AssetType = "equity"
+	}
+	if i.Currency == "" {
+		i.Currency = "USD"
+	}
+
+	conflict := "DO NOTHING"
+	if replace {
+		conflict = `DO UPDATE SET name = excluded.name, exchange = excluded.exchange,
+			asset_type = excluded.asset_type, currency = excluded.currency, updated_at = CURRENT_TIMESTAMP`
+	}
+	_, err := db.Exec(`
+		INSERT INTO instruments (symbol, name, exchange, asset_type, currency)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(symbol) `+conflict,
+		i.Symbol, i.Name, i.Exchange, i.AssetType, i.Currency)
+	return err
+}
+
+// setInstrumentTradable halts or resumes trading. Open orders stay open while
+// an instrument is halted but aren't evaluated until it resumes.
+func setInstrumentTradable(symbol string, tradable bool, reason string) error {
+	var haltReason interface{}
+	if !tradable && reason != "" {
+		haltReason = reason
+	}
+	result, err := db.Exec(`
+		UPDATE instruments SET tradable = ?, halt_reason = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE symbol = ?
+	`, tradable, haltReason, symbol)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUnknownSymbol
+	}
+	return nil
+}
+
+// importInstrumentsCSV reads a header row naming its columns, of which symbol
+// and name are required, then one instrument per line. Existing instruments
+// get the new listing details.
+func importInstrumentsCSV(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("%s: read header: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"symbol", "name"} {
+		if _, ok := columns[required]; !ok {
+			return 0, fmt.Errorf("%s: missing %s column", path, required)
+		}
+	}
+
+	imported := 0
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		i := Instrument{
+			Symbol:    normalizeSymbol(field("symbol")),
+			Name:      field("name"),
+			Exchange:  field("exchange"),
+			AssetType: strings.ToLower(field("asset_type")),
+			Currency:  strings.ToUpper(field("currency")),
+		}
+		if !symbolPattern.MatchString(i.Symbol) {
+			return imported, fmt.Errorf("%s:%d: invalid symbol %q", path, line, field("symbol"))
+		}
+		if err := storeInstrument(i, true); err != nil {
+			return imported, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if tradable := field("tradable"); tradable != "" {
+			ok, err := strconv.ParseBool(tradable)
+			if err != nil {
+				return imported, fmt.Errorf("%s:%d: invalid tradable %q", path, line, tradable)
+			}
+			if err := setInstrumentTradable(i.Symbol, ok, ""); err != nil {
+				return imported, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		imported++
+	}
+
+	return imported, nil
+}
+
+// LookupInstrument uses SYMBOL_SEARCH and only accepts an exact match. The
+// search reports a region rather than an exchange, so that is what's stored.
+func (p *AlphaVantageProvider) LookupInstrument(symbol string) (Instrument, error) {
+	params := url.Values{}
+	params.Set("function", "SYMBOL_SEARCH")
+	params.Set("keywords", symbol)
+	params.Set("apikey", p.APIKey)
+
+	resp, err := p.Client.Get("https://www.alphavantage.co/query?" + params.Encode())
+	if err != nil {
+		return Instrument{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Instrument{}, fmt.Errorf("alphavantage: unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Instrument{}, err
+	}
+
+	var result struct {
+		BestMatches []map[string]string `json:"bestMatches"`
+		Note        string              `json:"Note"`
+		Information string              `json:"Information"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return Instrument{}, fmt.Errorf("alphavantage: invalid response: %w", err)
+	}
+
+	switch {
+	case result.Note != "":
+		return Instrument{}, fmt.Errorf("alphavantage: %s", result.Note)
+	case result.Information != "":
+		return Instrument{}, fmt.Errorf("alphavantage: %s", result.Information)
+	}
+
+	for _, match := range result.BestMatches {
+		if normalizeSymbol(match["1. symbol"]) != symbol {
+			continue
+		}
+		return Instrument{
+			Symbol:    symbol,
+			Name:      match["2. name"],
+			Exchange:  match["4. region"],
+			AssetType: strings.ToLower(match["3. type"]),
+			Currency:  match["8. currency"],
+		}, nil
+	}
+	return Instrument{}, ErrUnknownSymbol
+}
+
+// LookupInstrument lists every symbol in the recording, so replays of
+// arbitrary tickers can be traded without importing them first.
+func (p *ReplayProvider) LookupInstrument(symbol string) (Instrument, error) {
+	if _, ok := p.quotes[symbol]; !ok {
+		return Instrument{}, ErrUnknownSymbol
+	}
+	return Instrument{Symbol: symbol, Name: symbol}, nil
+}
+
+// SearchInstruments backs symbol autocomplete. Exact symbols come first, then
+// symbols starting with the query, then names starting with or containing it.
+func SearchInstruments(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Query is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := 10
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > 50 {
+			http.Error(w, "Limit must be between 1 and 50", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query)
+	symbol := normalizeSymbol(query)
+
+	rows, err := db.Query(`
+		SELECT `+instrumentColumns+` FROM instruments
+		WHERE symbol LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\'
+		ORDER BY CASE
+				WHEN symbol = ? THEN 0
+				WHEN symbol LIKE ? ESCAPE '\' THEN 1
+				WHEN name LIKE ? ESCAPE '\' THEN 2
+				ELSE 3
+			END, symbol
+		LIMIT ?
+	`, escaped+"%", "%"+escaped+"%", symbol, escaped+"%", escaped+"%", limit)
+	if err != nil {
+		fmt.Println("Error searching instruments:", err)
+		http.Error(w, "Failed to search instruments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	instruments := []Instrument{}
+	for rows.Next() {
+		i, err := scanInstrument(rows)
+		if err != nil {
+			http.Error(w, "Failed to read instruments", http.StatusInternalServerError)
+			return
+		}
+		instruments = append(instruments, i)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instruments)
+}
+
+func GetInstrument(w http.ResponseWriter, r *http.Request) {
+	i, err := resolveInstrument(normalizeSymbol(mux.Vars(r)["symbol"]))
+	if err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println("Error resolving instrument:", err)
+		http.Error(w, "Failed to fetch instrument", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(i)
+}
+
+func runInstrumentsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: instruments import <file.csv> | halt <symbol> [reason] | resume <symbol>")
+	}
+
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: instruments import <file.csv>")
+		}
+		n, err := importInstrumentsCSV(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d instruments from %s\n", n, args[1])
+	case "halt":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: instruments halt <symbol> [reason]")
+		}
+		symbol := normalizeSymbol(args[1])
+		if err := setInstrumentTradable(symbol, false, strings.Join(args[2:], " ")); err != nil {
+			return fmt.Errorf("%s: %w", symbol, err)
+		}
+		fmt.Printf("Halted trading in %s\n", symbol)
+	case "resume":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: instruments resume <symbol>")
+		}
+		symbol := normalizeSymbol(args[1])
+		if err := setInstrumentTradable(symbol, true, ""); err != nil {
+			return fmt.Errorf("%s: %w", symbol, err)
+		}
+		fmt.Printf("Resumed trading in %s\n", symbol)
+	default:
+		return fmt.Errorf("unknown instruments command %q", args[0])
+	}
+	return nil
+}
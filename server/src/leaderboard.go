@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type leaderboardWindow struct {
+	Name  string
+	Start func(now time.Time) time.Time
+}
+
+// The "all" window has no start; it is measured against the starting balance.
+var leaderboardWindows = []leaderboardWindow{
+	{"1D", func(now time.Time) time.Time { return now.AddDate(0, 0, -1) }},
+	{"1W", func(now time.Time) time.Time { return now.AddDate(0, 0, -7) }},
+	{"1M", func(now time.Time) time.Time { return now.AddDate(0, -1, 0) }},
+	{"YTD", func(now time.Time) time.Time { return time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC) }},
+	{"all", nil},
+}
+
+const (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+)
+
+type LeaderboardEntry struct {
+	Rank     int                 `json:"rank"`
+	UserId   int                 `json:"-"`
+	Username string              `json:"username"`
+	Equity   Money               `json:"totalValue"`
+	GainLoss float64             `json:"gainLoss"`
+	Returns  map[string]*float64 `json:"returns"`
+}
+
+// sqliteTimeLayout matches CURRENT_TIMESTAMP, which is how trade_date and
+// accrued_at are written.
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// currentEquities values the accounts in a competition, or the main accounts
+// when competitionId is 0.
+func currentEquities(q queryer, competitionId int) ([]LeaderboardEntry, error) {
+	valuations, err := accountValuations(q, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(valuations))
+	for _, v := range valuations {
+		if v.CompetitionId != competitionId {
+			continue
+		}
+		entries = append(entries, LeaderboardEntry{UserId: v.UserId, Username: v.Username, Equity: v.Equity()})
+	}
+	return entries, nil
+}
+
+// equitiesAt reconstructs every user's equity as of at by unwinding the trades,
+// margin fees, external cash flows, dividends and splits booked since then,
+// and pricing the positions held at that time at the last daily close on or
+// before it. Users who signed up later come out at exactly their starting
+// balance.
+func equitiesAt(q queryer, at time.Time) (map[int]Money, error) {
+	since := at.UTC().Format(sqliteTimeLayout)
+	day := at.UTC().Format(dateLayout)
+
+	rows, err := q.Query(`
+		WITH flows AS (
+			SELECT user_id, CASE trade_type WHEN 'buy' THEN -quantity * price ELSE quantity * price END
+				- commission - regulatory_fee AS amount
+			FROM trades WHERE trade_date > ?
+			UNION ALL
+			SELECT user_id, -(borrow_fee + interest) FROM margin_fees WHERE accrued_at > ?
+			UNION ALL
+			SELECT e.user_id, e.amount
+			FROM ledger_entries e
+			JOIN ledger_transactions t ON t.id = e.transaction_id
+			WHERE e.account = 'cash' AND (t.kind IN `+externalFlowKinds+` OR t.kind IN `+corporateActionKinds+`)
+				AND t.created_at > ?
+		),
+		positions AS (
+			SELECT user_id, symbol, SUM(quantity) AS quantity
+			FROM (
+				SELECT user_id, symbol, quantity FROM portfolio
+				UNION ALL
+				SELECT user_id, symbol, CASE trade_type WHEN 'buy' THEN -quantity ELSE quantity END
+				FROM trades WHERE trade_date > ?
+				UNION ALL
+				SELECT user_id, symbol, quantity_before - quantity_after
+				FROM corporate_action_events WHERE created_at > ?
+			)
+			GROUP BY user_id, symbol
+			HAVING SUM(quantity) != 0
+		),
+		holdings AS (
+			SELECT pos.user_id, SUM(pos.quantity * COALESCE(
+				(SELECT CAST(ROUND(h.close * 100) AS INTEGER) FROM historical_prices h WHERE h.symbol = pos.symbol AND h.date <= ? ORDER BY h.date DESC LIMIT 1),
+				(SELECT t.price FROM trades t WHERE t.symbol = pos.symbol AND t.trade_date <= ? ORDER BY t.trade_date DESC LIMIT 1),
+				0
+			)) AS value
+			FROM positions pos
+			GROUP BY pos.user_id
+		)
+		SELECT u.id,
+			u.balance - COALESCE((SELECT SUM(f.amount) FROM flows f WHERE f.user_id = u.id), 0) + COALESCE(h.value, 0)
+		FROM users u
+		LEFT JOIN holdings h ON h.user_id = u.id
+	`, since, since, since, since, since, day, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	equities := make(map[int]Money)
+	for rows.Next() {
+		var userId int
+		var equity Money
+		if err := rows.Scan(&userId, &equity); err != nil {
+			return nil, err
+		}
+		equities[userId] = equity
+	}
+	return equities, rows.Err()
+}
+
+// percentReturn is nil when there is no meaningful base to measure from.
+func percentReturn(start, end Money) *float64 {
+	if start <= 0 {
+		return nil
+	}
+	r := (end - start).Float64() / start.Float64() * 100
+	return &r
+}
+
+// buildLeaderboard ranks the main accounts, or one competition's accounts,
+// with the all-time return measured against startingBalance.
+func buildLeaderboard(q queryer, now time.Time, competitionId int, startingBalance Money) ([]LeaderboardEntry, error) {
+	entries, err := currentEquities(q, competitionId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].Returns = make(map[string]*float64)
+	}
+
+	for _, window := range leaderboardWindows {
+		// Deposits and withdrawals during the window come off the ending
+		// equity so they don't count as gains or losses.
+		var start time.Time
+		if window.Start != nil {
+			start = window.Start(now)
+		}
+		flows, err := externalFlowsSince(q, start)
+		if err != nil {
+			return nil, fmt.Errorf("%s window: %w", window.Name, err)
+		}
+
+		if window.Start == nil {
+			for i := range entries {
+				entries[i].Returns[window.Name] = percentReturn(startingBalance, entries[i].Equity-flows[entries[i].UserId])
+			}
+			continue
+		}
+
+		starts, err := equitiesAt(q, start)
+		if err != nil {
+			return nil, fmt.Errorf("%s window: %w", window.Name, err)
+		}
+		for i := range entries {
+			entries[i].Returns[window.Name] = percentReturn(starts[entries[i].UserId], entries[i].Equity-flows[entries[i].UserId])
+		}
+	}
+
+	for i := range entries {
+		if all := entries[i].Returns["all"]; all != nil {
+			entries[i].GainLoss = *all
+		}
+	}
+
+	return entries, nil
+}
+
+// rankLeaderboard orders entries by equity, or by the return over a window.
+// Users without a return for that window sort last; ties go to username.
+func rankLeaderboard(entries []LeaderboardEntry, sortBy string) {
+	key := func(e LeaderboardEntry) float64 {
+		if sortBy == "equity" {
+			return e.Equity.Float64()
+		}
+		if r := e.Returns[sortBy]; r != nil {
+			return *r
+		}
+		return math.Inf(-1)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := key(entries[i]), key(entries[j])
+		if a != b {
+			return a > b
+		}
+		return entries[i].Username < entries[j].Username
+	})
+
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+}
+
+func isValidLeaderboardSort(sortBy string) bool {
+	if sortBy == "equity" {
+		return true
+	}
+	for _, window := range leaderboardWindows {
+		if window.Name == sortBy {
+			return true
+		}
+	}
+	return false
+}
+
+func GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	query := r.URL.Query()
+
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "equity"
+	}
+	if !isValidLeaderboardSort(sortBy) {
+		http.Error(w, "sort must be equity, 1D, 1W, 1M, YTD or all", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultLeaderboardLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxLeaderboardLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxLeaderboardLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+
+	// In a competition the board ranks its accounts instead, and is open to
+	// the participants and the creator. Once the competition is finalized it
+	// shows the frozen standings.
+	var competition *Competition
+	accountId := userId
+	if value := query.Get("competition"); value != "" {
+		competitionId, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid competition id", http.StatusBadRequest)
+			return
+		}
+		c, id, err := viewCompetition(competitionId, userId)
+		if err == ErrCompetitionNotFound {
+			http.Error(w, "Competition not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get competition", http.StatusInternalServerError)
+			return
+		}
+		competition, accountId = &c, id
+	}
+
+	var entries []LeaderboardEntry
+	var err error
+	if competition == nil {
+		entries, err = buildLeaderboard(db, time.Now().UTC(), 0, cfg.StartingBalance)
+	} else if competition.FinalizedAt != nil {
+		entries, err = finalStandings(*competition)
+	} else {
+		entries, err = buildLeaderboard(db, time.Now().UTC(), competition.Id, competition.StartingBalance)
+	}
+	if err != nil {
+		fmt.Println("Error building leaderboard:", err)
+		http.Error(w, "Failed to fetch leaderboard data", http.StatusInternalServerError)
+		return
+	}
+	if competition != nil && competition.FinalizedAt != nil {
+		sortBy = "equity"
+	} else {
+		rankLeaderboard(entries, sortBy)
+	}
+
+	var me *LeaderboardEntry
+	for i := range entries {
+		if accountId != 0 && entries[i].UserId == accountId {
+			me = &entries[i]
+			break
+		}
+	}
+
+	page := []LeaderboardEntry{}
+	if offset < len(entries) {
+		page = entries[offset:min(offset+limit, len(entries))]
+	}
+
+	response := map[string]interface{}{
+		"entries": page,
+		"total":   len(entries),
+		"limit":   limit,
+		"offset":  offset,
+		"sort":    sortBy,
+		"me":      me,
+	}
+	if competition != nil {
+		response["competition"] = competition
+		response["final"] = competition.FinalizedAt != nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// updateLeaderboardRanks records where every main account stands by equity and
+// tells each user who overtook them since the last run. Users new to the board
+// don't count as passing anyone until they have a rank of their own.
+func updateLeaderboardRanks() {
+	entries, err := currentEquities(db, 0)
+	if err != nil {
+		fmt.Println("Error valuing accounts for leaderboard ranks:", err)
+		return
+	}
+	rankLeaderboard(entries, "equity")
+
+	previous := make(map[int]int)
+	rows, err := db.Query("SELECT user_id, rank FROM leaderboard_ranks")
+	if err != nil {
+		fmt.Println("Error fetching leaderboard ranks:", err)
+		return
+	}
+	for rows.Next() {
+		var userId, rank int
+		if err := rows.Scan(&userId, &rank); err != nil {
+			rows.Close()
+			fmt.Println("Error scanning leaderboard rank:", err)
+			return
+		}
+		previous[userId] = rank
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("Error starting leaderboard rank transaction:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, e := range entries {
+		_, err := tx.Exec(`
+			INSERT INTO leaderboard_ranks (user_id, rank, equity, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id) DO UPDATE SET
+				rank = excluded.rank, equity = excluded.equity, updated_at = excluded.updated_at
+		`, e.UserId, e.Rank, e.Equity, now)
+		if err != nil {
+			fmt.Printf("Error storing leaderboard rank for user %d: %v\n", e.UserId, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Error committing leaderboard ranks:", err)
+		return
+	}
+
+	// entries is in rank order, so everyone ahead of a user now comes before
+	// them.
+	for i, e := range entries {
+		was, ok := previous[e.UserId]
+		if !ok {
+			continue
+		}
+		var passedBy []string
+		for _, ahead := range entries[:i] {
+			if rank, ok := previous[ahead.UserId]; ok && rank > was {
+				passedBy = append(passedBy, ahead.Username)
+			}
+		}
+		if len(passedBy) == 0 {
+			continue
+		}
+
+		who := passedBy[0]
+		switch {
+		case len(passedBy) == 2:
+			who += " and " + passedBy[1]
+		case len(passedBy) > 2:
+			who += fmt.Sprintf(" and %d others", len(passedBy)-1)
+		}
+		message := fmt.Sprintf("%s passed you on the leaderboard; you're now #%d", who, e.Rank)
+		notify(e.UserId, "leaderboard_passed", message, map[string]interface{}{
+			"rank":          e.Rank,
+			"previous_rank": was,
+			"passed_by":     passedBy,
+		})
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Ledger accounts. cash is the user's own money; the others are the house
+// accounts on the other side of each transaction.
+const (
+	accountCash    = "cash"
+	accountMarket  = "market"
+	accountFees    = "fees"
+	accountCapital = "capital"
+)
+
+// Ledger transaction kinds.
+const (
+	ledgerOpeningBalance = "opening_balance"
+	ledgerDeposit        = "deposit"
+	ledgerWithdrawal     = "withdrawal"
+	ledgerAdjustment     = "adjustment"
+	ledgerReset          = "reset"
+	ledgerTrade          = "trade"
+	ledgerBorrowFee      = "borrow_fee"
+	ledgerMarginInterest = "margin_interest"
+	ledgerCommission     = "commission"
+	ledgerRegulatoryFee  = "regulatory_fee"
+)
+
+// externalFlowKinds move cash into or out of an account from outside it.
+// Returns are measured net of them.
+const externalFlowKinds = "('deposit', 'withdrawal', 'adjustment', 'reset')"
+
+// postCash records amount moving into the user's cash from the contra house
+// account (out of it when negative) as one balanced transaction, and applies
+// it to users.balance. tradeId is 0 for transactions that aren't trades.
+func postCash(tx *sql.Tx, userId int, kind, contra string, amount Money, tradeId int64, memo string) error {
+	var trade interface{}
+	if tradeId != 0 {
+		trade = tradeId
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO ledger_transactions (user_id, kind, trade_id, memo)
+		VALUES (?, ?, ?, ?)
+	`, userId, kind, trade, memo)
+	if err != nil {
+		return fmt.Errorf("record ledger transaction: %w", err)
+	}
+	transactionId, _ := result.LastInsertId()
+
+	_, err = tx.Exec(`
+		INSERT INTO ledger_entries (transaction_id, user_id, account, amount)
+		VALUES (?, ?, ?, ?), (?, ?, ?, ?)
+	`, transactionId, userId, accountCash, amount, transactionId, userId, contra, -amount)
+	if err != nil {
+		return fmt.Errorf("record ledger entries: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ?", amount, userId)
+	if err != nil {
+		return fmt.Errorf("update balance: %w", err)
+	}
+	return nil
+}
+
+// openAccount funds a new user with the starting balance.
+func openAccount(tx *sql.Tx, userId int) error {
+	return postCash(tx, userId, ledgerOpeningBalance, accountCapital, cfg.StartingBalance, 0, "Starting balance")
+}
+
+// externalFlowsSince sums each user's deposits, withdrawals, adjustments and
+// resets booked after since.
+func externalFlowsSince(q queryer, since time.Time) (map[int]Money, error) {
+	rows, err := q.Query(`
+		SELECT e.user_id, SUM(e.amount)
+		FROM ledger_entries e
+		JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.account = 'cash' AND t.kind IN `+externalFlowKinds+` AND t.created_at > ?
+		GROUP BY e.user_id
+	`, since.UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := make(map[int]Money)
+	for rows.Next() {
+		var userId int
+		var amount Money
+		if err := rows.Scan(&userId, &amount); err != nil {
+			return nil, err
+		}
+		flows[userId] = amount
+	}
+	return flows, rows.Err()
+}
+
+// netFlowsOn sums one user's external flows on day, or every user's when
+// userId is 0.
+func netFlowsOn(q queryer, userId int, day time.Time) (map[int]Money, error) {
+	rows, err := q.Query(`
+		SELECT e.user_id, SUM(e.amount)
+		FROM ledger_entries e
+		JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.account = 'cash' AND t.kind IN `+externalFlowKinds+` AND date(t.created_at) = ?
+			AND (? = 0 OR e.user_id = ?)
+		GROUP BY e.user_id
+	`, day.Format(dateLayout), userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := make(map[int]Money)
+	for rows.Next() {
+		var id int
+		var amount Money
+		if err := rows.Scan(&id, &amount); err != nil {
+			return nil, err
+		}
+		flows[id] = amount
+	}
+	return flows, rows.Err()
+}
+
+func GetStatement(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, err := parseDateRange(r.URL.Query(), 30)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var opening Money
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(e.amount), 0)
+		FROM ledger_entries e
+		JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.user_id = ? AND e.account = 'cash' AND date(t.created_at) < ?
+	`, userId, from.Format(dateLayout)).Scan(&opening)
+	if err != nil {
+		fmt.Println("Error querying opening balance:", err)
+		http.Error(w, "Failed to fetch statement", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT t.id, t.kind, t.trade_id, t.memo, t.created_at, e.amount
+		FROM ledger_entries e
+		JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.user_id = ? AND e.account = 'cash' AND date(t.created_at) >= ? AND date(t.created_at) <= ?
+		ORDER BY t.id ASC
+	`, userId, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		fmt.Println("Error querying statement:", err)
+		http.Error(w, "Failed to fetch statement", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	balance := opening
+	entries := []map[string]interface{}{}
+	for rows.Next() {
+		var id int
+		var kind, memo string
+		var tradeId sql.NullInt64
+		var createdAt time.Time
+		var amount Money
+		if err := rows.Scan(&id, &kind, &tradeId, &memo, &createdAt, &amount); err != nil {
+			fmt.Println("Error scanning statement row:", err)
+			http.Error(w, "Failed to fetch statement", http.StatusInternalServerError)
+			return
+		}
+
+		balance += amount
+		entry := map[string]interface{}{
+			"id":      id,
+			"date":    createdAt,
+			"kind":    kind,
+			"memo":    memo,
+			"amount":  amount,
+			"balance": balance,
+		}
+		if tradeId.Valid {
+			entry["tradeId"] = tradeId.Int64
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":           from.Format(dateLayout),
+		"to":             to.Format(dateLayout),
+		"openingBalance": opening,
+		"closingBalance": balance,
+		"entries":        entries,
+	})
+}
+
+func decodeCashAmount(w http.ResponseWriter, r *http.Request) (Money, bool) {
+	var req struct {
+		Amount Money `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return 0, false
+	}
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be greater than 0", http.StatusBadRequest)
+		return 0, false
+	}
+	return req.Amount, true
+}
+
+// Withdraw only pays out cash that isn't held by open orders, and never
+// borrows, even on margin accounts. A margin account must still meet its
+// initial margin requirement afterwards, so short sale proceeds stay put.
+func Withdraw(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	amount, ok := decodeCashAmount(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	available, err := availableBalance(tx, userId)
+	if err != nil {
+		http.Error(w, "Failed to get available balance", http.StatusInternalServerError)
+		return
+	}
+	if available < amount {
+		http.Error(w, "Insufficient balance", http.StatusBadRequest)
+		return
+	}
+
+	if err := postCash(tx, userId, ledgerWithdrawal, accountCapital, -amount, 0, "Withdrawal"); err != nil {
+		fmt.Println("Error posting withdrawal:", err)
+		http.Error(w, "Failed to withdraw", http.StatusInternalServerError)
+		return
+	}
+
+	margin, err := isMarginAccount(tx, userId)
+	if err != nil {
+		http.Error(w, "Failed to get account data", http.StatusInternalServerError)
+		return
+	}
+	if margin {
+		if err := checkInitialMargin(tx, userId, nil); err == ErrInsufficientMargin {
+			http.Error(w, "Insufficient margin", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to check margin", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	respondWithBalance(w, tx, userId, "Withdrawal successful")
+}
+
+func respondWithBalance(w http.ResponseWriter, tx *sql.Tx, userId int, message string) {
+	var balance Money
+	if err := tx.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&balance); err != nil {
+		http.Error(w, "Failed to get balance", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     message,
+		"new_balance": balance,
+	})
+}
+
+// resetAccount cancels the user's open orders, closes every position at
+// market and brings cash back to the starting balance. Accounts under a
+// margin call can't reset their way out of it.
+func resetAccount(userId int) ([]tradeFill, error) {
+	version, err := accountVersion(db, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions []marginPosition
+	rows, err := db.Query("SELECT symbol, quantity FROM portfolio WHERE user_id = ? AND quantity != 0", userId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var position marginPosition
+		if err := rows.Scan(&position.Symbol, &position.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		positions = append(positions, position)
+	}
+	rows.Close()
+
+	for i := range positions {
+		if positions[i].Price, err = fetchStockPrice(positions[i].Symbol); err != nil {
+			return nil, fmt.Errorf("price %s: %w", positions[i].Symbol, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if current, err := accountVersion(tx, userId); err != nil {
+		return nil, err
+	} else if current != version {
+		return nil, ErrAccountChanged
+	}
+
+	var callAt sql.NullTime
+	err = tx.QueryRow("SELECT margin_call_at FROM margin_accounts WHERE user_id = ?", userId).Scan(&callAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if callAt.Valid {
+		return nil, ErrMarginCallPending
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', status_reason = 'account reset', reserved_cash = 0,
+			reserved_shares = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND status = 'open'
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var fills []tradeFill
+	for _, position := range positions {
+		tradeType, quantity := "sell", position.Quantity
+		if quantity < 0 {
+			tradeType, quantity = "buy", -quantity
+		}
+		fill, err := executeTrade(tx, userId, position.Symbol, quantity, tradeType, position.Price, "Account reset", nil, true)
+		if err != nil {
+			return nil, fmt.Errorf("close %s: %w", position.Symbol, err)
+		}
+		fills = append(fills, fill)
+	}
+
+	var balance Money
+	if err := tx.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&balance); err != nil {
+		return nil, err
+	}
+	if balance != cfg.StartingBalance {
+		if err := postCash(tx, userId, ledgerReset, accountCapital, cfg.StartingBalance-balance, 0, "Account reset"); err != nil {
+			return nil, err
+		}
+	}
+
+	return fills, tx.Commit()
+}
+
+func ResetAccount(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	fills, err := resetAccount(userId)
+	if err == ErrAccountChanged {
+		http.Error(w, "Account is busy, please retry the reset", http.StatusConflict)
+		return
+	} else if err == ErrMarginCallPending {
+		http.Error(w, "Meet or wait out the margin call before resetting", http.StatusConflict)
+		return
+	} else if err != nil {
+		fmt.Println("Error resetting account:", err)
+		http.Error(w, "Failed to reset account", http.StatusInternalServerError)
+		return
+	}
+
+	for _, fill := range fills {
+		publishFill(fill, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "Account reset",
+		"new_balance":      cfg.StartingBalance,
+		"closed_positions": len(fills),
+	})
+}
+
+// runDepositCommand credits a user's account with cash from outside:
+// deposit <username> <amount>. Deposits are admin-only, since the leaderboard
+// ranks by equity and users could otherwise buy their way to the top.
+func runDepositCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: deposit <username> <amount>")
+	}
+
+	amount, err := ParseMoney(args[1])
+	if err != nil {
+		return err
+	}
+	if amount <= 0 {
+		return fmt.Errorf("amount must be greater than 0")
+	}
+
+	userId, err := userIdByUsername(args[0])
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user named %q", args[0])
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := postCash(tx, userId, ledgerDeposit, accountCapital, amount, 0, "Deposit"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deposited $%s for %s\n", amount, args[0])
+	return nil
+}
+
+// runAdjustCommand posts an admin adjustment: adjust <username> <amount> <memo>.
+func runAdjustCommand(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: adjust <username> <amount> <memo>")
+	}
+
+	amount, err := ParseMoney(args[1])
+	if err != nil {
+		return err
+	}
+	if amount == 0 {
+		return fmt.Errorf("amount must not be zero")
+	}
+
+	userId, err := userIdByUsername(args[0])
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user named %q", args[0])
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := postCash(tx, userId, ledgerAdjustment, accountCapital, amount, 0, strings.Join(args[2:], " ")); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Adjusted %s by $%s\n", args[0], amount)
+	return nil
+}
+
+// runReconcileCommand checks that every ledger transaction balances, then
+// rebuilds each users.balance from its cash entries and reports the ones that
+// had drifted. With -dry-run it only reports.
+func runReconcileCommand(args []string) error {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "-dry-run" {
+			return fmt.Errorf("unknown argument %s", arg)
+		}
+		dryRun = true
+	}
+
+	rows, err := db.Query(`
+		SELECT transaction_id, SUM(amount) FROM ledger_entries
+		GROUP BY transaction_id HAVING SUM(amount) != 0
+	`)
+	if err != nil {
+		return err
+	}
+	unbalanced := 0
+	for rows.Next() {
+		var transactionId int
+		var imbalance Money
+		if err := rows.Scan(&transactionId, &imbalance); err != nil {
+			rows.Close()
+			return err
+		}
+		fmt.Printf("Transaction %d is out of balance by $%s\n", transactionId, imbalance)
+		unbalanced++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type mismatch struct {
+		userId         int
+		username       string
+		stored, ledger Money
+	}
+	var mismatches []mismatch
+
+	rows, err = tx.Query(`
+		SELECT u.id, u.username, u.balance,
+			COALESCE((SELECT SUM(amount) FROM ledger_entries WHERE user_id = u.id AND account = 'cash'), 0)
+		FROM users u
+		ORDER BY u.id
+	`)
+	if err != nil {
+		return err
+	}
+	checked := 0
+	for rows.Next() {
+		var m mismatch
+		if err := rows.Scan(&m.userId, &m.username, &m.stored, &m.ledger); err != nil {
+			rows.Close()
+			return err
+		}
+		checked++
+		if m.stored != m.ledger {
+			mismatches = append(mismatches, m)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		fmt.Printf("User %d (%s): balance $%s, ledger $%s, off by $%s\n",
+			m.userId, m.username, m.stored, m.ledger, m.stored-m.ledger)
+		if dryRun {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE users SET balance = ?, version = version + 1 WHERE id = ?", m.ledger, m.userId); err != nil {
+			return err
+		}
+	}
+
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	action := "rebuilt"
+	if dryRun {
+		action = "found"
+	}
+	fmt.Printf("Checked %d accounts: %d mismatches %s, %d unbalanced transactions\n", checked, len(mismatches), action, unbalanced)
+	if unbalanced > 0 {
+		return fmt.Errorf("%d ledger transactions do not balance", unbalanced)
+	}
+	return nil
+}
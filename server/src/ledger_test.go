@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// asUser builds a request as AuthMiddleware would pass it on for userId.
+func asUser(userId int, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), userIdContextKey, userId))
+}
+
+func TestWithdrawKeepsInitialMargin(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "shorter")
+	if _, err := db.Exec("INSERT INTO margin_accounts (user_id) VALUES (?)", userId); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shorting 10 at $100 adds $1,000 of proceeds to the $10,000 starting cash,
+	// for $10,000 of equity, and needs $500 of it to stay above initial margin.
+	// The proceeds alone would cover a $10,500 withdrawal.
+	tradeAt(t, userId, "AAPL", 10, "sell", 10000)
+
+	tests := []struct {
+		amount string
+		status int
+	}{
+		{"10500", http.StatusBadRequest},
+		{"9500.01", http.StatusBadRequest},
+		{"9500", http.StatusOK},
+		{"0.01", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		Withdraw(w, asUser(userId, "POST", "/cash/withdraw", `{"amount": `+tt.amount+`}`))
+		if w.Code != tt.status {
+			t.Errorf("withdrawing %s: status %d (%s), want %d", tt.amount, w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+		}
+	}
+
+	var balance Money
+	if err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&balance); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 150000 {
+		t.Errorf("balance %s, want 1500.00", balance)
+	}
+}
+
+func TestResetRefusedDuringMarginCall(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "called")
+	if _, err := db.Exec("INSERT INTO margin_accounts (user_id, margin_call_at) VALUES (?, CURRENT_TIMESTAMP)", userId); err != nil {
+		t.Fatal(err)
+	}
+	tradeAt(t, userId, "AAPL", 10, "sell", 10000)
+
+	w := httptest.NewRecorder()
+	ResetAccount(w, asUser(userId, "POST", "/account/reset", ""))
+	if w.Code != http.StatusConflict {
+		t.Errorf("reset under a margin call: status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	var held int
+	if err := db.QueryRow("SELECT quantity FROM portfolio WHERE user_id = ? AND symbol = 'AAPL'", userId).Scan(&held); err != nil {
+		t.Fatal(err)
+	}
+	if held != -10 {
+		t.Errorf("holding %d AAPL after a refused reset, want -10", held)
+	}
+
+	if _, err := db.Exec("UPDATE margin_accounts SET margin_call_at = NULL WHERE user_id = ?", userId); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	ResetAccount(w, asUser(userId, "POST", "/account/reset", ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("reset once the call is met: status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), http.StatusOK)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidLotSelection = errors.New("invalid lot selection")
+
+// Lot methods decide which open lots a closing trade consumes. "average"
+// depletes lots oldest first but books every close against the average cost
+// of all open lots, then reprices the lots left open at that average;
+// "specific" closes the lots named on the trade, then falls back to oldest
+// first.
+var lotMethods = []string{"fifo", "lifo", "specific", "average"}
+
+func isValidLotMethod(method string) bool {
+	for _, m := range lotMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+type lotSelection struct {
+	LotId    int64 `json:"lot_id"`
+	Quantity int   `json:"quantity"`
+}
+
+type Lot struct {
+	Id        int64      `json:"id"`
+	Symbol    string     `json:"symbol"`
+	Side      string     `json:"side"`
+	Quantity  int        `json:"quantity"`
+	Remaining int        `json:"remaining"`
+	Price     Money      `json:"price"`
+	OpenedAt  time.Time  `json:"opened_at"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+}
+
+func lotMethod(q queryer, userId int) (string, error) {
+	var method string
+	err := q.QueryRow("SELECT lot_method FROM users WHERE id = ?", userId).Scan(&method)
+	return method, err
+}
+
+func openLots(q queryer, userId int, symbol, side string) ([]Lot, error) {
+	rows, err := q.Query(`
+		SELECT id, symbol, side, quantity, remaining, price, opened_at
+		FROM lots
+		WHERE user_id = ? AND symbol = ? AND side = ? AND remaining > 0
+		ORDER BY id ASC
+	`, userId, symbol, side)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lots []Lot
+	for rows.Next() {
+		var lot Lot
+		if err := rows.Scan(&lot.Id, &lot.Symbol, &lot.Side, &lot.Quantity, &lot.Remaining, &lot.Price, &lot.OpenedAt); err != nil {
+			return nil, err
+		}
+		lots = append(lots, lot)
+	}
+	return lots, rows.Err()
+}
+
+type lotClose struct {
+	lot      *Lot
+	quantity int
+}
+
+// planLotCloses picks which lots, and how much of each, to close for
+// quantity shares. lots arrive oldest first.
+func planLotCloses(lots []Lot, quantity int, method string, selection []lotSelection) ([]lotClose, error) {
+	byId := make(map[int64]*Lot)
+	for i := range lots {
+		byId[lots[i].Id] = &lots[i]
+	}
+
+	var plan []lotClose
+	taken := make(map[int64]int)
+	remaining := quantity
+
+	for _, s := range selection {
+		lot, ok := byId[s.LotId]
+		if !ok || s.Quantity <= 0 || taken[s.LotId]+s.Quantity > lot.Remaining {
+			return nil, ErrInvalidLotSelection
+		}
+		if s.Quantity > remaining {
+			return nil, ErrInvalidLotSelection
+		}
+		plan = append(plan, lotClose{lot, s.Quantity})
+		taken[s.LotId] += s.Quantity
+		remaining -= s.Quantity
+	}
+
+	order := make([]*Lot, 0, len(lots))
+	for i := range lots {
+		order = append(order, &lots[i])
+	}
+	if method == "lifo" {
+		sort.SliceStable(order, func(i, j int) bool { return order[i].Id > order[j].Id })
+	}
+
+	for _, lot := range order {
+		if remaining == 0 {
+			break
+		}
+		free := lot.Remaining - taken[lot.Id]
+		if free <= 0 {
+			continue
+		}
+		n := min(free, remaining)
+		plan = append(plan, lotClose{lot, n})
+		taken[lot.Id] += n
+		remaining -= n
+	}
+
+	return plan, nil
+}
+
+// applyLots updates the user's lots for a fill of delta shares (positive for
+// buys) at price, closing lots on the opposite side first and opening a new
+// lot with whatever is left. It returns the realized P&L and how many shares
+// were closed.
+func applyLots(tx *sql.Tx, userId int, symbol string, tradeId int64, delta int, price Money, selection []lotSelection) (Money, int, error) {
+	openSide, closeSide := "long", "short"
+	quantity := delta
+	if delta < 0 {
+		openSide, closeSide = "short", "long"
+		quantity = -delta
+	}
+
+	method, err := lotMethod(tx, userId)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get lot method: %w", err)
+	}
+	if len(selection) > 0 && method != "specific" {
+		return 0, 0, ErrInvalidLotSelection
+	}
+
+	lots, err := openLots(tx, userId, symbol, closeSide)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get open lots: %w", err)
+	}
+
+	var poolCost Money
+	var poolShares int
+	for _, lot := range lots {
+		poolCost += lot.Price.Times(lot.Remaining)
+		poolShares += lot.Remaining
+	}
+
+	plan, err := planLotCloses(lots, quantity, method, selection)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var realized, pooledBasis Money
+	var closed int
+	for _, c := range plan {
+		// A lot's own basis is exact. Average cost takes this close's share of
+		// the whole pool's cost, rounded to the nearest cent, halves away from
+		// zero. Prorating the running total keeps the closes of one trade from
+		// each rounding the same way.
+		basis := c.lot.Price.Times(c.quantity)
+		if method == "average" {
+			basis = poolCost.Prorate(closed+c.quantity, poolShares) - pooledBasis
+			pooledBasis += basis
+		}
+
+		// A long lot's cost is what was paid for it; a short lot's proceeds
+		// are what it was sold for.
+		costBasis, proceeds := basis, price.Times(c.quantity)
+		if closeSide == "short" {
+			costBasis, proceeds = proceeds, costBasis
+		}
+		pnl := proceeds - costBasis
+
+		c.lot.Remaining -= c.quantity
+		if c.lot.Remaining == 0 {
+			_, err = tx.Exec("UPDATE lots SET remaining = 0, closed_at = CURRENT_TIMESTAMP WHERE id = ?", c.lot.Id)
+		} else {
+			_, err = tx.Exec("UPDATE lots SET remaining = ? WHERE id = ?", c.lot.Remaining, c.lot.Id)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("update lot: %w", err)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO lot_closures (lot_id, trade_id, quantity, cost_basis, proceeds, realized_pnl)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, c.lot.Id, tradeId, c.quantity, costBasis, proceeds, pnl)
+		if err != nil {
+			return 0, 0, fmt.Errorf("record lot closure: %w", err)
+		}
+
+		realized += pnl
+		closed += c.quantity
+	}
+
+	// Whatever is left of the pool carries on at its average cost, so the next
+	// close, the portfolio's average price and unrealized P&L all see what
+	// the shares cost on average rather than the prices of the lots that
+	// happened to be left open.
+	if method == "average" && closed > 0 && closed < poolShares {
+		average := (poolCost - pooledBasis).Prorate(1, poolShares-closed)
+		_, err = tx.Exec(`
+			UPDATE lots SET price = ? WHERE user_id = ? AND symbol = ? AND side = ? AND remaining > 0
+		`, average, userId, symbol, closeSide)
+		if err != nil {
+			return 0, 0, fmt.Errorf("reprice lots at average cost: %w", err)
+		}
+	}
+
+	if opening := quantity - closed; opening > 0 {
+		_, err = tx.Exec(`
+			INSERT INTO lots (user_id, symbol, side, quantity, remaining, price, opened_trade_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, userId, symbol, openSide, opening, opening, price, tradeId)
+		if err != nil {
+			return 0, 0, fmt.Errorf("open lot: %w", err)
+		}
+	}
+
+	return realized, closed, nil
+}
+
+// lotCostBasis is the average price of the user's remaining lots in symbol,
+// which is what the portfolio shows as average_price. It is rounded to the
+// nearest cent, halves away from zero; the lots keep the exact cost.
+func lotCostBasis(q queryer, userId int, symbol string) (Money, error) {
+	var cost Money
+	var shares int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(remaining * price), 0), COALESCE(SUM(remaining), 0) FROM lots
+		WHERE user_id = ? AND symbol = ? AND remaining > 0
+	`, userId, symbol).Scan(&cost, &shares)
+	return cost.Prorate(1, shares), err
+}
+
+func GetLots(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+	symbol := normalizeSymbol(r.URL.Query().Get("symbol"))
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+	if status != "open" && status != "all" {
+		http.Error(w, "Status must be open or all", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT id, symbol, side, quantity, remaining, price, opened_at, closed_at
+		FROM lots WHERE user_id = ?`
+	args := []interface{}{userId}
+	if symbol != "" {
+		query += " AND symbol = ?"
+		args = append(args, symbol)
+	}
+	if status == "open" {
+		query += " AND remaining > 0"
+	}
+	query += " ORDER BY id ASC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch lots", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lots := []Lot{}
+	for rows.Next() {
+		var lot Lot
+		var closedAt sql.NullTime
+		if err := rows.Scan(&lot.Id, &lot.Symbol, &lot.Side, &lot.Quantity, &lot.Remaining, &lot.Price, &lot.OpenedAt, &closedAt); err != nil {
+			http.Error(w, "Failed to scan lot", http.StatusInternalServerError)
+			return
+		}
+		if closedAt.Valid {
+			lot.ClosedAt = &closedAt.Time
+		}
+		lots = append(lots, lot)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lots)
+}
+
+func SetLotMethod(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !isValidLotMethod(req.Method) {
+		http.Error(w, "Method must be one of "+strings.Join(lotMethods, ", "), http.StatusBadRequest)
+		return
+	}
+
+	userId := getUserIdFromSession(r)
+	if _, err := db.Exec("UPDATE users SET lot_method = ? WHERE id = ?", req.Method, userId); err != nil {
+		http.Error(w, "Failed to update lot method", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"lot_method": req.Method})
+}
+
+// pnlPeriods maps the period query parameter to a strftime format.
+var pnlPeriods = map[string]string{
+	"day":   "%Y-%m-%d",
+	"month": "%Y-%m",
+	"year":  "%Y",
+}
+
+// GetPnLReport splits realized P&L by symbol and by period for closing trades
+// in the date range, and unrealized P&L by symbol for lots still open, marked
+// at the latest daily price.
+func GetPnLReport(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+
+	period := query.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	format, ok := pnlPeriods[period]
+	if !ok {
+		http.Error(w, "Period must be day, month or year", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseDateRange(query, 365)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method, err := lotMethod(db, userId)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Realized P&L is before fees; fees are every fee paid on trades in the
+	// period, whether they opened or closed a position.
+	rows, err := db.Query(`
+		SELECT symbol, strftime(?, trade_date), COALESCE(SUM(realized_pnl), 0), SUM(commission + regulatory_fee)
+		FROM trades
+		WHERE user_id = ? AND date(trade_date) >= ? AND date(trade_date) <= ?
+		GROUP BY symbol, strftime(?, trade_date)
+		HAVING COUNT(realized_pnl) > 0 OR SUM(commission + regulatory_fee) > 0
+		ORDER BY 2 ASC
+	`, format, userId, from.Format(dateLayout), to.Format(dateLayout), format)
+	if err != nil {
+		fmt.Println("Error querying realized P&L:", err)
+		http.Error(w, "Failed to fetch realized P&L", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var realizedTotal, feesTotal Money
+	realizedBySymbol := make(map[string]Money)
+	feesBySymbol := make(map[string]Money)
+	realizedByPeriod := []map[string]interface{}{}
+	periodIndex := make(map[string]int)
+	for rows.Next() {
+		var symbol, bucket string
+		var pnl, fees Money
+		if err := rows.Scan(&symbol, &bucket, &pnl, &fees); err != nil {
+			http.Error(w, "Failed to scan realized P&L", http.StatusInternalServerError)
+			return
+		}
+		realizedTotal += pnl
+		realizedBySymbol[symbol] += pnl
+		feesTotal += fees
+		feesBySymbol[symbol] += fees
+		if i, ok := periodIndex[bucket]; ok {
+			realizedByPeriod[i]["realized"] = realizedByPeriod[i]["realized"].(Money) + pnl
+			realizedByPeriod[i]["fees"] = realizedByPeriod[i]["fees"].(Money) + fees
+			realizedByPeriod[i]["net"] = realizedByPeriod[i]["net"].(Money) + pnl - fees
+		} else {
+			periodIndex[bucket] = len(realizedByPeriod)
+			realizedByPeriod = append(realizedByPeriod, map[string]interface{}{"period": bucket, "realized": pnl, "fees": fees, "net": pnl - fees})
+		}
+	}
+
+	lotRows, err := db.Query(`
+		SELECT l.symbol, l.side, l.remaining, l.price, dsp.price
+		FROM lots l
+		LEFT JOIN (
+			SELECT dsp.symbol, dsp.price
+			FROM daily_stock_prices dsp
+			INNER JOIN (
+				SELECT symbol, MAX(updated_at) AS latest_update
+				FROM daily_stock_prices
+				GROUP BY symbol
+			) latest ON dsp.symbol = latest.symbol AND dsp.updated_at = latest.latest_update
+		) dsp ON dsp.symbol = l.symbol
+		WHERE l.user_id = ? AND l.remaining > 0
+	`, userId)
+	if err != nil {
+		fmt.Println("Error querying open lots:", err)
+		http.Error(w, "Failed to fetch unrealized P&L", http.StatusInternalServerError)
+		return
+	}
+	defer lotRows.Close()
+
+	var unrealizedTotal Money
+	unrealizedBySymbol := make(map[string]map[string]interface{})
+	for lotRows.Next() {
+		var symbol, side string
+		var remaining int
+		var lotPrice Money
+		var marketPrice sql.NullInt64
+		if err := lotRows.Scan(&symbol, &side, &remaining, &lotPrice, &marketPrice); err != nil {
+			http.Error(w, "Failed to scan open lot", http.StatusInternalServerError)
+			return
+		}
+
+		// Without a market price the lot is marked at cost.
+		price := lotPrice
+		if marketPrice.Valid {
+			price = Money(marketPrice.Int64)
+		}
+		quantity := remaining
+		if side == "short" {
+			quantity = -remaining
+		}
+		costBasis := lotPrice.Times(quantity)
+		marketValue := price.Times(quantity)
+
+		entry, ok := unrealizedBySymbol[symbol]
+		if !ok {
+			entry = map[string]interface{}{"quantity": 0, "costBasis": Money(0), "marketValue": Money(0), "unrealized": Money(0)}
+			unrealizedBySymbol[symbol] = entry
+		}
+		entry["quantity"] = entry["quantity"].(int) + quantity
+		entry["costBasis"] = entry["costBasis"].(Money) + costBasis
+		entry["marketValue"] = entry["marketValue"].(Money) + marketValue
+		entry["unrealized"] = entry["unrealized"].(Money) + marketValue - costBasis
+		unrealizedTotal += marketValue - costBasis
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lotMethod": method,
+		"from":      from.Format(dateLayout),
+		"to":        to.Format(dateLayout),
+		"period":    period,
+		"realized": map[string]interface{}{
+			"total":    realizedTotal,
+			"bySymbol": realizedBySymbol,
+			"byPeriod": realizedByPeriod,
+		},
+		"fees": map[string]interface{}{
+			"total":    feesTotal,
+			"bySymbol": feesBySymbol,
+		},
+		"netRealized": realizedTotal - feesTotal,
+		"unrealized": map[string]interface{}{
+			"total":    unrealizedTotal,
+			"bySymbol": unrealizedBySymbol,
+		},
+	})
+}
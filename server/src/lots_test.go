@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+// Buying 10 at $100 and 10 at $200, then selling 10 at $150 twice, books the
+// $3,000 paid for the shares under every lot method; they only differ in
+// which sell gets which part of it.
+func TestLotMethodsCloseAtCost(t *testing.T) {
+	tests := []struct {
+		method       string
+		realized     [2]Money
+		averageAfter Money
+	}{
+		{"fifo", [2]Money{50000, -50000}, 20000},
+		{"lifo", [2]Money{-50000, 50000}, 10000},
+		{"average", [2]Money{0, 0}, 15000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			setupTestDB(t)
+			userId := createTestUser(t, "lots")
+			if _, err := db.Exec("UPDATE users SET balance = 1000000, lot_method = ? WHERE id = ?", tt.method, userId); err != nil {
+				t.Fatal(err)
+			}
+
+			tradeAt(t, userId, "AAPL", 10, "buy", 10000)
+			tradeAt(t, userId, "AAPL", 10, "buy", 20000)
+
+			first := tradeAt(t, userId, "AAPL", 10, "sell", 15000)
+			if first.RealizedPnL != tt.realized[0] {
+				t.Errorf("first sell realized %s, want %s", first.RealizedPnL, tt.realized[0])
+			}
+
+			average, err := lotCostBasis(db, userId, "AAPL")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if average != tt.averageAfter {
+				t.Errorf("lot cost basis after first sell is %s, want %s", average, tt.averageAfter)
+			}
+			var shown Money
+			if err := db.QueryRow("SELECT average_price FROM portfolio WHERE user_id = ? AND symbol = 'AAPL'", userId).Scan(&shown); err != nil {
+				t.Fatal(err)
+			}
+			if shown != tt.averageAfter {
+				t.Errorf("portfolio average price after first sell is %s, want %s", shown, tt.averageAfter)
+			}
+
+			second := tradeAt(t, userId, "AAPL", 10, "sell", 15000)
+			if second.RealizedPnL != tt.realized[1] {
+				t.Errorf("second sell realized %s, want %s", second.RealizedPnL, tt.realized[1])
+			}
+
+			var basis Money
+			if err := db.QueryRow(`
+				SELECT SUM(c.cost_basis) FROM lot_closures c JOIN lots l ON l.id = c.lot_id WHERE l.user_id = ?
+			`, userId).Scan(&basis); err != nil {
+				t.Fatal(err)
+			}
+			if basis != 300000 {
+				t.Errorf("booked %s of cost basis, want 3000.00", basis)
+			}
+		})
+	}
+}
+
+func TestPlanLotCloses(t *testing.T) {
+	lots := func() []Lot {
+		return []Lot{{Id: 1, Remaining: 5}, {Id: 2, Remaining: 5}, {Id: 3, Remaining: 5}}
+	}
+	type closed struct {
+		id       int64
+		quantity int
+	}
+	tests := []struct {
+		name      string
+		quantity  int
+		method    string
+		selection []lotSelection
+		want      []closed
+		wantErr   bool
+	}{
+		{"fifo", 7, "fifo", nil, []closed{{1, 5}, {2, 2}}, false},
+		{"lifo", 7, "lifo", nil, []closed{{3, 5}, {2, 2}}, false},
+		{"average depletes oldest first", 6, "average", nil, []closed{{1, 5}, {2, 1}}, false},
+		{"specific then oldest", 7, "specific", []lotSelection{{3, 4}}, []closed{{3, 4}, {1, 3}}, false},
+		{"selection over lot", 7, "specific", []lotSelection{{2, 6}}, nil, true},
+		{"selection over quantity", 3, "specific", []lotSelection{{2, 4}}, nil, true},
+		{"unknown lot", 1, "specific", []lotSelection{{9, 1}}, nil, true},
+		{"more than open", 20, "fifo", nil, []closed{{1, 5}, {2, 5}, {3, 5}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := planLotCloses(lots(), tt.quantity, tt.method, tt.selection)
+			if tt.wantErr {
+				if err != ErrInvalidLotSelection {
+					t.Fatalf("got error %v, want ErrInvalidLotSelection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []closed
+			for _, c := range plan {
+				got = append(got, closed{c.lot.Id, c.quantity})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("plan %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("plan %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
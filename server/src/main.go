@@ -3,13 +3,13 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -20,12 +20,11 @@ import (
 )
 
 var db *sql.DB
-var stockCache map[string]StockPrice
 
 type StockPrice struct {
-	Symbol string  `json:"symbol"`
-	Price  float64 `json:"price"`
-	Time   string  `json:"time"`
+	Symbol string `json:"symbol"`
+	Price  Money  `json:"price"`
+	Time   string `json:"time"`
 }
 
 func getCookieValue(r *http.Request, cookieName string) string {
@@ -36,9 +35,9 @@ func getCookieValue(r *http.Request, cookieName string) string {
 	return cookie.Value
 }
 
-func initDB() {
+func openDB() {
 	var err error
-	db, err = sql.Open("sqlite3", "./data.db")
+	db, err = sql.Open("sqlite3", databaseDSN(cfg.DatabasePath))
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -46,111 +45,242 @@ func initDB() {
 	if err = db.Ping(); err != nil {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
+}
 
-	tables := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			first_name TEXT NOT NULL,
-			last_name TEXT NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			username TEXT UNIQUE NOT NULL,
-			password TEXT NOT NULL,
-			balance REAL NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS trades (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			symbol TEXT NOT NULL,
-			quantity INTEGER NOT NULL,
-			price REAL NOT NULL,
-			trade_type TEXT NOT NULL,
-			trade_date DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS portfolio (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			symbol TEXT NOT NULL,
-			quantity INTEGER NOT NULL,
-			average_price REAL NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			UNIQUE(user_id, symbol)
-		)`,
-		`CREATE TABLE IF NOT EXISTS posts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			symbol TEXT NOT NULL,
-			quantity INTEGER NOT NULL,
-			trade_type TEXT NOT NULL,
-			rationale TEXT,
-			trade_date DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS posts_likes (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			post_id INTEGER NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (post_id) REFERENCES posts(id),
-			UNIQUE(user_id, post_id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS daily_stock_prices (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			symbol TEXT NOT NULL,
-			price REAL NOT NULL,
-			updated_at DATETIME NOT NULL,
-			UNIQUE(symbol, updated_at)
-		)`,
-	}
-
-	for _, table := range tables {
-		_, err := db.Exec(table)
-		if err != nil {
-			log.Printf("Error creating table: %v", err)
-		}
+// databaseDSN opens every transaction with BEGIN IMMEDIATE, so a transaction
+// holds the write lock from its first read and read-check-write sequences like
+// a trade can't interleave. Writers queue for up to five seconds rather than
+// failing straight away with "database is locked".
+func databaseDSN(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
 	}
+	return "file:" + strings.TrimPrefix(path, "file:") + separator + "_txlock=immediate&_busy_timeout=5000"
+}
 
-	log.Println("Connected to database and ensured all tables exist.")
+func initDB() {
+	openDB()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	if err := checkSchemaVersion(db, migrations); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
+	if err := migrateTo(db, migrations, latestMigrationVersion(migrations)); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	log.Println("Connected to database and applied all migrations.")
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file (default $TRADEX_CONFIG, then ./config.json)")
+	flag.Parse()
+	args := flag.Args()
+
+	var err error
+	cfg, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if len(args) > 0 && args[0] == "config" {
+		if err := runConfigCommand(cfg); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		openDB()
+		if err := runMigrateCommand(db, args[1:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		db.Close()
+		return
+	}
+
 	initDB()
 	defer db.Close()
+	initQuotes()
+
+	if len(args) > 0 && args[0] == "backfill" {
+		if err := runBackfillCommand(args[1:]); err != nil {
+			log.Fatalf("backfill: %v", err)
+		}
+		return
+	}
 
-	stockCache = make(map[string]StockPrice)
+	if len(args) > 0 && args[0] == "reconcile" {
+		if err := runReconcileCommand(args[1:]); err != nil {
+			log.Fatalf("reconcile: %v", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "corporate-actions" {
+		if err := runCorporateActionsCommand(args[1:]); err != nil {
+			log.Fatalf("corporate-actions: %v", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "instruments" {
+		if err := runInstrumentsCommand(args[1:]); err != nil {
+			log.Fatalf("instruments: %v", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "deposit" {
+		if err := runDepositCommand(args[1:]); err != nil {
+			log.Fatalf("deposit: %v", err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "adjust" {
+		if err := runAdjustCommand(args[1:]); err != nil {
+			log.Fatalf("adjust: %v", err)
+		}
+		return
+	}
+
+	marginSettings = cfg.Margin
+	if marketCalendar, err = newTradingCalendar(cfg.Market); err != nil {
+		log.Fatalf("Failed to configure trading calendar: %v", err)
+	}
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/signup", PostSignup).Methods("POST")
+	r.HandleFunc("/signup", IdempotencyMiddleware(PostSignup)).Methods("POST")
 	r.HandleFunc("/login", PostLogin).Methods("POST")
 	r.HandleFunc("/logout", Logout).Methods("POST")
+	r.HandleFunc("/logout-all", AuthMiddleware(LogoutAll)).Methods("POST")
 	r.HandleFunc("/protected", AuthMiddleware(ProtectedHandler)).Methods("GET")
-	r.HandleFunc("/userdata", GetUserData).Methods("GET")
+	r.HandleFunc("/userdata", AuthMiddleware(GetUserData)).Methods("GET")
 	r.HandleFunc("/stock-price", GetStockPrice).Methods("GET")
-	r.HandleFunc("/trade", AuthMiddleware(MakeTrade)).Methods("POST")
+	r.HandleFunc("/market/status", GetMarketStatus).Methods("GET")
+	r.HandleFunc("/instruments/search", SearchInstruments).Methods("GET")
+	r.HandleFunc("/instruments/{symbol}", GetInstrument).Methods("GET")
+	r.HandleFunc("/trade", AuthMiddleware(IdempotencyMiddleware(MakeTrade))).Methods("POST")
+	r.HandleFunc("/trades", AuthMiddleware(GetTradeHistory)).Methods("GET")
+	r.HandleFunc("/orders", AuthMiddleware(GetOrders)).Methods("GET")
+	r.HandleFunc("/orders/{id}", AuthMiddleware(AmendOrder)).Methods("PUT")
+	r.HandleFunc("/orders/{id}", AuthMiddleware(CancelOrder)).Methods("DELETE")
 	r.HandleFunc("/portfolio-value", AuthMiddleware(GetPortfolioValue)).Methods("GET")
+	r.HandleFunc("/portfolio/history", AuthMiddleware(GetPortfolioHistory)).Methods("GET")
+	r.HandleFunc("/lots", AuthMiddleware(GetLots)).Methods("GET")
+	r.HandleFunc("/lot-method", AuthMiddleware(SetLotMethod)).Methods("PUT")
+	r.HandleFunc("/closed-market-orders", AuthMiddleware(SetClosedMarketOrders)).Methods("PUT")
+	r.HandleFunc("/pnl", AuthMiddleware(GetPnLReport)).Methods("GET")
+	r.HandleFunc("/statement", AuthMiddleware(GetStatement)).Methods("GET")
+	r.HandleFunc("/cash/withdraw", AuthMiddleware(Withdraw)).Methods("POST")
+	r.HandleFunc("/account/reset", AuthMiddleware(ResetAccount)).Methods("POST")
+	r.HandleFunc("/margin/enable", AuthMiddleware(EnableMargin)).Methods("POST")
+	r.HandleFunc("/margin/disable", AuthMiddleware(DisableMargin)).Methods("POST")
 	r.HandleFunc("/historical-prices", AuthMiddleware(GetHistoricalPrices)).Methods("GET")
 	r.HandleFunc("/leaderboard", AuthMiddleware(GetLeaderboard)).Methods("GET")
+	r.HandleFunc("/competitions", AuthMiddleware(GetCompetitions)).Methods("GET")
+	r.HandleFunc("/competitions", AuthMiddleware(CreateCompetition)).Methods("POST")
+	r.HandleFunc("/competitions/join", AuthMiddleware(JoinCompetition)).Methods("POST")
+	r.HandleFunc("/competitions/{id}", AuthMiddleware(GetCompetition)).Methods("GET")
+	r.HandleFunc("/watchlists", AuthMiddleware(GetWatchlists)).Methods("GET")
+	r.HandleFunc("/watchlists", AuthMiddleware(CreateWatchlist)).Methods("POST")
+	r.HandleFunc("/watchlists/order", AuthMiddleware(ReorderWatchlists)).Methods("PUT")
+	r.HandleFunc("/watchlists/{id}", AuthMiddleware(GetWatchlist)).Methods("GET")
+	r.HandleFunc("/watchlists/{id}", AuthMiddleware(UpdateWatchlist)).Methods("PUT")
+	r.HandleFunc("/watchlists/{id}", AuthMiddleware(DeleteWatchlist)).Methods("DELETE")
+	r.HandleFunc("/watchlists/{id}/symbols", AuthMiddleware(AddWatchlistSymbol)).Methods("POST")
+	r.HandleFunc("/watchlists/{id}/symbols/{symbol}", AuthMiddleware(RemoveWatchlistSymbol)).Methods("DELETE")
+	r.HandleFunc("/alerts", AuthMiddleware(GetAlerts)).Methods("GET")
+	r.HandleFunc("/alerts", AuthMiddleware(CreateAlert)).Methods("POST")
+	r.HandleFunc("/alerts/{id}", AuthMiddleware(DeleteAlert)).Methods("DELETE")
+	r.HandleFunc("/notifications", AuthMiddleware(GetNotifications)).Methods("GET")
+	r.HandleFunc("/notifications/read-all", AuthMiddleware(MarkAllNotificationsRead)).Methods("POST")
+	r.HandleFunc("/notifications/preferences", AuthMiddleware(GetNotificationPreferences)).Methods("GET")
+	r.HandleFunc("/notifications/preferences", AuthMiddleware(UpdateNotificationPreferences)).Methods("PUT")
+	r.HandleFunc("/notifications/{id}/read", AuthMiddleware(MarkNotificationRead)).Methods("POST")
 	r.HandleFunc("/posts", AuthMiddleware(GetPosts)).Methods("GET")
+	r.HandleFunc("/feed", AuthMiddleware(GetFeed)).Methods("GET")
+	r.HandleFunc("/users/{username}", AuthMiddleware(GetUserProfile)).Methods("GET")
+	r.HandleFunc("/users/{username}/follow", AuthMiddleware(FollowUser)).Methods("POST")
+	r.HandleFunc("/users/{username}/follow", AuthMiddleware(UnfollowUser)).Methods("DELETE")
+	r.HandleFunc("/users/{username}/followers", AuthMiddleware(GetFollowers)).Methods("GET")
+	r.HandleFunc("/users/{username}/following", AuthMiddleware(GetFollowing)).Methods("GET")
 	r.HandleFunc("/like/{id}", AuthMiddleware(ToggleLike)).Methods("POST")
+	r.HandleFunc("/posts/{id}/comments", AuthMiddleware(GetComments)).Methods("GET")
+	r.HandleFunc("/posts/{id}/comments", AuthMiddleware(CreateComment)).Methods("POST")
+	r.HandleFunc("/comments/{id}", AuthMiddleware(UpdateComment)).Methods("PUT")
+	r.HandleFunc("/comments/{id}", AuthMiddleware(DeleteComment)).Methods("DELETE")
+	r.HandleFunc("/comments/{id}/like", AuthMiddleware(ToggleCommentLike)).Methods("POST")
+	r.HandleFunc("/ws", AuthMiddleware(ServeWebSocket)).Methods("GET")
 
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173"},
+		AllowedOrigins:   cfg.CORSOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", idempotencyKeyHeader},
+		ExposedHeaders:   []string{idempotentReplayHeader},
 		AllowCredentials: true,
 	})
 
 	handler := c.Handler(r)
 
-	startStockPriceUpdateJob()
+	startScheduledJobs()
+	startPriceTicker(cfg.PriceTickInterval.Duration)
+
+	if cfg.DebugAddr != "" {
+		go serveDebug(cfg.DebugAddr)
+	}
+
+	log.Printf("Listening on %s", cfg.Addr)
+	fmt.Println(http.ListenAndServe(cfg.Addr, handler))
+}
+
+// serveDebug serves the endpoints only operators should see on their own
+// listener, which carries no sessions and no CORS.
+func serveDebug(addr string) {
+	r := mux.NewRouter()
+	r.HandleFunc("/quote-cache/stats", GetQuoteCacheStats).Methods("GET")
+
+	log.Printf("Serving debug endpoints on %s", addr)
+	fmt.Println(http.ListenAndServe(addr, r))
+}
+
+func initQuotes() {
+	var err error
+	quoteProvider, err = newQuoteProvider(cfg.Quotes)
+	if err != nil {
+		log.Fatalf("Failed to configure quote provider: %v", err)
+	}
+	log.Printf("Using %s quote provider", quoteProvider.Name())
 
-	fmt.Println(http.ListenAndServe(":5174", handler))
+	quoteCache = newQuoteCache(quoteProvider, cfg.QuoteCache)
 }
 
-func startStockPriceUpdateJob() {
+func startScheduledJobs() {
 	c := cron.New()
-	c.AddFunc("10 15 * * *", updateDailyStockPrices)
+	if cfg.Schedules.DailyPrices != "" {
+		c.AddFunc(cfg.Schedules.DailyPrices, updateDailyStockPrices)
+	} else {
+		c.Schedule(closeSchedule{marketCalendar, cfg.Market.DailyPricesDelay.Duration}, cron.FuncJob(updateDailyStockPrices))
+	}
+	c.AddFunc(cfg.Schedules.PriceHistory, updateHistoricalPrices)
+	c.AddFunc(cfg.Schedules.EquitySnapshots, snapshotEquities)
+	c.AddFunc(cfg.Schedules.OpenOrders, evaluateOpenOrders)
+	c.AddFunc(cfg.Schedules.MarginCalls, checkMarginCalls)
+	c.AddFunc(cfg.Schedules.BorrowFees, accrueBorrowFees)
+	c.AddFunc(cfg.Schedules.ExpiredSessions, purgeExpiredSessions)
+	c.AddFunc(cfg.Schedules.IdempotencyKeys, purgeExpiredIdempotencyKeys)
+	c.AddFunc(cfg.Schedules.Competitions, finalizeCompetitions)
+	c.AddFunc(cfg.Schedules.CorporateActions, updateCorporateActions)
+	c.AddFunc(cfg.Schedules.PriceAlerts, evaluatePriceAlerts)
+	c.AddFunc(cfg.Schedules.LeaderboardRanks, updateLeaderboardRanks)
 	c.Start()
 }
 
@@ -177,7 +307,8 @@ func updateDailyStockPrices() {
 		if err != nil {
 			fmt.Printf("Error storing daily price for %s: %v\n", symbol, err)
 		} else {
-			fmt.Printf("Updated daily price for %s: $%.2f\n", symbol, price)
+			fmt.Printf("Updated daily price for %s: $%s\n", symbol, price)
+			publishPrice(symbol, price, time.Now().UTC())
 		}
 	}
 
@@ -203,35 +334,13 @@ func getUniqueSymbolsInPortfolios() ([]string, error) {
 	return symbols, nil
 }
 
-func fetchStockPrice(symbol string) (float64, error) {
-	apiKey := "J585VGMES541XQW2"
-	url := fmt.Sprintf("https://www.alphavantage.co/query?function=GLOBAL_QUOTE&symbol=%s&apikey=%s", symbol, apiKey)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return 0, err
-	}
-
-	var result map[string]interface{}
-	json.Unmarshal(body, &result)
-
-	globalQuote, ok := result["Global Quote"].(map[string]interface{})
-	if !ok {
-		return 0, fmt.Errorf("invalid response from API")
-	}
-
-	price, err := strconv.ParseFloat(globalQuote["05. price"].(string), 64)
-	if err != nil {
-		return 0, err
+func isAllowedOrigin(origin string) bool {
+	for _, allowed := range cfg.CORSOrigins {
+		if allowed == origin {
+			return true
+		}
 	}
-
-	return price, nil
+	return false
 }
 
 func IsEmailValid(email string) bool {
@@ -241,24 +350,26 @@ func IsEmailValid(email string) bool {
 }
 
 func GetUserData(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_token")
+	userId := getUserIdFromSession(r)
+
+	var balance Money
+	err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&balance)
 	if err != nil {
-		fmt.Println("Error! No cookie provided.")
+		fmt.Println("Error querying user balance:", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var balance float64
-	err = db.QueryRow("SELECT balance FROM users WHERE username = ?", cookie.Value).Scan(&balance)
+	available, err := availableBalance(db, userId)
 	if err != nil {
-		fmt.Println("Username or Password Incorrect!")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		http.Error(w, "Failed to get available balance", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]float64{
-		"balance": balance,
+	json.NewEncoder(w).Encode(map[string]Money{
+		"balance":           balance,
+		"available_balance": available,
 	})
 }
 
@@ -328,19 +439,34 @@ func PostSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO users (first_name, last_name, email, username, password, balance)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, credentials.FirstName, credentials.LastName, credentials.Email, credentials.Username, string(hashedPassword), 10000.0)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
+	result, err := tx.Exec(`
+		INSERT INTO users (first_name, last_name, email, username, password, balance)
+		VALUES (?, ?, ?, ?, ?, 0)
+	`, credentials.FirstName, credentials.LastName, credentials.Email, credentials.Username, string(hashedPassword))
 	if err != nil {
 		http.Error(w, "Failed to insert user", http.StatusInternalServerError)
 		return
-	} else {
-		fmt.Printf("Success: User Added")
 	}
 
 	id, _ := result.LastInsertId()
+	if err := openAccount(tx, int(id)); err != nil {
+		fmt.Println("Error opening account:", err)
+		http.Error(w, "Failed to insert user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to insert user", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Success: User Added")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -361,8 +487,12 @@ func PostLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var userId int
 	var hashedPassword string
-	err := db.QueryRow("SELECT password FROM users WHERE username = ?", credentials.Username).Scan(&hashedPassword)
+	err := db.QueryRow(`
+		SELECT id, password FROM users
+		WHERE username = ? AND id NOT IN (SELECT account_id FROM competition_entries)
+	`, credentials.Username).Scan(&userId, &hashedPassword)
 	if err != nil {
 		http.Error(w, "Username or Password Incorrect", http.StatusUnauthorized)
 		return
@@ -373,14 +503,13 @@ func PostLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    credentials.Username,
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: false,
-		Secure:   false,
-		SameSite: http.SameSiteStrictMode,
-	})
+	token, expiresAt, err := createSession(userId)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, token, expiresAt)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -390,14 +519,14 @@ func PostLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func Logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    "",
-		Expires:  time.Now().Add(-time.Hour),
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	if token := getCookieValue(r, sessionCookieName); token != "" {
+		if err := deleteSession(token); err != nil {
+			http.Error(w, "Failed to end session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	clearSessionCookie(w)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -405,25 +534,18 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_token")
-		if err != nil {
-			if err == http.ErrNoCookie {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
-		}
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	if err := revokeUserSessions(getUserIdFromSession(r)); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
 
-		if cookie.Value == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	clearSessionCookie(w)
 
-		next.ServeHTTP(w, r)
-	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Logged out of all sessions",
+	})
 }
 
 func ProtectedHandler(w http.ResponseWriter, r *http.Request) {
@@ -434,59 +556,51 @@ func ProtectedHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetStockPrice(w http.ResponseWriter, r *http.Request) {
-	symbol := r.URL.Query().Get("symbol")
+	symbol := normalizeSymbol(r.URL.Query().Get("symbol"))
 	if symbol == "" {
 		http.Error(w, "Symbol is required", http.StatusBadRequest)
 		return
 	}
 
-	if cachedPrice, ok := stockCache[symbol]; ok {
-		parsedTime, err := time.Parse(time.RFC3339, cachedPrice.Time)
-		if err == nil && time.Since(parsedTime) < 5*time.Minute {
-			json.NewEncoder(w).Encode(cachedPrice)
-			return
-		}
+	if _, err := resolveInstrument(symbol); err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println("Error resolving instrument:", err)
+		http.Error(w, "Failed to fetch stock price", http.StatusInternalServerError)
+		return
 	}
 
-	price, err := fetchStockPrice(symbol)
-	if err != nil {
+	quote, err := fetchQuote(symbol)
+	if err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to fetch stock price", http.StatusInternalServerError)
 		return
 	}
 
 	stockPrice := StockPrice{
 		Symbol: symbol,
-		Price:  price,
-		Time:   time.Now().Format(time.RFC3339)}
-
-	stockCache[symbol] = stockPrice
+		Price:  quote.Price,
+		Time:   quote.Time.Format(time.RFC3339)}
 
 	json.NewEncoder(w).Encode(stockPrice)
 }
 
-func getUserIdFromSession(r *http.Request) int {
-	cookie, err := r.Cookie("session_token")
-	if err != nil {
-		return 0
-	}
-
-	var userId int
-	err = db.QueryRow("SELECT id FROM users WHERE username = ?", cookie.Value).Scan(&userId)
-	if err != nil {
-		return 0
-	}
-
-	return userId
-}
-
 func MakeTrade(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var tradeReq struct {
-		Symbol    string `json:"symbol"`
-		Quantity  int    `json:"quantity"`
-		TradeType string `json:"trade_type"`
-		Rationale string `json:"rationale"`
+		Symbol     string `json:"symbol"`
+		Quantity   int    `json:"quantity"`
+		TradeType  string `json:"trade_type"`
+		OrderType  string `json:"order_type"`
+		LimitPrice *Money `json:"limit_price"`
+		StopPrice  *Money `json:"stop_price"`
+		Rationale  string `json:"rationale"`
+		// Lots picks the lots to close on specific-lot accounts.
+		Lots []lotSelection `json:"lots"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&tradeReq); err != nil {
@@ -499,160 +613,250 @@ func MakeTrade(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, _ := r.Cookie("session_token")
-	username := cookie.Value
-
-	stockPrice, err := fetchStockPrice(tradeReq.Symbol)
-	if err != nil {
-		http.Error(w, "Failed to get stock price", http.StatusInternalServerError)
+	if !isValidTradeType(tradeReq.TradeType) {
+		http.Error(w, "Trade type must be buy or sell", http.StatusBadRequest)
 		return
 	}
 
-	totalCost := float64(tradeReq.Quantity) * stockPrice
-
-	var balance float64
-	var userId int
-	err = db.QueryRow("SELECT id, balance FROM users WHERE username = ?", username).Scan(&userId, &balance)
-	if err != nil {
-		http.Error(w, "Failed to get user data", http.StatusInternalServerError)
+	if tradeReq.OrderType == "" {
+		tradeReq.OrderType = "market"
+	}
+	if tradeReq.OrderType != "market" && !isValidOrderType(tradeReq.OrderType) {
+		http.Error(w, "Order type must be market, limit, stop or stop_limit", http.StatusBadRequest)
 		return
 	}
-
-	if tradeReq.TradeType == "buy" && balance < totalCost {
-		http.Error(w, "Insufficient balance", http.StatusBadRequest)
+	if err := validateOrderPrices(tradeReq.OrderType, tradeReq.LimitPrice, tradeReq.StopPrice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+	tradeReq.Symbol = normalizeSymbol(tradeReq.Symbol)
+	if _, err := resolveInstrument(tradeReq.Symbol); err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		fmt.Println("Error resolving instrument:", err)
+		http.Error(w, "Failed to execute trade", http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
 
-	var newBalance float64
-	if tradeReq.TradeType == "buy" {
-		newBalance = balance - totalCost
-	} else {
-		newBalance = balance + totalCost
+	userId, competition, ok := accountForRequest(w, r)
+	if !ok {
+		return
 	}
-
-	_, err = tx.Exec("UPDATE users SET balance = ? WHERE id = ?", newBalance, userId)
-	if err != nil {
-		http.Error(w, "Failed to update balance", http.StatusInternalServerError)
+	if competition != nil && !competition.isOpen(time.Now().UTC()) {
+		http.Error(w, "Competition is not open for trading", http.StatusConflict)
 		return
 	}
-
-	_, err = tx.Exec(`
-		INSERT INTO trades (user_id, symbol, quantity, price, trade_type)
-		VALUES (?, ?, ?, ?, ?)
-	`, userId, tradeReq.Symbol, tradeReq.Quantity, stockPrice, tradeReq.TradeType)
-	if err != nil {
-		http.Error(w, "Failed to record trade", http.StatusInternalServerError)
+	if competition != nil && !competition.allowsSymbol(tradeReq.Symbol) {
+		http.Error(w, "Symbol is not allowed in this competition", http.StatusBadRequest)
 		return
 	}
 
-	var currentQuantity int
-	err = tx.QueryRow("SELECT quantity FROM portfolio WHERE user_id = ? AND symbol = ?", userId, tradeReq.Symbol).Scan(&currentQuantity)
-	if err != nil && err != sql.ErrNoRows {
-		http.Error(w, "Failed to get current portfolio quantity", http.StatusInternalServerError)
+	if tradeReq.OrderType != "market" && len(tradeReq.Lots) > 0 {
+		http.Error(w, "Lots can only be chosen for market orders", http.StatusBadRequest)
 		return
 	}
 
-	var newQuantity int
-	if tradeReq.TradeType == "buy" {
-		newQuantity = currentQuantity + tradeReq.Quantity
-	} else {
-		newQuantity = currentQuantity - tradeReq.Quantity
+	// Market orders sent while the market is closed are turned away or, if
+	// the user asked for it, queued as open orders for the next session.
+	queued := false
+	if tradeReq.OrderType == "market" && !marketCalendar.IsOpen(time.Now()) {
+		queue, err := queuesClosedMarketOrders(userId)
+		if err != nil {
+			http.Error(w, "Failed to get account settings", http.StatusInternalServerError)
+			return
+		}
+		if !queue {
+			opensAt := marketCalendar.NextSession(time.Now()).OpensAt
+			http.Error(w, "Market is closed until "+opensAt.Format(time.RFC3339), http.StatusConflict)
+			return
+		}
+		if len(tradeReq.Lots) > 0 {
+			http.Error(w, "Lots can only be chosen while the market is open", http.StatusBadRequest)
+			return
+		}
+		queued = true
 	}
 
-	if newQuantity < 0 {
-		http.Error(w, "Insufficient shares to sell", http.StatusBadRequest)
-		return
-	}
+	if tradeReq.OrderType != "market" || queued {
+		order, err := placeOrder(userId, tradeReq.Symbol, tradeReq.Quantity, tradeReq.TradeType, tradeReq.OrderType,
+			tradeReq.LimitPrice, tradeReq.StopPrice, tradeReq.Rationale)
+		if err == ErrInsufficientBalance || err == ErrInsufficientShares {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err == ErrInstrumentHalted {
+			http.Error(w, "Trading in "+tradeReq.Symbol+" is halted", http.StatusConflict)
+			return
+		} else if err != nil {
+			fmt.Println("Error placing order:", err)
+			http.Error(w, "Failed to place order", http.StatusInternalServerError)
+			return
+		}
 
-	if newQuantity == 0 {
-		_, err = tx.Exec("DELETE FROM portfolio WHERE user_id = ? AND symbol = ?", userId, tradeReq.Symbol)
-	} else {
-		_, err = tx.Exec(`
-			INSERT OR REPLACE INTO portfolio (user_id, symbol, quantity, average_price)
-			VALUES (?, ?, ?, (SELECT COALESCE(
-				(SELECT (average_price * quantity + ? * ?) / (quantity + ?)
-				FROM portfolio WHERE user_id = ? AND symbol = ?),
-				?
-			)))
-		`, userId, tradeReq.Symbol, newQuantity, tradeReq.Quantity, stockPrice, tradeReq.Quantity, userId, tradeReq.Symbol, stockPrice)
-	}
+		publishOrder(order)
 
-	if err != nil {
-		http.Error(w, "Failed to update portfolio", http.StatusInternalServerError)
+		message := "Order placed"
+		if queued {
+			message = "Market is closed, order queued for the next open"
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": message,
+			"order":   order,
+		})
 		return
 	}
 
-	_, err = tx.Exec(`
-	INSERT INTO posts (user_id, symbol, quantity, trade_type, rationale, trade_date)
-	VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
-`, userId, tradeReq.Symbol, tradeReq.Quantity, tradeReq.TradeType, tradeReq.Rationale)
-
-	if err != nil {
-		http.Error(w, "Failed to create post for trade", http.StatusInternalServerError)
+	fill, err := executeMarketTrade(userId, tradeReq.Symbol, tradeReq.Quantity, tradeReq.TradeType, tradeReq.Rationale, tradeReq.Lots)
+	if err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusBadRequest)
+		return
+	} else if err == ErrInsufficientBalance {
+		http.Error(w, "Insufficient balance", http.StatusBadRequest)
+		return
+	} else if err == ErrInsufficientShares {
+		http.Error(w, "Insufficient shares to sell", http.StatusBadRequest)
+		return
+	} else if err == ErrInsufficientMargin {
+		http.Error(w, "Insufficient margin", http.StatusBadRequest)
+		return
+	} else if err == ErrInvalidLotSelection {
+		http.Error(w, "Invalid lot selection", http.StatusBadRequest)
+		return
+	} else if err == ErrInstrumentHalted {
+		http.Error(w, "Trading in "+tradeReq.Symbol+" is halted", http.StatusConflict)
+		return
+	} else if err == ErrAccountChanged {
+		http.Error(w, "Account is busy, please retry the trade", http.StatusConflict)
+		return
+	} else if err != nil {
+		fmt.Println("Error executing trade:", err)
+		http.Error(w, "Failed to execute trade", http.StatusInternalServerError)
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
-		return
+	publishFill(fill, 0)
+	notifyFill(fill, 0)
+
+	response := map[string]interface{}{
+		"message":        "Trade successful",
+		"new_balance":    fill.NewBalance,
+		"commission":     fill.Fees.Commission,
+		"regulatory_fee": fill.Fees.Regulatory,
+		"fees":           fill.Fees.Total(),
+	}
+	if fill.ClosedQuantity > 0 {
+		response["realized_pnl"] = fill.RealizedPnL
 	}
+	json.NewEncoder(w).Encode(response)
+}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":     "Trade successful",
-		"new_balance": newBalance,
-	})
+// GetPosts returns the latest 50 posts from everyone. GetFeed pages through
+// the rest.
+type TradeHistoryEntry struct {
+	Type          string `json:"type"`
+	Symbol        string `json:"symbol"`
+	Quantity      int    `json:"quantity"`
+	Price         *Money `json:"price,omitempty"`
+	Commission    *Money `json:"commission,omitempty"`
+	RegulatoryFee *Money `json:"regulatory_fee,omitempty"`
+	RealizedPnL   *Money `json:"realized_pnl,omitempty"`
+	// QuantityAfter and Cash are set on corporate action events.
+	QuantityAfter *int      `json:"quantity_after,omitempty"`
+	Cash          *Money    `json:"cash,omitempty"`
+	Description   string    `json:"description"`
+	Date          time.Time `json:"date"`
 }
 
-func GetPosts(w http.ResponseWriter, r *http.Request) {
-	userId := getUserIdFromSession(r)
+// GetTradeHistory lists the account's trades together with the dividends and
+// splits applied to its positions, newest first.
+func GetTradeHistory(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+	symbol := normalizeSymbol(r.URL.Query().Get("symbol"))
 
 	rows, err := db.Query(`
-		SELECT p.id, u.username, p.symbol, p.quantity, p.trade_type, p.rationale, p.trade_date,
-			   (SELECT COUNT(*) FROM posts_likes WHERE post_id = p.id) AS likes_count,
-			   CASE WHEN pl.user_id IS NOT NULL THEN 1 ELSE 0 END AS liked_by_user
-		FROM posts p
-		JOIN users u ON p.user_id = u.id
-		LEFT JOIN posts_likes pl ON p.id = pl.post_id AND pl.user_id = ?
-		ORDER BY p.trade_date DESC
-		LIMIT 50
-	`, userId)
+		SELECT * FROM (
+			SELECT trade_type, symbol, quantity, price, commission, regulatory_fee, realized_pnl,
+				NULL, NULL, 0, 0, 0, trade_date, id, 0
+			FROM trades WHERE user_id = ?
+			UNION ALL
+			SELECT a.action_type, e.symbol, e.quantity_before, NULL, NULL, NULL, NULL,
+				e.quantity_after, e.cash, COALESCE(a.amount, 0), COALESCE(a.split_to, 0), COALESCE(a.split_from, 0),
+				e.created_at, e.id, 1
+			FROM corporate_action_events e
+			JOIN corporate_actions a ON a.id = e.action_id
+			WHERE e.user_id = ?
+		)
+		WHERE ? = '' OR symbol = ?
+		ORDER BY 13 DESC, 15 DESC, 14 DESC
+		LIMIT 100
+	`, userId, userId, symbol, symbol)
 	if err != nil {
-		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		fmt.Println("Error querying trade history:", err)
+		http.Error(w, "Failed to fetch trade history", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var posts []map[string]interface{}
+	history := []TradeHistoryEntry{}
 	for rows.Next() {
-		var postId int
-		var username, symbol, tradeType, rationale string
-		var quantity, likesCount int
-		var likedByUser bool
-		var tradeDate time.Time
-		err := rows.Scan(&postId, &username, &symbol, &quantity, &tradeType, &rationale, &tradeDate, &likesCount, &likedByUser)
+		var e TradeHistoryEntry
+		var price, commission, regulatoryFee, realizedPnL, cash sql.NullInt64
+		var quantityAfter sql.NullInt64
+		var amount float64
+		var splitTo, splitFrom int
+		var date time.Time
+		var id, isEvent int
+		err := rows.Scan(&e.Type, &e.Symbol, &e.Quantity, &price, &commission, &regulatoryFee, &realizedPnL,
+			&quantityAfter, &cash, &amount, &splitTo, &splitFrom, &date, &id, &isEvent)
 		if err != nil {
-			http.Error(w, "Failed to scan post row", http.StatusInternalServerError)
+			fmt.Println("Error scanning trade history:", err)
+			http.Error(w, "Failed to scan trade history", http.StatusInternalServerError)
 			return
 		}
+		e.Price, e.Commission, e.RegulatoryFee, e.RealizedPnL = nullMoney(price), nullMoney(commission), nullMoney(regulatoryFee), nullMoney(realizedPnL)
+		e.Cash = nullMoney(cash)
+		if quantityAfter.Valid {
+			after := int(quantityAfter.Int64)
+			e.QuantityAfter = &after
+		}
+		e.Date = date
+
+		switch e.Type {
+		case "buy":
+			e.Description = fmt.Sprintf("Bought %d %s at $%s", e.Quantity, e.Symbol, e.Price)
+		case "sell":
+			e.Description = fmt.Sprintf("Sold %d %s at $%s", e.Quantity, e.Symbol, e.Price)
+		case "dividend":
+			e.Description = fmt.Sprintf("Dividend of $%s a share on %d %s: $%s",
+				strconv.FormatFloat(amount, 'f', -1, 64), e.Quantity, e.Symbol, e.Cash)
+		case "split":
+			kind := "split"
+			if splitTo < splitFrom {
+				e.Type, kind = "reverse_split", "reverse split"
+			}
+			e.Description = fmt.Sprintf("%d-for-%d %s of %s: %d shares became %d", splitTo, splitFrom, kind, e.Symbol, e.Quantity, *e.QuantityAfter)
+			if *e.Cash != 0 {
+				e.Description += fmt.Sprintf(", $%s cash in lieu", e.Cash)
+			}
+		}
 
-		posts = append(posts, map[string]interface{}{
-			"id":            postId,
-			"username":      username,
-			"symbol":        symbol,
-			"quantity":      quantity,
-			"trade_type":    tradeType,
-			"rationale":     rationale,
-			"trade_date":    tradeDate,
-			"likes":         likesCount,
-			"liked_by_user": likedByUser,
-		})
+		history = append(history, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func GetPosts(w http.ResponseWriter, r *http.Request) {
+	posts, err := queryPosts(getUserIdFromSession(r), feedQuery{Limit: 50})
+	if err != nil {
+		http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -663,70 +867,106 @@ func ToggleLike(w http.ResponseWriter, r *http.Request) {
 	postId := mux.Vars(r)["id"]
 	userId := getUserIdFromSession(r)
 
-	var liked bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts_likes WHERE user_id = ? AND post_id = ?)", userId, postId).Scan(&liked)
+	liked, likesCount, err := toggleLike("posts_likes", "post_id", postId, userId)
 	if err != nil {
-		http.Error(w, "Failed to check like status", http.StatusInternalServerError)
+		fmt.Println("Error toggling like:", err)
+		http.Error(w, "Failed to toggle like", http.StatusInternalServerError)
 		return
 	}
 
+	if liked {
+		notifyPostLiked(postId, userId)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"likes":         likesCount,
+		"liked_by_user": liked,
+	})
+}
+
+// toggleLike likes an item in a likes table such as posts_likes, or takes the
+// like back if the user already had one, and returns whether they like it now
+// and its new count.
+func toggleLike(table, column string, itemId interface{}, userId int) (bool, int, error) {
+	var liked bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE user_id = ? AND "+column+" = ?)", userId, itemId).Scan(&liked)
+	if err != nil {
+		return false, 0, fmt.Errorf("check like status: %w", err)
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
-		return
+		return false, 0, err
 	}
 	defer tx.Rollback()
 
 	if liked {
-		_, err = tx.Exec("DELETE FROM posts_likes WHERE user_id = ? AND post_id = ?", userId, postId)
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE user_id = ? AND "+column+" = ?", userId, itemId)
 	} else {
-		_, err = tx.Exec("INSERT INTO posts_likes (user_id, post_id) VALUES (?, ?)", userId, postId)
+		_, err = tx.Exec("INSERT INTO "+table+" (user_id, "+column+") VALUES (?, ?)", userId, itemId)
 	}
-
 	if err != nil {
-		http.Error(w, "Failed to toggle like", http.StatusInternalServerError)
-		return
+		return false, 0, err
 	}
 
 	var likesCount int
-	err = tx.QueryRow("SELECT COUNT(*) FROM posts_likes WHERE post_id = ?", postId).Scan(&likesCount)
+	err = tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+column+" = ?", itemId).Scan(&likesCount)
 	if err != nil {
-		http.Error(w, "Failed to get updated like count", http.StatusInternalServerError)
-		return
+		return false, 0, fmt.Errorf("count likes: %w", err)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
-		return
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"likes":         likesCount,
-		"liked_by_user": !liked,
-	})
+	return !liked, likesCount, nil
 }
 
 func GetPortfolioValue(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_token")
-	if err != nil {
-		fmt.Println("Error getting session cookie:", err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
 		return
 	}
-	username := cookie.Value
 
-	var userId int
-	var email string
-	var balance float64
-	err = db.QueryRow("SELECT id, email, balance FROM users WHERE username = ?", username).Scan(&userId, &email, &balance)
+	// A competition account reports its owner's username and email.
+	var username, email string
+	var balance Money
+	err := db.QueryRow(`
+		SELECT u.username, u.email, a.balance FROM users a
+		LEFT JOIN competition_entries ce ON ce.account_id = a.id
+		JOIN users u ON u.id = COALESCE(ce.user_id, a.id)
+		WHERE a.id = ?
+	`, userId).Scan(&username, &email, &balance)
 	if err != nil {
 		fmt.Println("Error querying user data:", err)
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
+	// Fees paid are all-time, per symbol, including symbols no longer held.
+	feesBySymbol := make(map[string]Money)
+	var totalFees Money
+	feeRows, err := db.Query(`
+		SELECT symbol, SUM(commission + regulatory_fee) FROM trades WHERE user_id = ? GROUP BY symbol
+	`, userId)
+	if err != nil {
+		fmt.Println("Error querying trade fees:", err)
+		http.Error(w, "Failed to fetch portfolio", http.StatusInternalServerError)
+		return
+	}
+	for feeRows.Next() {
+		var symbol string
+		var fees Money
+		if err := feeRows.Scan(&symbol, &fees); err != nil {
+			feeRows.Close()
+			http.Error(w, "Failed to scan trade fees", http.StatusInternalServerError)
+			return
+		}
+		feesBySymbol[symbol] = fees
+		totalFees += fees
+	}
+	feeRows.Close()
+
 	rows, err := db.Query(`
 		SELECT p.symbol, p.quantity, p.average_price, COALESCE(dsp.price, p.average_price) as current_price
 		FROM portfolio p
@@ -744,13 +984,13 @@ func GetPortfolioValue(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	var totalValue float64
+	var totalValue, longValue, shortValue Money
 	portfolio := make(map[string]map[string]interface{})
 
 	for rows.Next() {
 		var symbol string
 		var quantity int
-		var averagePrice, currentPrice float64
+		var averagePrice, currentPrice Money
 		err := rows.Scan(&symbol, &quantity, &averagePrice, &currentPrice)
 		if err != nil {
 			fmt.Println("Error scanning portfolio row:", err)
@@ -758,26 +998,66 @@ func GetPortfolioValue(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		marketValue := float64(quantity) * currentPrice
+		marketValue := currentPrice.Times(quantity)
 		totalValue += marketValue
+		if quantity < 0 {
+			shortValue -= marketValue
+		} else {
+			longValue += marketValue
+		}
 
 		portfolio[symbol] = map[string]interface{}{
 			"quantity":     quantity,
 			"averagePrice": averagePrice,
 			"currentPrice": currentPrice,
 			"marketValue":  marketValue,
-			"profitLoss":   marketValue - (float64(quantity) * averagePrice),
+			"profitLoss":   marketValue - averagePrice.Times(quantity),
+			"fees":         feesBySymbol[symbol],
 		}
 	}
 
 	totalValue += balance
 
+	var marginEnabled bool
+	var marginCallAt sql.NullTime
+	err = db.QueryRow("SELECT TRUE, margin_call_at FROM margin_accounts WHERE user_id = ?", userId).Scan(&marginEnabled, &marginCallAt)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println("Error querying margin account:", err)
+		http.Error(w, "Failed to fetch margin account", http.StatusInternalServerError)
+		return
+	}
+
+	buyingPower, err := availableBalance(db, userId)
+	if err != nil {
+		http.Error(w, "Failed to get available balance", http.StatusInternalServerError)
+		return
+	}
+
+	margin := marginState{Cash: balance, LongValue: longValue, ShortValue: shortValue}
+	var marginRequirement Money
+	var marginUsage float64
+	if marginEnabled {
+		buyingPower = margin.BuyingPower()
+		marginRequirement = margin.MaintenanceRequirement()
+		marginUsage = margin.Usage()
+	}
+
 	response := map[string]interface{}{
-		"username":   username,
-		"email":      email,
-		"balance":    balance,
-		"totalValue": totalValue,
-		"portfolio":  portfolio,
+		"username":          username,
+		"email":             email,
+		"balance":           balance,
+		"totalValue":        totalValue,
+		"portfolio":         portfolio,
+		"longMarketValue":   longValue,
+		"shortMarketValue":  shortValue,
+		"buyingPower":       buyingPower,
+		"marginEnabled":     marginEnabled,
+		"marginRequirement": marginRequirement,
+		"marginUsage":       marginUsage,
+		"totalFees":         totalFees,
+	}
+	if marginCallAt.Valid {
+		response["marginCallAt"] = marginCallAt.Time
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -789,144 +1069,69 @@ func GetPortfolioValue(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetHistoricalPrices(w http.ResponseWriter, r *http.Request) {
-	symbol := r.URL.Query().Get("symbol")
+	query := r.URL.Query()
+
+	symbol := normalizeSymbol(query.Get("symbol"))
 	if symbol == "" {
 		http.Error(w, "Symbol is required", http.StatusBadRequest)
 		return
 	}
 
-	days := 30
-	if daysParam := r.URL.Query().Get("days"); daysParam != "" {
-		if parsedDays, err := strconv.Atoi(daysParam); err == nil {
-			days = parsedDays
-		}
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "daily"
+	}
+	if interval != "daily" && interval != "weekly" && interval != "monthly" {
+		http.Error(w, "Interval must be daily, weekly or monthly", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseDateRange(query, 30)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	rows, err := db.Query(`
-		SELECT date, price
+		SELECT date, open, high, low, close, volume
 		FROM historical_prices
-		WHERE symbol = ?
-		AND date >= date('now', '-' || ? || ' days')
+		WHERE symbol = ? AND date >= ? AND date <= ?
 		ORDER BY date ASC
-	`, symbol, days)
+	`, symbol, from.Format(dateLayout), to.Format(dateLayout))
 	if err != nil {
 		http.Error(w, "Failed to fetch historical prices", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var prices []map[string]interface{}
+	bars := []Bar{}
 	for rows.Next() {
-		var date string
-		var price float64
-		if err := rows.Scan(&date, &price); err != nil {
+		var bar Bar
+		if err := rows.Scan(&bar.Date, &bar.Open, &bar.High, &bar.Low, &bar.Close, &bar.Volume); err != nil {
 			http.Error(w, "Failed to scan historical price row", http.StatusInternalServerError)
 			return
 		}
+		bars = append(bars, bar)
+	}
+
+	var prices []map[string]interface{}
+	for _, bar := range aggregateBars(bars, interval) {
 		prices = append(prices, map[string]interface{}{
-			"date":  date,
-			"price": price,
+			"date":   bar.Date.Format(dateLayout),
+			"open":   bar.Open,
+			"high":   bar.High,
+			"low":    bar.Low,
+			"close":  bar.Close,
+			"volume": bar.Volume,
 		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"symbol": symbol,
-		"prices": prices,
-	})
-}
-
-func GetLeaderboard(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`
-        SELECT u.id, u.username, u.balance
-        FROM users u
-        ORDER BY u.balance DESC
-        LIMIT 10
-    `)
-	if err != nil {
-		http.Error(w, "Failed to fetch leaderboard data", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var leaderboard []map[string]interface{}
-	for rows.Next() {
-		var userId int
-		var username string
-		var balance float64
-		err := rows.Scan(&userId, &username, &balance)
-		if err != nil {
-			http.Error(w, "Failed to scan leaderboard row", http.StatusInternalServerError)
-			return
-		}
-
-		portfolioValue, err := getPortfolioValue(userId)
-		if err != nil {
-			http.Error(w, "Failed to get portfolio value", http.StatusInternalServerError)
-			return
-		}
-
-		totalValue := balance + portfolioValue
-		gainLoss := (totalValue - 10000) / 100
-
-		leaderboard = append(leaderboard, map[string]interface{}{
-			"username":   username,
-			"totalValue": totalValue,
-			"gainLoss":   gainLoss,
-		})
-	}
-
-	sort.Slice(leaderboard, func(i, j int) bool {
-		return leaderboard[i]["totalValue"].(float64) > leaderboard[j]["totalValue"].(float64)
+		"symbol":   symbol,
+		"interval": interval,
+		"from":     from.Format(dateLayout),
+		"to":       to.Format(dateLayout),
+		"prices":   prices,
 	})
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(leaderboard)
-}
-
-// Helper function to calculate portfolio value
-func getPortfolioValue(userId int) (float64, error) {
-	/* OLD ONE
-		rows, err := db.Query(`
-	        SELECT p.quantity, COALESCE(dsp.price, p.average_price) as current_price
-	        FROM portfolio p
-	        LEFT JOIN (
-	            SELECT symbol, price
-	            FROM daily_stock_prices
-	            WHERE updated_at = (SELECT MAX(updated_at) FROM daily_stock_prices)
-	        ) dsp ON p.symbol = dsp.symbol
-	        WHERE p.user_id = ?
-	    `, userId)
-	*/
-	rows, err := db.Query(`
-    	SELECT p.quantity, COALESCE(dsp.price, p.average_price) as current_price
-    	FROM portfolio p
-    	LEFT JOIN (
-        	SELECT dsp.symbol, dsp.price
-        	FROM daily_stock_prices dsp
-        	INNER JOIN (
-            	SELECT symbol, MAX(updated_at) AS latest_update
-            	FROM daily_stock_prices
-            	GROUP BY symbol
-        	) latest_prices
-        	ON dsp.symbol = latest_prices.symbol AND dsp.updated_at = latest_prices.latest_update
-    	) dsp ON p.symbol = dsp.symbol
-    	WHERE p.user_id = ?
-	`, userId)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var totalValue float64
-	for rows.Next() {
-		var quantity int
-		var currentPrice float64
-		if err := rows.Scan(&quantity, &currentPrice); err != nil {
-			return 0, err
-		}
-		totalValue += float64(quantity) * currentPrice
-	}
-
-	return totalValue, nil
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupTestDB points the server at a fresh, fully migrated database in a
+// temporary directory, priced by the simulated provider and trading around
+// the clock.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	cfg = defaultConfig()
+	cfg.DatabasePath = filepath.Join(t.TempDir(), "test.db")
+	cfg.Quotes = QuoteProviderOptions{Provider: "simulated", SimulatedSeed: 1}
+	cfg.Market.Calendar = "always_open"
+	marginSettings = cfg.Margin
+
+	var err error
+	if marketCalendar, err = newTradingCalendar(cfg.Market); err != nil {
+		t.Fatal(err)
+	}
+	initDB()
+	initQuotes()
+	t.Cleanup(func() { db.Close() })
+}
+
+// createTestUser opens an account at the starting balance.
+func createTestUser(t *testing.T, username string) int {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO users (first_name, last_name, email, username, password, balance)
+		VALUES ('Test', 'User', ?, ?, '', 0)
+	`, username+"@example.com", username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	if err := openAccount(tx, int(id)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// tradeAt fills a trade at a fixed price, bypassing the quote provider.
+func tradeAt(t *testing.T, userId int, symbol string, quantity int, tradeType string, price Money) tradeFill {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	fill, err := executeTrade(tx, userId, symbol, quantity, tradeType, price, "", nil, true)
+	if err != nil {
+		t.Fatalf("%s %d %s at %s: %v", tradeType, quantity, symbol, price, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return fill
+}
+
+// createTestCompetition starts a competition running from startsAt to endsAt
+// and enters each of userIds, returning its id and their accounts in it.
+func createTestCompetition(t *testing.T, startsAt, endsAt time.Time, userIds ...int) (int, []int) {
+	t.Helper()
+
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	result, err := db.Exec(`
+		INSERT INTO competitions (name, created_by, starting_balance, starts_at, ends_at, invite_code)
+		VALUES ('Test', ?, ?, ?, ?, ?)
+	`, userIds[0], cfg.StartingBalance, startsAt.UTC(), endsAt.UTC(), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+
+	var accountIds []int
+	for _, userId := range userIds {
+		if _, err := joinCompetition(userId, code); err != nil {
+			t.Fatal(err)
+		}
+		_, accountId, err := competitionAccount(int(id), userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accountIds = append(accountIds, accountId)
+	}
+	return int(id), accountIds
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var ErrInsufficientMargin = errors.New("insufficient margin")
+var ErrMarginCallPending = errors.New("margin call pending")
+
+type MarginSettings struct {
+	InitialMargin     float64  `json:"initial_margin"`
+	MaintenanceMargin float64  `json:"maintenance_margin"`
+	BorrowRate        float64  `json:"borrow_rate"`
+	InterestRate      float64  `json:"interest_rate"`
+	CallGracePeriod   Duration `json:"call_grace_period"`
+}
+
+var marginSettings MarginSettings
+
+func (s MarginSettings) Validate() error {
+	if s.InitialMargin <= 0 || s.InitialMargin > 1 {
+		return fmt.Errorf("initial margin must be in (0, 1]")
+	}
+	if s.MaintenanceMargin <= 0 || s.MaintenanceMargin > s.InitialMargin {
+		return fmt.Errorf("maintenance margin must be in (0, initial margin]")
+	}
+	if s.BorrowRate < 0 || s.InterestRate < 0 {
+		return fmt.Errorf("borrow and interest rates must not be negative")
+	}
+	return nil
+}
+
+func isMarginAccount(q queryer, userId int) (bool, error) {
+	var enabled bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM margin_accounts WHERE user_id = ?)", userId).Scan(&enabled)
+	return enabled, err
+}
+
+type marginPosition struct {
+	Symbol   string
+	Quantity int
+	Price    Money
+}
+
+func (p marginPosition) MarketValue() Money {
+	return p.Price.Times(max(p.Quantity, -p.Quantity))
+}
+
+// marginState values an account the way the margin rules see it. Short
+// positions are negative portfolio quantities and their sale proceeds are in
+// Cash, so Equity is cash plus longs minus what it costs to buy the shorts back.
+type marginState struct {
+	Cash       Money
+	LongValue  Money
+	ShortValue Money
+	Positions  []marginPosition
+}
+
+func (m marginState) Equity() Money {
+	return m.Cash + m.LongValue - m.ShortValue
+}
+
+// Requirements and buying power scale by the margin ratios and round to the
+// nearest cent, halves away from zero.
+func (m marginState) InitialRequirement() Money {
+	return (m.LongValue + m.ShortValue).MulRate(marginSettings.InitialMargin)
+}
+
+func (m marginState) MaintenanceRequirement() Money {
+	return (m.LongValue + m.ShortValue).MulRate(marginSettings.MaintenanceMargin)
+}
+
+func (m marginState) BuyingPower() Money {
+	excess := m.Equity() - m.InitialRequirement()
+	if excess < 0 {
+		return 0
+	}
+	return excess.MulRate(1 / marginSettings.InitialMargin)
+}
+
+func (m marginState) Usage() float64 {
+	if m.Equity() <= 0 {
+		return 1
+	}
+	return m.InitialRequirement().Float64() / m.Equity().Float64()
+}
+
+// loadMarginState prices positions at the given quotes, falling back to the
+// latest daily price and then the average price like the portfolio report does.
+func loadMarginState(q queryer, userId int, prices map[string]Money) (marginState, error) {
+	var state marginState
+	if err := q.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&state.Cash); err != nil {
+		return state, err
+	}
+
+	rows, err := q.Query(`
+		SELECT p.symbol, p.quantity, COALESCE(dsp.price, p.average_price) AS current_price
+		FROM portfolio p
+		LEFT JOIN (
+			SELECT dsp.symbol, dsp.price
+			FROM daily_stock_prices dsp
+			INNER JOIN (
+				SELECT symbol, MAX(updated_at) AS latest_update
+				FROM daily_stock_prices
+				GROUP BY symbol
+			) latest_prices
+			ON dsp.symbol = latest_prices.symbol AND dsp.updated_at = latest_prices.latest_update
+		) dsp ON p.symbol = dsp.symbol
+		WHERE p.user_id = ?
+	`, userId)
+	if err != nil {
+		return state, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var position marginPosition
+		if err := rows.Scan(&position.Symbol, &position.Quantity, &position.Price); err != nil {
+			return state, err
+		}
+		if price, ok := prices[position.Symbol]; ok {
+			position.Price = price
+		}
+
+		if position.Quantity < 0 {
+			state.ShortValue += position.MarketValue()
+		} else {
+			state.LongValue += position.MarketValue()
+		}
+		state.Positions = append(state.Positions, position)
+	}
+
+	return state, rows.Err()
+}
+
+// checkInitialMargin fails with ErrInsufficientMargin when the account, with
+// positions priced at the given quotes where there are any, no longer covers
+// its initial margin requirement.
+func checkInitialMargin(tx *sql.Tx, userId int, prices map[string]Money) error {
+	state, err := loadMarginState(tx, userId, prices)
+	if err != nil {
+		return err
+	}
+	if state.Equity() < state.InitialRequirement() {
+		return ErrInsufficientMargin
+	}
+	return nil
+}
+
+func EnableMargin(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	_, err := db.Exec("INSERT OR IGNORE INTO margin_accounts (user_id) VALUES (?)", userId)
+	if err != nil {
+		http.Error(w, "Failed to enable margin", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":           "Margin enabled",
+		"initialMargin":     marginSettings.InitialMargin,
+		"maintenanceMargin": marginSettings.MaintenanceMargin,
+	})
+}
+
+func DisableMargin(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	var shorts int
+	var balance Money
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM portfolio WHERE user_id = ? AND quantity < 0), balance
+		FROM users WHERE id = ?
+	`, userId, userId).Scan(&shorts, &balance)
+	if err != nil {
+		http.Error(w, "Failed to get account data", http.StatusInternalServerError)
+		return
+	}
+
+	if shorts > 0 || balance < 0 {
+		http.Error(w, "Close short positions and repay margin debt before disabling margin", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM margin_accounts WHERE user_id = ?", userId); err != nil {
+		http.Error(w, "Failed to disable margin", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Margin disabled",
+	})
+}
+
+func marginAccountIds() ([]int, error) {
+	rows, err := db.Query("SELECT user_id FROM margin_accounts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIds []int
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+	return userIds, rows.Err()
+}
+
+// accrueBorrowFees charges one day of stock borrow fees on short market value
+// and one day of interest on any negative cash (margin debt).
+func accrueBorrowFees() {
+	userIds, err := marginAccountIds()
+	if err != nil {
+		fmt.Println("Error getting margin accounts:", err)
+		return
+	}
+
+	for _, userId := range userIds {
+		state, err := loadMarginState(db, userId, nil)
+		if err != nil {
+			fmt.Printf("Error valuing margin account %d: %v\n", userId, err)
+			continue
+		}
+
+		// Each fee is one day of its annual rate, rounded to the nearest cent,
+		// halves away from zero.
+		debit := max(0, -state.Cash)
+		borrowFee := state.ShortValue.MulRate(marginSettings.BorrowRate / 365)
+		interest := debit.MulRate(marginSettings.InterestRate / 365)
+		total := borrowFee + interest
+		if total <= 0 {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			fmt.Println("Error starting transaction:", err)
+			return
+		}
+
+		if borrowFee > 0 {
+			err = postCash(tx, userId, ledgerBorrowFee, accountFees, -borrowFee, 0,
+				fmt.Sprintf("Stock borrow fee on $%s short", state.ShortValue))
+		}
+		if err == nil && interest > 0 {
+			err = postCash(tx, userId, ledgerMarginInterest, accountFees, -interest, 0,
+				fmt.Sprintf("Margin interest on $%s debit", debit))
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO margin_fees (user_id, borrow_fee, interest, short_value, debit_balance)
+				VALUES (?, ?, ?, ?, ?)
+			`, userId, borrowFee, interest, state.ShortValue, debit)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			fmt.Printf("Error charging margin fees for user %d: %v\n", userId, err)
+			continue
+		}
+
+		fmt.Printf("Charged user %d $%s in margin fees\n", userId, total)
+	}
+}
+
+// checkMarginCalls issues a margin call when equity falls below maintenance and
+// force-liquidates if it is still short of maintenance after the grace period,
+// or immediately once equity is gone.
+func checkMarginCalls() {
+	userIds, err := marginAccountIds()
+	if err != nil {
+		fmt.Println("Error getting margin accounts:", err)
+		return
+	}
+
+	for _, userId := range userIds {
+		state, err := loadMarginState(db, userId, nil)
+		if err != nil {
+			fmt.Printf("Error valuing margin account %d: %v\n", userId, err)
+			continue
+		}
+
+		prices := make(map[string]Money)
+		for _, position := range state.Positions {
+			if price, err := fetchStockPrice(position.Symbol); err == nil {
+				prices[position.Symbol] = price
+			}
+		}
+		if state, err = loadMarginState(db, userId, prices); err != nil {
+			fmt.Printf("Error valuing margin account %d: %v\n", userId, err)
+			continue
+		}
+
+		var callAt sql.NullTime
+		err = db.QueryRow("SELECT margin_call_at FROM margin_accounts WHERE user_id = ?", userId).Scan(&callAt)
+		if err != nil {
+			fmt.Printf("Error reading margin call state for user %d: %v\n", userId, err)
+			continue
+		}
+
+		if state.Equity() >= state.MaintenanceRequirement() {
+			if callAt.Valid {
+				if _, err := db.Exec("UPDATE margin_accounts SET margin_call_at = NULL WHERE user_id = ?", userId); err != nil {
+					fmt.Printf("Error clearing margin call for user %d: %v\n", userId, err)
+					continue
+				}
+				fmt.Printf("Margin call for user %d cleared\n", userId)
+			}
+			continue
+		}
+
+		if !callAt.Valid {
+			if _, err := db.Exec("UPDATE margin_accounts SET margin_call_at = ? WHERE user_id = ?", time.Now().UTC(), userId); err != nil {
+				fmt.Printf("Error issuing margin call for user %d: %v\n", userId, err)
+				continue
+			}
+			fmt.Printf("Margin call for user %d: equity $%s below maintenance $%s\n",
+				userId, state.Equity(), state.MaintenanceRequirement())
+			if state.Equity() > 0 {
+				continue
+			}
+		} else if time.Since(callAt.Time) < marginSettings.CallGracePeriod.Duration && state.Equity() > 0 {
+			continue
+		}
+
+		if err := liquidateMarginAccount(userId, prices); err != nil {
+			fmt.Printf("Error liquidating margin account %d: %v\n", userId, err)
+		}
+	}
+}
+
+// liquidateMarginAccount closes the largest positions first until the account
+// is back above its initial requirement. Positions are read again under the
+// transaction's write lock, since the user may have traded since they were
+// priced; prices only supplies the quotes. Forced closes stay out of the
+// public feed, but the owner is notified of each.
+func liquidateMarginAccount(userId int, prices map[string]Money) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', status_reason = 'margin liquidation', reserved_cash = 0,
+			reserved_shares = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND status = 'open'
+	`, userId)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadMarginState(tx, userId, prices)
+	if err != nil {
+		return err
+	}
+	positions := state.Positions
+	sort.Slice(positions, func(i, j int) bool { return positions[i].MarketValue() > positions[j].MarketValue() })
+
+	var fills []tradeFill
+
+	for _, position := range positions {
+		current, err := loadMarginState(tx, userId, prices)
+		if err != nil {
+			return err
+		}
+		if current.Equity() >= current.InitialRequirement() && current.Equity() > 0 {
+			break
+		}
+
+		tradeType := "sell"
+		quantity := position.Quantity
+		if quantity < 0 {
+			tradeType = "buy"
+			quantity = -quantity
+		}
+
+		fill, err := executeTrade(tx, userId, position.Symbol, quantity, tradeType, position.Price, "Forced liquidation after margin call", nil, false)
+		if err != nil {
+			return fmt.Errorf("close %s: %w", position.Symbol, err)
+		}
+		fills = append(fills, fill)
+		fmt.Printf("Liquidated %s %d %s for user %d at $%s\n", tradeType, quantity, position.Symbol, userId, position.Price)
+	}
+
+	if _, err := tx.Exec("UPDATE margin_accounts SET margin_call_at = NULL WHERE user_id = ?", userId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, fill := range fills {
+		publishFill(fill, 0)
+		notifyFill(fill, 0)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLiquidateMarginAccount(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "margined")
+	if _, err := db.Exec("INSERT INTO margin_accounts (user_id, margin_call_at) VALUES (?, ?)", userId, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	// $19,000 of AAPL on $10,000 of equity, then 10 shares sold after the
+	// margin call went out: liquidation has to close the 180 still held, not
+	// the 190 there were.
+	tradeAt(t, userId, "AAPL", 190, "buy", 10000)
+	tradeAt(t, userId, "AAPL", 10, "sell", 10000)
+	var before Money
+	if err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := liquidateMarginAccount(userId, map[string]Money{"AAPL": 5000}); err != nil {
+		t.Fatal(err)
+	}
+
+	var held, openLots, posts, liquidations, notified int
+	var balance Money
+	var callCleared bool
+	err := db.QueryRow(`
+		SELECT (SELECT COALESCE(SUM(quantity), 0) FROM portfolio WHERE user_id = ?),
+			(SELECT COUNT(*) FROM lots WHERE user_id = ? AND remaining > 0),
+			(SELECT COUNT(*) FROM posts WHERE user_id = ?),
+			(SELECT COUNT(*) FROM trades WHERE user_id = ? AND trade_type = 'sell' AND quantity = 180 AND price = 5000),
+			(SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = 'order_filled' AND message = 'Sold 180 AAPL at $50.00'),
+			(SELECT balance FROM users WHERE id = ?),
+			(SELECT margin_call_at IS NULL FROM margin_accounts WHERE user_id = ?)
+	`, userId, userId, userId, userId, userId, userId, userId).Scan(&held, &openLots, &posts, &liquidations, &notified, &balance, &callCleared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if held != 0 || openLots != 0 {
+		t.Errorf("after liquidation: %d shares held in %d open lots, want none", held, openLots)
+	}
+	if liquidations != 1 {
+		t.Errorf("%d forced sales of 180 AAPL at $50, want 1", liquidations)
+	}
+	if want := before + 900000 - cfg.Fees.feesFor("sell", 180, 5000).Total(); balance != want {
+		t.Errorf("balance $%s, want $%s", balance, want)
+	}
+	if posts != 2 {
+		t.Errorf("%d posts, want only the user's own 2 trades", posts)
+	}
+	if notified != 1 {
+		t.Errorf("%d fill notifications for the forced sale, want 1", notified)
+	}
+	if !callCleared {
+		t.Error("margin call still open after liquidation")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migrations live in migrations/ as NNNN_name.up.sql and NNNN_name.down.sql
+// and are compiled into the binary. Never edit one that has shipped; add a new
+// version instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		contents, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down scripts", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func latestMigrationVersion(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+func applyMigration(db *sql.DB, m Migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script := m.Down
+	if up {
+		script = m.Up
+	}
+	if _, err := tx.Exec(script); err != nil {
+		direction := "down"
+		if up {
+			direction = "up"
+		}
+		return fmt.Errorf("migration %d_%s %s: %w", m.Version, m.Name, direction, err)
+	}
+
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().UTC())
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateTo moves the schema up or down until exactly the migrations with
+// versions <= target are applied.
+func migrateTo(db *sql.DB, migrations []Migration, target int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok && m.Version <= target {
+			if err := applyMigration(db, m, true); err != nil {
+				return err
+			}
+			fmt.Printf("Applied migration %04d_%s\n", m.Version, m.Name)
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; ok && m.Version > target {
+			if err := applyMigration(db, m, false); err != nil {
+				return err
+			}
+			fmt.Printf("Reverted migration %04d_%s\n", m.Version, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkSchemaVersion refuses databases migrated by a newer binary, since this
+// one can't know what those migrations changed.
+func checkSchemaVersion(db *sql.DB, migrations []Migration) error {
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if latest := latestMigrationVersion(migrations); current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, latest)
+	}
+	return nil
+}
+
+func migrateUsage() {
+	fmt.Fprintln(os.Stderr, `usage: TradEx migrate <command>
+
+commands:
+  status        show applied and pending migrations
+  up            apply all pending migrations
+  down [n]      revert the last n migrations (default 1)
+  to <version>  migrate up or down to exactly <version>`)
+}
+
+func runMigrateCommand(db *sql.DB, args []string) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		migrateUsage()
+		return fmt.Errorf("missing migrate command")
+	}
+
+	// Status is still useful against a newer schema; changing it is not.
+	if args[0] != "status" {
+		if err := checkSchemaVersion(db, migrations); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "status":
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		known := make(map[int]bool)
+		for _, m := range migrations {
+			known[m.Version] = true
+			if at, ok := applied[m.Version]; ok {
+				fmt.Printf("%04d_%-24s applied %s\n", m.Version, m.Name, at.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%04d_%-24s pending\n", m.Version, m.Name)
+			}
+		}
+		for version, at := range applied {
+			if !known[version] {
+				fmt.Printf("%04d_%-24s applied %s (unknown to this binary)\n", version, "?", at.Format(time.RFC3339))
+			}
+		}
+		return nil
+
+	case "up":
+		return migrateTo(db, migrations, latestMigrationVersion(migrations))
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("down takes a positive number of steps")
+			}
+		}
+
+		current, err := currentSchemaVersion(db)
+		if err != nil {
+			return err
+		}
+
+		target := 0
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if migrations[i].Version > current {
+				continue
+			}
+			if steps == 0 {
+				target = migrations[i].Version
+				break
+			}
+			steps--
+		}
+		return migrateTo(db, migrations, target)
+
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("to needs a version")
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if target > latestMigrationVersion(migrations) {
+			return fmt.Errorf("no migration with version %d", target)
+		}
+		return migrateTo(db, migrations, target)
+
+	default:
+		migrateUsage()
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
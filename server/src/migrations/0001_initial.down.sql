@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS daily_stock_prices;
+DROP TABLE IF EXISTS posts_likes;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS portfolio;
+DROP TABLE IF EXISTS trades;
+DROP TABLE IF EXISTS users;
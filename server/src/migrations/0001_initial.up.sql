@@ -0,0 +1,61 @@
+-- Baseline schema. IF NOT EXISTS lets databases created before migrations
+-- existed adopt this version without losing data.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	username TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	balance REAL NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS trades (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	symbol TEXT NOT NULL,
+	quantity INTEGER NOT NULL,
+	price REAL NOT NULL,
+	trade_type TEXT NOT NULL,
+	trade_date DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS portfolio (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	symbol TEXT NOT NULL,
+	quantity INTEGER NOT NULL,
+	average_price REAL NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	UNIQUE(user_id, symbol)
+);
+
+CREATE TABLE IF NOT EXISTS posts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	symbol TEXT NOT NULL,
+	quantity INTEGER NOT NULL,
+	trade_type TEXT NOT NULL,
+	rationale TEXT,
+	trade_date DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS posts_likes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	post_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (post_id) REFERENCES posts(id),
+	UNIQUE(user_id, post_id)
+);
+
+CREATE TABLE IF NOT EXISTS daily_stock_prices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	symbol TEXT NOT NULL,
+	price REAL NOT NULL,
+	updated_at DATETIME NOT NULL,
+	UNIQUE(symbol, updated_at)
+);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS orders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	symbol TEXT NOT NULL,
+	quantity INTEGER NOT NULL,
+	trade_type TEXT NOT NULL,
+	order_type TEXT NOT NULL,
+	limit_price REAL,
+	stop_price REAL,
+	triggered INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'open',
+	status_reason TEXT,
+	reserved_cash REAL NOT NULL DEFAULT 0,
+	reserved_shares INTEGER NOT NULL DEFAULT 0,
+	rationale TEXT,
+	fill_price REAL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	filled_at DATETIME,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_status ON orders(user_id, status);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
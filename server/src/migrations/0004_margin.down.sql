@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS margin_fees;
+DROP TABLE IF EXISTS margin_accounts;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS margin_accounts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER UNIQUE NOT NULL,
+	margin_call_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS margin_fees (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	borrow_fee REAL NOT NULL,
+	interest REAL NOT NULL,
+	short_value REAL NOT NULL,
+	debit_balance REAL NOT NULL,
+	accrued_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
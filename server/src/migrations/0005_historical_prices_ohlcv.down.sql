@@ -0,0 +1,13 @@
+CREATE TABLE historical_prices_legacy (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	symbol TEXT NOT NULL,
+	price REAL NOT NULL,
+	date DATE NOT NULL,
+	UNIQUE(symbol, date)
+);
+
+INSERT INTO historical_prices_legacy (symbol, price, date)
+SELECT symbol, close, date FROM historical_prices;
+
+DROP TABLE historical_prices;
+ALTER TABLE historical_prices_legacy RENAME TO historical_prices;
@@ -0,0 +1,29 @@
+-- Older databases may already have historical_prices with a single price
+-- column. Make sure it exists in that shape, then rebuild it as daily OHLCV
+-- bars, carrying any old prices over as flat bars.
+
+CREATE TABLE IF NOT EXISTS historical_prices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	symbol TEXT NOT NULL,
+	price REAL NOT NULL,
+	date DATE NOT NULL,
+	UNIQUE(symbol, date)
+);
+
+CREATE TABLE historical_prices_ohlcv (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	symbol TEXT NOT NULL,
+	date DATE NOT NULL,
+	open REAL NOT NULL,
+	high REAL NOT NULL,
+	low REAL NOT NULL,
+	close REAL NOT NULL,
+	volume INTEGER NOT NULL DEFAULT 0,
+	UNIQUE(symbol, date)
+);
+
+INSERT INTO historical_prices_ohlcv (symbol, date, open, high, low, close, volume)
+SELECT symbol, date, price, price, price, price, 0 FROM historical_prices;
+
+DROP TABLE historical_prices;
+ALTER TABLE historical_prices_ohlcv RENAME TO historical_prices;
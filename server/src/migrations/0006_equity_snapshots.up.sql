@@ -0,0 +1,15 @@
+-- One row per user per day. net_flow is cash added (positive) or removed
+-- (negative) from outside the account that day; returns are measured net of it.
+CREATE TABLE equity_snapshots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	date DATE NOT NULL,
+	cash REAL NOT NULL,
+	long_value REAL NOT NULL,
+	short_value REAL NOT NULL,
+	equity REAL NOT NULL,
+	net_flow REAL NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	UNIQUE(user_id, date)
+);
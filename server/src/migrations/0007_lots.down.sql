@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS lot_closures;
+DROP TABLE IF EXISTS lots;
+ALTER TABLE trades DROP COLUMN realized_pnl;
+ALTER TABLE users DROP COLUMN lot_method;
@@ -0,0 +1,45 @@
+-- Tax lots: buys open long lots and sells open short lots; trades in the
+-- other direction close them under the account's lot_method. Each closing
+-- trade records its realized P&L.
+
+ALTER TABLE users ADD COLUMN lot_method TEXT NOT NULL DEFAULT 'fifo';
+
+ALTER TABLE trades ADD COLUMN realized_pnl REAL;
+
+CREATE TABLE lots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	symbol TEXT NOT NULL,
+	side TEXT NOT NULL,
+	quantity INTEGER NOT NULL,
+	remaining INTEGER NOT NULL,
+	price REAL NOT NULL,
+	opened_trade_id INTEGER,
+	opened_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	closed_at DATETIME,
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (opened_trade_id) REFERENCES trades(id)
+);
+
+CREATE INDEX idx_lots_user_symbol_open ON lots(user_id, symbol, remaining);
+
+CREATE TABLE lot_closures (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	lot_id INTEGER NOT NULL,
+	trade_id INTEGER NOT NULL,
+	quantity INTEGER NOT NULL,
+	cost_basis REAL NOT NULL,
+	proceeds REAL NOT NULL,
+	realized_pnl REAL NOT NULL,
+	closed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (lot_id) REFERENCES lots(id),
+	FOREIGN KEY (trade_id) REFERENCES trades(id)
+);
+
+-- Positions opened before lots existed become one lot at their average price.
+INSERT INTO lots (user_id, symbol, side, quantity, remaining, price)
+SELECT user_id, symbol,
+	CASE WHEN quantity > 0 THEN 'long' ELSE 'short' END,
+	ABS(quantity), ABS(quantity), average_price
+FROM portfolio
+WHERE quantity != 0;
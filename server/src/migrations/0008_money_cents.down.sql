@@ -0,0 +1,98 @@
+-- Back to REAL dollars. Every cent value converts exactly.
+
+ALTER TABLE users ADD COLUMN balance_new REAL NOT NULL DEFAULT 0;
+UPDATE users SET balance_new = balance / 100.0;
+ALTER TABLE users DROP COLUMN balance;
+ALTER TABLE users RENAME COLUMN balance_new TO balance;
+
+ALTER TABLE trades ADD COLUMN price_new REAL NOT NULL DEFAULT 0;
+UPDATE trades SET price_new = price / 100.0;
+ALTER TABLE trades DROP COLUMN price;
+ALTER TABLE trades RENAME COLUMN price_new TO price;
+ALTER TABLE trades ADD COLUMN realized_pnl_new REAL;
+UPDATE trades SET realized_pnl_new = realized_pnl / 100.0;
+ALTER TABLE trades DROP COLUMN realized_pnl;
+ALTER TABLE trades RENAME COLUMN realized_pnl_new TO realized_pnl;
+
+ALTER TABLE portfolio ADD COLUMN average_price_new REAL NOT NULL DEFAULT 0;
+UPDATE portfolio SET average_price_new = average_price / 100.0;
+ALTER TABLE portfolio DROP COLUMN average_price;
+ALTER TABLE portfolio RENAME COLUMN average_price_new TO average_price;
+
+ALTER TABLE orders ADD COLUMN limit_price_new REAL;
+UPDATE orders SET limit_price_new = limit_price / 100.0;
+ALTER TABLE orders DROP COLUMN limit_price;
+ALTER TABLE orders RENAME COLUMN limit_price_new TO limit_price;
+ALTER TABLE orders ADD COLUMN stop_price_new REAL;
+UPDATE orders SET stop_price_new = stop_price / 100.0;
+ALTER TABLE orders DROP COLUMN stop_price;
+ALTER TABLE orders RENAME COLUMN stop_price_new TO stop_price;
+ALTER TABLE orders ADD COLUMN reserved_cash_new REAL NOT NULL DEFAULT 0;
+UPDATE orders SET reserved_cash_new = reserved_cash / 100.0;
+ALTER TABLE orders DROP COLUMN reserved_cash;
+ALTER TABLE orders RENAME COLUMN reserved_cash_new TO reserved_cash;
+ALTER TABLE orders ADD COLUMN fill_price_new REAL;
+UPDATE orders SET fill_price_new = fill_price / 100.0;
+ALTER TABLE orders DROP COLUMN fill_price;
+ALTER TABLE orders RENAME COLUMN fill_price_new TO fill_price;
+
+ALTER TABLE margin_fees ADD COLUMN borrow_fee_new REAL NOT NULL DEFAULT 0;
+UPDATE margin_fees SET borrow_fee_new = borrow_fee / 100.0;
+ALTER TABLE margin_fees DROP COLUMN borrow_fee;
+ALTER TABLE margin_fees RENAME COLUMN borrow_fee_new TO borrow_fee;
+ALTER TABLE margin_fees ADD COLUMN interest_new REAL NOT NULL DEFAULT 0;
+UPDATE margin_fees SET interest_new = interest / 100.0;
+ALTER TABLE margin_fees DROP COLUMN interest;
+ALTER TABLE margin_fees RENAME COLUMN interest_new TO interest;
+ALTER TABLE margin_fees ADD COLUMN short_value_new REAL NOT NULL DEFAULT 0;
+UPDATE margin_fees SET short_value_new = short_value / 100.0;
+ALTER TABLE margin_fees DROP COLUMN short_value;
+ALTER TABLE margin_fees RENAME COLUMN short_value_new TO short_value;
+ALTER TABLE margin_fees ADD COLUMN debit_balance_new REAL NOT NULL DEFAULT 0;
+UPDATE margin_fees SET debit_balance_new = debit_balance / 100.0;
+ALTER TABLE margin_fees DROP COLUMN debit_balance;
+ALTER TABLE margin_fees RENAME COLUMN debit_balance_new TO debit_balance;
+
+ALTER TABLE lots ADD COLUMN price_new REAL NOT NULL DEFAULT 0;
+UPDATE lots SET price_new = price / 100.0;
+ALTER TABLE lots DROP COLUMN price;
+ALTER TABLE lots RENAME COLUMN price_new TO price;
+
+ALTER TABLE lot_closures ADD COLUMN cost_basis_new REAL NOT NULL DEFAULT 0;
+UPDATE lot_closures SET cost_basis_new = cost_basis / 100.0;
+ALTER TABLE lot_closures DROP COLUMN cost_basis;
+ALTER TABLE lot_closures RENAME COLUMN cost_basis_new TO cost_basis;
+ALTER TABLE lot_closures ADD COLUMN proceeds_new REAL NOT NULL DEFAULT 0;
+UPDATE lot_closures SET proceeds_new = proceeds / 100.0;
+ALTER TABLE lot_closures DROP COLUMN proceeds;
+ALTER TABLE lot_closures RENAME COLUMN proceeds_new TO proceeds;
+ALTER TABLE lot_closures ADD COLUMN realized_pnl_new REAL NOT NULL DEFAULT 0;
+UPDATE lot_closures SET realized_pnl_new = realized_pnl / 100.0;
+ALTER TABLE lot_closures DROP COLUMN realized_pnl;
+ALTER TABLE lot_closures RENAME COLUMN realized_pnl_new TO realized_pnl;
+
+ALTER TABLE equity_snapshots ADD COLUMN cash_new REAL NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET cash_new = cash / 100.0;
+ALTER TABLE equity_snapshots DROP COLUMN cash;
+ALTER TABLE equity_snapshots RENAME COLUMN cash_new TO cash;
+ALTER TABLE equity_snapshots ADD COLUMN long_value_new REAL NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET long_value_new = long_value / 100.0;
+ALTER TABLE equity_snapshots DROP COLUMN long_value;
+ALTER TABLE equity_snapshots RENAME COLUMN long_value_new TO long_value;
+ALTER TABLE equity_snapshots ADD COLUMN short_value_new REAL NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET short_value_new = short_value / 100.0;
+ALTER TABLE equity_snapshots DROP COLUMN short_value;
+ALTER TABLE equity_snapshots RENAME COLUMN short_value_new TO short_value;
+ALTER TABLE equity_snapshots ADD COLUMN equity_new REAL NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET equity_new = equity / 100.0;
+ALTER TABLE equity_snapshots DROP COLUMN equity;
+ALTER TABLE equity_snapshots RENAME COLUMN equity_new TO equity;
+ALTER TABLE equity_snapshots ADD COLUMN net_flow_new REAL NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET net_flow_new = net_flow / 100.0;
+ALTER TABLE equity_snapshots DROP COLUMN net_flow;
+ALTER TABLE equity_snapshots RENAME COLUMN net_flow_new TO net_flow;
+
+ALTER TABLE daily_stock_prices ADD COLUMN price_new REAL NOT NULL DEFAULT 0;
+UPDATE daily_stock_prices SET price_new = price / 100.0;
+ALTER TABLE daily_stock_prices DROP COLUMN price;
+ALTER TABLE daily_stock_prices RENAME COLUMN price_new TO price;
@@ -0,0 +1,101 @@
+-- Money moves from REAL dollars to INTEGER cents. Each column is rebuilt in
+-- place: add an INTEGER column, convert, drop the old one and take its name.
+-- Existing amounts round to the nearest cent, halves away from zero, which is
+-- what SQLite's ROUND does. Market data in historical_prices stays REAL.
+
+ALTER TABLE users ADD COLUMN balance_new INTEGER NOT NULL DEFAULT 0;
+UPDATE users SET balance_new = CAST(ROUND(balance * 100) AS INTEGER);
+ALTER TABLE users DROP COLUMN balance;
+ALTER TABLE users RENAME COLUMN balance_new TO balance;
+
+ALTER TABLE trades ADD COLUMN price_new INTEGER NOT NULL DEFAULT 0;
+UPDATE trades SET price_new = CAST(ROUND(price * 100) AS INTEGER);
+ALTER TABLE trades DROP COLUMN price;
+ALTER TABLE trades RENAME COLUMN price_new TO price;
+ALTER TABLE trades ADD COLUMN realized_pnl_new INTEGER;
+UPDATE trades SET realized_pnl_new = CAST(ROUND(realized_pnl * 100) AS INTEGER);
+ALTER TABLE trades DROP COLUMN realized_pnl;
+ALTER TABLE trades RENAME COLUMN realized_pnl_new TO realized_pnl;
+
+ALTER TABLE portfolio ADD COLUMN average_price_new INTEGER NOT NULL DEFAULT 0;
+UPDATE portfolio SET average_price_new = CAST(ROUND(average_price * 100) AS INTEGER);
+ALTER TABLE portfolio DROP COLUMN average_price;
+ALTER TABLE portfolio RENAME COLUMN average_price_new TO average_price;
+
+ALTER TABLE orders ADD COLUMN limit_price_new INTEGER;
+UPDATE orders SET limit_price_new = CAST(ROUND(limit_price * 100) AS INTEGER);
+ALTER TABLE orders DROP COLUMN limit_price;
+ALTER TABLE orders RENAME COLUMN limit_price_new TO limit_price;
+ALTER TABLE orders ADD COLUMN stop_price_new INTEGER;
+UPDATE orders SET stop_price_new = CAST(ROUND(stop_price * 100) AS INTEGER);
+ALTER TABLE orders DROP COLUMN stop_price;
+ALTER TABLE orders RENAME COLUMN stop_price_new TO stop_price;
+ALTER TABLE orders ADD COLUMN reserved_cash_new INTEGER NOT NULL DEFAULT 0;
+UPDATE orders SET reserved_cash_new = CAST(ROUND(reserved_cash * 100) AS INTEGER);
+ALTER TABLE orders DROP COLUMN reserved_cash;
+ALTER TABLE orders RENAME COLUMN reserved_cash_new TO reserved_cash;
+ALTER TABLE orders ADD COLUMN fill_price_new INTEGER;
+UPDATE orders SET fill_price_new = CAST(ROUND(fill_price * 100) AS INTEGER);
+ALTER TABLE orders DROP COLUMN fill_price;
+ALTER TABLE orders RENAME COLUMN fill_price_new TO fill_price;
+
+ALTER TABLE margin_fees ADD COLUMN borrow_fee_new INTEGER NOT NULL DEFAULT 0;
+UPDATE margin_fees SET borrow_fee_new = CAST(ROUND(borrow_fee * 100) AS INTEGER);
+ALTER TABLE margin_fees DROP COLUMN borrow_fee;
+ALTER TABLE margin_fees RENAME COLUMN borrow_fee_new TO borrow_fee;
+ALTER TABLE margin_fees ADD COLUMN interest_new INTEGER NOT NULL DEFAULT 0;
+UPDATE margin_fees SET interest_new = CAST(ROUND(interest * 100) AS INTEGER);
+ALTER TABLE margin_fees DROP COLUMN interest;
+ALTER TABLE margin_fees RENAME COLUMN interest_new TO interest;
+ALTER TABLE margin_fees ADD COLUMN short_value_new INTEGER NOT NULL DEFAULT 0;
+UPDATE margin_fees SET short_value_new = CAST(ROUND(short_value * 100) AS INTEGER);
+ALTER TABLE margin_fees DROP COLUMN short_value;
+ALTER TABLE margin_fees RENAME COLUMN short_value_new TO short_value;
+ALTER TABLE margin_fees ADD COLUMN debit_balance_new INTEGER NOT NULL DEFAULT 0;
+UPDATE margin_fees SET debit_balance_new = CAST(ROUND(debit_balance * 100) AS INTEGER);
+ALTER TABLE margin_fees DROP COLUMN debit_balance;
+ALTER TABLE margin_fees RENAME COLUMN debit_balance_new TO debit_balance;
+
+ALTER TABLE lots ADD COLUMN price_new INTEGER NOT NULL DEFAULT 0;
+UPDATE lots SET price_new = CAST(ROUND(price * 100) AS INTEGER);
+ALTER TABLE lots DROP COLUMN price;
+ALTER TABLE lots RENAME COLUMN price_new TO price;
+
+ALTER TABLE lot_closures ADD COLUMN cost_basis_new INTEGER NOT NULL DEFAULT 0;
+UPDATE lot_closures SET cost_basis_new = CAST(ROUND(cost_basis * 100) AS INTEGER);
+ALTER TABLE lot_closures DROP COLUMN cost_basis;
+ALTER TABLE lot_closures RENAME COLUMN cost_basis_new TO cost_basis;
+ALTER TABLE lot_closures ADD COLUMN proceeds_new INTEGER NOT NULL DEFAULT 0;
+UPDATE lot_closures SET proceeds_new = CAST(ROUND(proceeds * 100) AS INTEGER);
+ALTER TABLE lot_closures DROP COLUMN proceeds;
+ALTER TABLE lot_closures RENAME COLUMN proceeds_new TO proceeds;
+ALTER TABLE lot_closures ADD COLUMN realized_pnl_new INTEGER NOT NULL DEFAULT 0;
+UPDATE lot_closures SET realized_pnl_new = CAST(ROUND(realized_pnl * 100) AS INTEGER);
+ALTER TABLE lot_closures DROP COLUMN realized_pnl;
+ALTER TABLE lot_closures RENAME COLUMN realized_pnl_new TO realized_pnl;
+
+ALTER TABLE equity_snapshots ADD COLUMN cash_new INTEGER NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET cash_new = CAST(ROUND(cash * 100) AS INTEGER);
+ALTER TABLE equity_snapshots DROP COLUMN cash;
+ALTER TABLE equity_snapshots RENAME COLUMN cash_new TO cash;
+ALTER TABLE equity_snapshots ADD COLUMN long_value_new INTEGER NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET long_value_new = CAST(ROUND(long_value * 100) AS INTEGER);
+ALTER TABLE equity_snapshots DROP COLUMN long_value;
+ALTER TABLE equity_snapshots RENAME COLUMN long_value_new TO long_value;
+ALTER TABLE equity_snapshots ADD COLUMN short_value_new INTEGER NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET short_value_new = CAST(ROUND(short_value * 100) AS INTEGER);
+ALTER TABLE equity_snapshots DROP COLUMN short_value;
+ALTER TABLE equity_snapshots RENAME COLUMN short_value_new TO short_value;
+ALTER TABLE equity_snapshots ADD COLUMN equity_new INTEGER NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET equity_new = CAST(ROUND(equity * 100) AS INTEGER);
+ALTER TABLE equity_snapshots DROP COLUMN equity;
+ALTER TABLE equity_snapshots RENAME COLUMN equity_new TO equity;
+ALTER TABLE equity_snapshots ADD COLUMN net_flow_new INTEGER NOT NULL DEFAULT 0;
+UPDATE equity_snapshots SET net_flow_new = CAST(ROUND(net_flow * 100) AS INTEGER);
+ALTER TABLE equity_snapshots DROP COLUMN net_flow;
+ALTER TABLE equity_snapshots RENAME COLUMN net_flow_new TO net_flow;
+
+ALTER TABLE daily_stock_prices ADD COLUMN price_new INTEGER NOT NULL DEFAULT 0;
+UPDATE daily_stock_prices SET price_new = CAST(ROUND(price * 100) AS INTEGER);
+ALTER TABLE daily_stock_prices DROP COLUMN price;
+ALTER TABLE daily_stock_prices RENAME COLUMN price_new TO price;
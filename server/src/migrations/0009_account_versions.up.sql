@@ -0,0 +1,4 @@
+-- Every write that spends or moves an account's cash or shares bumps its
+-- version, so a trade can check nothing changed between pricing and filling.
+
+ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,42 @@
+-- Double-entry cash ledger. Every change to a user's cash is a transaction of
+-- entries that sum to zero: one on the user's cash account and the rest on
+-- the house accounts it came from or went to (market, fees, capital).
+-- users.balance is kept as a running total of the cash entries.
+
+CREATE TABLE ledger_transactions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	trade_id INTEGER,
+	memo TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (trade_id) REFERENCES trades(id)
+);
+
+CREATE INDEX idx_ledger_transactions_user ON ledger_transactions(user_id, created_at);
+
+CREATE TABLE ledger_entries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	transaction_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	account TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	FOREIGN KEY (transaction_id) REFERENCES ledger_transactions(id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX idx_ledger_entries_transaction ON ledger_entries(transaction_id);
+CREATE INDEX idx_ledger_entries_user_account ON ledger_entries(user_id, account);
+
+-- Existing balances are carried forward as each user's opening balance.
+INSERT INTO ledger_transactions (user_id, kind, memo)
+SELECT id, 'opening_balance', 'Balance carried forward' FROM users ORDER BY id;
+
+INSERT INTO ledger_entries (transaction_id, user_id, account, amount)
+SELECT lt.id, u.id, 'cash', u.balance
+FROM ledger_transactions lt JOIN users u ON u.id = lt.user_id;
+
+INSERT INTO ledger_entries (transaction_id, user_id, account, amount)
+SELECT lt.id, u.id, 'capital', -u.balance
+FROM ledger_transactions lt JOIN users u ON u.id = lt.user_id;
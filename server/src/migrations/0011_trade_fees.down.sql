@@ -0,0 +1,2 @@
+ALTER TABLE trades DROP COLUMN regulatory_fee;
+ALTER TABLE trades DROP COLUMN commission;
@@ -0,0 +1,5 @@
+-- Fees charged on each trade under the fee schedule, in cents. Trades from
+-- before fees existed were free.
+
+ALTER TABLE trades ADD COLUMN commission INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE trades ADD COLUMN regulatory_fee INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,18 @@
+-- Responses to POSTs sent with an Idempotency-Key, so a retry replays the
+-- original result instead of running the request again. scope is the route
+-- and user the key belongs to; status_code is NULL while the first request
+-- is still running.
+CREATE TABLE idempotency_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	scope TEXT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	status_code INTEGER,
+	content_type TEXT NOT NULL DEFAULT '',
+	response_body BLOB,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL,
+	UNIQUE(scope, key)
+);
+
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
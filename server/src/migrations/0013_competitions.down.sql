@@ -0,0 +1,5 @@
+-- Competition accounts are left in users; with no password they still can't
+-- log in.
+DROP TABLE IF EXISTS competition_entries;
+DROP TABLE IF EXISTS competition_symbols;
+DROP TABLE IF EXISTS competitions;
@@ -0,0 +1,36 @@
+-- Time-boxed trading competitions. Each participant trades a separate account
+-- inside the competition: a users row of its own, which can't log in and is
+-- linked back to its owner by competition_entries, so trades, lots, orders and
+-- the ledger work on it exactly as on a main account.
+CREATE TABLE competitions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	created_by INTEGER NOT NULL REFERENCES users(id),
+	starting_balance INTEGER NOT NULL,
+	starts_at DATETIME NOT NULL,
+	ends_at DATETIME NOT NULL,
+	invite_code TEXT NOT NULL UNIQUE,
+	finalized_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A competition with no rows here allows every symbol.
+CREATE TABLE competition_symbols (
+	competition_id INTEGER NOT NULL REFERENCES competitions(id),
+	symbol TEXT NOT NULL,
+	PRIMARY KEY (competition_id, symbol)
+);
+
+-- final_rank and final_equity are frozen when the competition is finalized.
+CREATE TABLE competition_entries (
+	competition_id INTEGER NOT NULL REFERENCES competitions(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	account_id INTEGER NOT NULL UNIQUE REFERENCES users(id),
+	joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	final_rank INTEGER,
+	final_equity INTEGER,
+	PRIMARY KEY (competition_id, user_id)
+);
+
+CREATE INDEX idx_competition_entries_user_id ON competition_entries(user_id);
+CREATE INDEX idx_competitions_ends_at ON competitions(ends_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS corporate_action_events;
+DROP TABLE IF EXISTS corporate_actions;
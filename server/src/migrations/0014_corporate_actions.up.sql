@@ -0,0 +1,36 @@
+-- Dividends and splits, fed from the quote provider or imported from CSV.
+-- Dividends pay amount dollars a share to whoever holds the symbol at the end
+-- of record_date. Splits turn every split_from shares into split_to on
+-- ex_date, so a 1-for-10 reverse split is split_to 1, split_from 10.
+CREATE TABLE corporate_actions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	symbol TEXT NOT NULL,
+	action_type TEXT NOT NULL CHECK (action_type IN ('dividend', 'split')),
+	ex_date DATE NOT NULL,
+	record_date DATE,
+	pay_date DATE,
+	amount REAL,
+	split_to INTEGER,
+	split_from INTEGER,
+	source TEXT NOT NULL,
+	processed_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(symbol, action_type, ex_date)
+);
+
+-- What each action did to each account holding the symbol: the position
+-- before and after, and the cash paid (dividends and cash in lieu of
+-- fractional shares) or charged (dividends owed on shorts).
+CREATE TABLE corporate_action_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	action_id INTEGER NOT NULL REFERENCES corporate_actions(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	symbol TEXT NOT NULL,
+	quantity_before INTEGER NOT NULL,
+	quantity_after INTEGER NOT NULL,
+	cash INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_corporate_action_events_user_id ON corporate_action_events(user_id, created_at);
+CREATE INDEX idx_corporate_actions_pending ON corporate_actions(processed_at, ex_date);
@@ -0,0 +1,2 @@
+-- Folding symbols to upper case isn't undone; the old spellings are gone.
+DROP TABLE instruments;
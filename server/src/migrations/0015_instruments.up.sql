@@ -0,0 +1,106 @@
+-- The symbol master. Trades, orders and quotes only accept symbols listed
+-- here; tradable = 0 halts an instrument without delisting it.
+CREATE TABLE instruments (
+	symbol TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	exchange TEXT NOT NULL DEFAULT '',
+	asset_type TEXT NOT NULL DEFAULT 'equity',
+	currency TEXT NOT NULL DEFAULT 'USD',
+	tradable INTEGER NOT NULL DEFAULT 1,
+	halt_reason TEXT,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_instruments_name ON instruments(name COLLATE NOCASE);
+
+INSERT INTO instruments (symbol, name, exchange, asset_type) VALUES
+	('AAPL', 'Apple Inc.', 'NASDAQ', 'equity'),
+	('MSFT', 'Microsoft Corporation', 'NASDAQ', 'equity'),
+	('GOOGL', 'Alphabet Inc. Class A', 'NASDAQ', 'equity'),
+	('GOOG', 'Alphabet Inc. Class C', 'NASDAQ', 'equity'),
+	('AMZN', 'Amazon.com, Inc.', 'NASDAQ', 'equity'),
+	('META', 'Meta Platforms, Inc.', 'NASDAQ', 'equity'),
+	('NVDA', 'NVIDIA Corporation', 'NASDAQ', 'equity'),
+	('TSLA', 'Tesla, Inc.', 'NASDAQ', 'equity'),
+	('NFLX', 'Netflix, Inc.', 'NASDAQ', 'equity'),
+	('AMD', 'Advanced Micro Devices, Inc.', 'NASDAQ', 'equity'),
+	('INTC', 'Intel Corporation', 'NASDAQ', 'equity'),
+	('ADBE', 'Adobe Inc.', 'NASDAQ', 'equity'),
+	('CSCO', 'Cisco Systems, Inc.', 'NASDAQ', 'equity'),
+	('PEP', 'PepsiCo, Inc.', 'NASDAQ', 'equity'),
+	('COST', 'Costco Wholesale Corporation', 'NASDAQ', 'equity'),
+	('AVGO', 'Broadcom Inc.', 'NASDAQ', 'equity'),
+	('QCOM', 'QUALCOMM Incorporated', 'NASDAQ', 'equity'),
+	('PYPL', 'PayPal Holdings, Inc.', 'NASDAQ', 'equity'),
+	('SBUX', 'Starbucks Corporation', 'NASDAQ', 'equity'),
+	('BRK.B', 'Berkshire Hathaway Inc. Class B', 'NYSE', 'equity'),
+	('JPM', 'JPMorgan Chase & Co.', 'NYSE', 'equity'),
+	('V', 'Visa Inc.', 'NYSE', 'equity'),
+	('MA', 'Mastercard Incorporated', 'NYSE', 'equity'),
+	('JNJ', 'Johnson & Johnson', 'NYSE', 'equity'),
+	('PG', 'The Procter & Gamble Company', 'NYSE', 'equity'),
+	('KO', 'The Coca-Cola Company', 'NYSE', 'equity'),
+	('DIS', 'The Walt Disney Company', 'NYSE', 'equity'),
+	('XOM', 'Exxon Mobil Corporation', 'NYSE', 'equity'),
+	('CVX', 'Chevron Corporation', 'NYSE', 'equity'),
+	('BAC', 'Bank of America Corporation', 'NYSE', 'equity'),
+	('HD', 'The Home Depot, Inc.', 'NYSE', 'equity'),
+	('PFE', 'Pfizer Inc.', 'NYSE', 'equity'),
+	('NKE', 'NIKE, Inc.', 'NYSE', 'equity'),
+	('IBM', 'International Business Machines Corporation', 'NYSE', 'equity'),
+	('ORCL', 'Oracle Corporation', 'NYSE', 'equity'),
+	('CRM', 'Salesforce, Inc.', 'NYSE', 'equity'),
+	('UBER', 'Uber Technologies, Inc.', 'NYSE', 'equity'),
+	('BA', 'The Boeing Company', 'NYSE', 'equity'),
+	('F', 'Ford Motor Company', 'NYSE', 'equity'),
+	('GM', 'General Motors Company', 'NYSE', 'equity'),
+	('SPY', 'SPDR S&P 500 ETF Trust', 'NYSE Arca', 'etf'),
+	('QQQ', 'Invesco QQQ Trust', 'NASDAQ', 'etf'),
+	('DIA', 'SPDR Dow Jones Industrial Average ETF Trust', 'NYSE Arca', 'etf'),
+	('IWM', 'iShares Russell 2000 ETF', 'NYSE Arca', 'etf'),
+	('VOO', 'Vanguard S&P 500 ETF', 'NYSE Arca', 'etf'),
+	('VTI', 'Vanguard Total Stock Market ETF', 'NYSE Arca', 'etf');
+
+-- Symbols used to be stored however they were typed, so "aapl" and "AAPL"
+-- could be separate positions. Fold everything to upper case, keeping one
+-- price per symbol and day and merging positions that only differed in case.
+UPDATE trades SET symbol = UPPER(TRIM(symbol));
+UPDATE posts SET symbol = UPPER(TRIM(symbol));
+UPDATE orders SET symbol = UPPER(TRIM(symbol));
+UPDATE lots SET symbol = UPPER(TRIM(symbol));
+UPDATE corporate_action_events SET symbol = UPPER(TRIM(symbol));
+
+DELETE FROM historical_prices WHERE rowid NOT IN (
+	SELECT MAX(rowid) FROM historical_prices GROUP BY UPPER(TRIM(symbol)), date
+);
+UPDATE historical_prices SET symbol = UPPER(TRIM(symbol));
+
+DELETE FROM daily_stock_prices WHERE rowid NOT IN (
+	SELECT MAX(rowid) FROM daily_stock_prices GROUP BY UPPER(TRIM(symbol)), updated_at
+);
+UPDATE daily_stock_prices SET symbol = UPPER(TRIM(symbol));
+
+CREATE TEMP TABLE merged_portfolio AS
+SELECT user_id, UPPER(TRIM(symbol)) AS symbol, SUM(quantity) AS quantity
+FROM portfolio GROUP BY user_id, UPPER(TRIM(symbol));
+
+DELETE FROM portfolio;
+
+INSERT INTO portfolio (user_id, symbol, quantity, average_price)
+SELECT m.user_id, m.symbol, m.quantity, COALESCE((
+	SELECT CAST(ROUND(1.0 * SUM(l.remaining * l.price) / SUM(l.remaining)) AS INTEGER)
+	FROM lots l WHERE l.user_id = m.user_id AND l.symbol = m.symbol AND l.remaining > 0
+), 0)
+FROM merged_portfolio m WHERE m.quantity != 0;
+
+DROP TABLE merged_portfolio;
+
+-- Anything already traded stays listed, so existing positions can be valued
+-- and closed. Its name can be filled in later with `instruments import`.
+INSERT OR IGNORE INTO instruments (symbol, name)
+SELECT symbol, symbol FROM (
+	SELECT symbol FROM trades
+	UNION SELECT symbol FROM portfolio
+	UNION SELECT symbol FROM orders
+	UNION SELECT symbol FROM historical_prices
+) WHERE symbol != '';
@@ -0,0 +1,4 @@
+UPDATE orders SET status = 'cancelled', reserved_cash = 0, reserved_shares = 0,
+	status_reason = 'market orders can no longer be queued', updated_at = CURRENT_TIMESTAMP
+WHERE order_type = 'market' AND status = 'open';
+ALTER TABLE users DROP COLUMN closed_market_orders;
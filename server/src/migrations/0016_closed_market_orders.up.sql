@@ -0,0 +1,3 @@
+-- What happens to a market order sent while the market is closed: 'reject'
+-- turns it away, 'queue' keeps it as an open order that fills at the next open.
+ALTER TABLE users ADD COLUMN closed_market_orders TEXT NOT NULL DEFAULT 'reject';
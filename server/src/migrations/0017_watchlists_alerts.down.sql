@@ -0,0 +1,4 @@
+DROP TABLE notifications;
+DROP TABLE price_alerts;
+DROP TABLE watchlist_items;
+DROP TABLE watchlists;
@@ -0,0 +1,56 @@
+-- Named watchlists of symbols, kept in the order the user arranges them.
+CREATE TABLE watchlists (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	name TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(user_id, name)
+);
+
+CREATE TABLE watchlist_items (
+	watchlist_id INTEGER NOT NULL REFERENCES watchlists(id),
+	symbol TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (watchlist_id, symbol)
+);
+
+-- Price alerts. threshold is the price for above/below alerts and percent
+-- the move for percent_change ones. reference_price is what percent_change
+-- and 52-week alerts measure from; it moves to the trigger price each time
+-- they fire. armed is cleared when an above/below alert fires and set again
+-- once the price is back on the other side of the threshold.
+CREATE TABLE price_alerts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	symbol TEXT NOT NULL,
+	condition TEXT NOT NULL,
+	threshold INTEGER,
+	percent REAL,
+	reference_price INTEGER,
+	repeat INTEGER NOT NULL DEFAULT 0,
+	cooldown_seconds INTEGER NOT NULL,
+	armed INTEGER NOT NULL DEFAULT 1,
+	status TEXT NOT NULL DEFAULT 'active',
+	trigger_count INTEGER NOT NULL DEFAULT 0,
+	last_triggered_at DATETIME,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_price_alerts_status ON price_alerts(status, symbol);
+CREATE INDEX idx_price_alerts_user ON price_alerts(user_id, status);
+
+-- In-app notifications; data holds the event's details as JSON.
+CREATE TABLE notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	type TEXT NOT NULL,
+	message TEXT NOT NULL,
+	data TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	read_at DATETIME
+);
+
+CREATE INDEX idx_notifications_user ON notifications(user_id, id);
@@ -0,0 +1,3 @@
+DROP TABLE leaderboard_ranks;
+DROP INDEX idx_notifications_unread;
+DROP TABLE notification_preferences;
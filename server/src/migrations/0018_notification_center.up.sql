@@ -0,0 +1,18 @@
+-- Types a user has switched off; anything without a row is delivered.
+CREATE TABLE notification_preferences (
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	type TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT 1,
+	PRIMARY KEY (user_id, type)
+);
+
+CREATE INDEX idx_notifications_unread ON notifications(user_id) WHERE read_at IS NULL;
+
+-- Each main account's rank by equity the last time the leaderboard was
+-- checked, so the next check can tell who has been passed.
+CREATE TABLE leaderboard_ranks (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id),
+	rank INTEGER NOT NULL,
+	equity INTEGER NOT NULL,
+	updated_at DATETIME NOT NULL
+);
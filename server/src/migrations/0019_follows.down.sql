@@ -0,0 +1,3 @@
+DROP INDEX idx_posts_user_trade_date;
+DROP INDEX idx_posts_trade_date;
+DROP TABLE follows;
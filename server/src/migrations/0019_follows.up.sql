@@ -0,0 +1,13 @@
+CREATE TABLE follows (
+	follower_id INTEGER NOT NULL REFERENCES users(id),
+	followee_id INTEGER NOT NULL REFERENCES users(id),
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (follower_id, followee_id),
+	CHECK (follower_id != followee_id)
+);
+
+CREATE INDEX idx_follows_followee ON follows(followee_id);
+
+-- The feed pages through posts newest first, by trade_date then id.
+CREATE INDEX idx_posts_trade_date ON posts(trade_date, id);
+CREATE INDEX idx_posts_user_trade_date ON posts(user_id, trade_date, id);
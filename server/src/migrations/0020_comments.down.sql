@@ -0,0 +1,2 @@
+DROP TABLE comments_likes;
+DROP TABLE comments;
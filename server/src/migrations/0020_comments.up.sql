@@ -0,0 +1,25 @@
+-- Comments on posts. parent_id points at a top-level comment for replies;
+-- threads go one level deep. Deleted comments keep their row so replies
+-- still have a parent.
+CREATE TABLE comments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	post_id INTEGER NOT NULL REFERENCES posts(id),
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	parent_id INTEGER REFERENCES comments(id),
+	body TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	edited_at DATETIME,
+	deleted_at DATETIME
+);
+
+CREATE INDEX idx_comments_post ON comments(post_id, id);
+CREATE INDEX idx_comments_parent ON comments(parent_id);
+
+CREATE TABLE comments_likes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	comment_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (comment_id) REFERENCES comments(id),
+	UNIQUE(user_id, comment_id)
+);
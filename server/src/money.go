@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount of dollars held as whole cents, so balances and costs
+// add up exactly no matter how many trades go through them. It is stored as
+// INTEGER cents and sent over JSON as a dollar number like 12.34.
+//
+// Prices are Money too: quotes are rounded to the cent when they enter the
+// server, so price times quantity is always exact. Anything that can produce
+// a fraction of a cent (rates, ratios, averages) says how it rounds.
+type Money int64
+
+// MoneyFromFloat rounds a dollar amount to the nearest cent, halves away from
+// zero. Use it only at the edges, for amounts that arrive as floats.
+func MoneyFromFloat(dollars float64) Money {
+	return Money(math.Round(dollars * 100))
+}
+
+// ParseMoney reads a decimal dollar amount such as "12.3456" without going
+// through a float, rounding to the nearest cent, halves away from zero.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty amount")
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	// Exponents only show up from other programs' float formatting.
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+		m := MoneyFromFloat(f)
+		if negative {
+			m = -m
+		}
+		return m, nil
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("invalid amount %q", s)
+			}
+		}
+	}
+
+	dollars, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || dollars > math.MaxInt64/100-1 {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+
+	frac += "000"
+	cents, _ := strconv.ParseInt(frac[:2], 10, 64)
+	m := Money(dollars*100 + cents)
+	if frac[2] >= '5' {
+		m++
+	}
+
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+// Float64 is for ratios and display only; never feed it back into Money.
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Times is a per-share price times a share count. It is exact.
+func (m Money) Times(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// MulRate scales by a rate such as a margin ratio or a daily interest rate,
+// rounding to the nearest cent, halves away from zero.
+func (m Money) MulRate(rate float64) Money {
+	return Money(math.Round(float64(m) * rate))
+}
+
+// Prorate returns part/whole of m, rounding to the nearest cent, halves away
+// from zero. It is how a total cost is split across some of its shares, and
+// how an average price per share is worked out from a total.
+func (m Money) Prorate(part, whole int) Money {
+	if whole == 0 {
+		return 0
+	}
+	numerator := int64(m) * int64(part)
+	quotient, remainder := numerator/int64(whole), numerator%int64(whole)
+	if remainder != 0 && 2*absInt64(remainder) >= absInt64(int64(whole)) {
+		if (numerator < 0) != (whole < 0) {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	return Money(quotient)
+}
+
+func absInt64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func nullMoney(n sql.NullInt64) *Money {
+	if !n.Valid {
+		return nil
+	}
+	m := Money(n.Int64)
+	return &m
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a numeric string, rounding anything
+// finer than a cent to the nearest cent.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	data = bytes.Trim(data, `"`)
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"10", 1000},
+		{"10.5", 1050},
+		{"10.50", 1050},
+		{"10.005", 1001},
+		{"10.0049", 1000},
+		{"-0.01", -1},
+		{"-10.005", -1001},
+		{"+3.2", 320},
+		{".75", 75},
+		{"7.", 700},
+		{"1e3", 100000},
+		{"1.2345E1", 1235},
+		{" 42.1 ", 4210},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if err != nil {
+			t.Errorf("ParseMoney(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoneyInvalid(t *testing.T) {
+	for _, in := range []string{"", "-", ".", "abc", "1.2.3", "1,000", "12a", "99999999999999999999"} {
+		if got, err := ParseMoney(in); err == nil {
+			t.Errorf("ParseMoney(%q) = %s, want an error", in, got)
+		}
+	}
+}
+
+func TestProrate(t *testing.T) {
+	tests := []struct {
+		m           Money
+		part, whole int
+		want        Money
+	}{
+		{1000, 1, 3, 333},
+		{1000, 2, 3, 667},
+		{-1000, 2, 3, -667},
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{1234, 0, 10, 0},
+		{1234, 5, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Prorate(tt.part, tt.whole); got != tt.want {
+			t.Errorf("Money(%d).Prorate(%d, %d) = %d, want %d", tt.m, tt.part, tt.whole, got, tt.want)
+		}
+	}
+}
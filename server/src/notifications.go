@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type notificationType struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// notificationTypes are the events a user can be notified about, and can
+// switch off one by one.
+var notificationTypes = []notificationType{
+	{"post_liked", "Someone liked one of your posts"},
+	{"order_filled", "A trade or open order filled"},
+	{"order_rejected", "An open order was rejected"},
+	{"price_alert", "A price alert triggered"},
+	{"leaderboard_passed", "Another trader passed you on the leaderboard"},
+	{"new_follower", "Someone started following you"},
+	{"post_commented", "Someone commented on one of your posts"},
+	{"comment_replied", "Someone replied to one of your comments"},
+}
+
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+func isNotificationType(kind string) bool {
+	for _, t := range notificationTypes {
+		if t.Type == kind {
+			return true
+		}
+	}
+	return false
+}
+
+type Notification struct {
+	Id        int             `json:"id"`
+	Type      string          `json:"type"`
+	Message   string          `json:"message"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	ReadAt    *time.Time      `json:"read_at"`
+}
+
+const notificationColumns = "id, type, message, data, created_at, read_at"
+
+func scanNotification(row rowScanner) (Notification, error) {
+	var n Notification
+	var data sql.NullString
+	var readAt sql.NullTime
+	if err := row.Scan(&n.Id, &n.Type, &n.Message, &data, &n.CreatedAt, &readAt); err != nil {
+		return n, err
+	}
+	if data.Valid {
+		n.Data = json.RawMessage(data.String)
+	}
+	if readAt.Valid {
+		n.ReadAt = &readAt.Time
+	}
+	return n, nil
+}
+
+func notificationEnabled(q queryer, userId int, kind string) (bool, error) {
+	enabled := true
+	err := q.QueryRow(`
+		SELECT enabled FROM notification_preferences WHERE user_id = ? AND type = ?
+	`, userId, kind).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return enabled, err
+}
+
+// createNotification stores a notification as part of tx. It returns nil when
+// the user has switched that type off. Publish it with publishNotification
+// once tx has committed.
+func createNotification(tx *sql.Tx, userId int, kind, message string, data interface{}) (*Notification, error) {
+	enabled, err := notificationEnabled(tx, userId, kind)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO notifications (user_id, type, message, data) VALUES (?, ?, ?, ?)
+	`, userId, kind, message, string(encoded))
+	if err != nil {
+		return nil, err
+	}
+	id, _ := result.LastInsertId()
+	n, err := scanNotification(tx.QueryRow("SELECT "+notificationColumns+" FROM notifications WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func publishNotification(userId int, n *Notification) {
+	if n != nil {
+		hub.Publish(userTopic(userId), "notification", n)
+	}
+}
+
+// notify stores and publishes a notification on its own, for producers whose
+// work has already committed. Failures are logged rather than returned so
+// they never undo the event being reported.
+func notify(userId int, kind, message string, data interface{}) {
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("Error starting notification transaction:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	n, err := createNotification(tx, userId, kind, message, data)
+	if err != nil {
+		fmt.Printf("Error creating %s notification for user %d: %v\n", kind, userId, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Error committing notification:", err)
+		return
+	}
+	publishNotification(userId, n)
+}
+
+// notifyFill tells the trader a trade went through. orderId is 0 for market
+// orders.
+func notifyFill(fill tradeFill, orderId int) {
+	verb := "Bought"
+	if fill.TradeType == "sell" {
+		verb = "Sold"
+	}
+	message := fmt.Sprintf("%s %d %s at $%s", verb, fill.Quantity, fill.Symbol, fill.Price)
+	if orderId != 0 {
+		message = fmt.Sprintf("Order %d filled: %s", orderId, message)
+	}
+
+	data := map[string]interface{}{
+		"trade_id":   fill.TradeId,
+		"order_id":   orderId,
+		"symbol":     fill.Symbol,
+		"quantity":   fill.Quantity,
+		"trade_type": fill.TradeType,
+		"price":      fill.Price,
+	}
+	if fill.CompetitionId != 0 {
+		data["competition_id"] = fill.CompetitionId
+	}
+	notify(fill.OwnerId, "order_filled", message, data)
+}
+
+// notifyPostLiked tells a post's author someone liked it. Unliking and liking
+// again doesn't add another notification while the first is still unread.
+func notifyPostLiked(postId string, likerId int) {
+	var id, authorId int
+	var symbol, liker string
+	err := db.QueryRow(`
+		SELECT p.id, p.user_id, p.symbol, u.username FROM posts p, users u
+		WHERE p.id = ? AND u.id = ?
+	`, postId, likerId).Scan(&id, &authorId, &symbol, &liker)
+	if err != nil {
+		fmt.Println("Error looking up liked post:", err)
+		return
+	}
+	if authorId == likerId {
+		return
+	}
+
+	var pending bool
+	err = db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM notifications
+			WHERE user_id = ? AND type = 'post_liked' AND read_at IS NULL
+				AND json_extract(data, '$.post_id') = ? AND json_extract(data, '$.liker_id') = ?)
+	`, authorId, id, likerId).Scan(&pending)
+	if err != nil || pending {
+		return
+	}
+
+	notify(authorId, "post_liked", fmt.Sprintf("%s liked your %s post", liker, symbol), map[string]interface{}{
+		"post_id":  id,
+		"liker_id": likerId,
+		"liker":    liker,
+	})
+}
+
+func unreadNotificationCount(userId int) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL
+	`, userId).Scan(&count)
+	return count, err
+}
+
+// GetNotifications lists the user's notifications, newest first, a page at a
+// time. Pass the returned next_before as ?before= for the next page; it is
+// null on the last one. ?unread=true and ?type= narrow the list.
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	query := r.URL.Query()
+
+	limit := defaultNotificationLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxNotificationLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxNotificationLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	where := "user_id = ?"
+	args := []interface{}{userId}
+	if value := query.Get("before"); value != "" {
+		before, err := strconv.Atoi(value)
+		if err != nil || before <= 0 {
+			http.Error(w, "before must be a notification id", http.StatusBadRequest)
+			return
+		}
+		where += " AND id < ?"
+		args = append(args, before)
+	}
+	if kind := query.Get("type"); kind != "" {
+		if !isNotificationType(kind) {
+			http.Error(w, "Unknown notification type", http.StatusBadRequest)
+			return
+		}
+		where += " AND type = ?"
+		args = append(args, kind)
+	}
+	if value := query.Get("unread"); value != "" {
+		unread, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "unread must be true or false", http.StatusBadRequest)
+			return
+		}
+		if unread {
+			where += " AND read_at IS NULL"
+		} else {
+			where += " AND read_at IS NOT NULL"
+		}
+	}
+
+	// One extra row tells whether there is another page.
+	rows, err := db.Query(`
+		SELECT `+notificationColumns+` FROM notifications
+		WHERE `+where+` ORDER BY id DESC LIMIT ?
+	`, append(args, limit+1)...)
+	if err != nil {
+		fmt.Println("Error fetching notifications:", err)
+		http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			http.Error(w, "Failed to scan notification row", http.StatusInternalServerError)
+			return
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+		return
+	}
+
+	var nextBefore *int
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		nextBefore = &notifications[limit-1].Id
+	}
+
+	unread, err := unreadNotificationCount(userId)
+	if err != nil {
+		http.Error(w, "Failed to count unread notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": notifications,
+		"unread_count":  unread,
+		"next_before":   nextBefore,
+	})
+}
+
+func MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid notification id", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`
+		UPDATE notifications SET read_at = ? WHERE id = ? AND user_id = ? AND read_at IS NULL
+	`, time.Now().UTC(), id, userId)
+	if err != nil {
+		http.Error(w, "Failed to mark notification read", http.StatusInternalServerError)
+		return
+	}
+
+	n, err := scanNotification(db.QueryRow(`
+		SELECT `+notificationColumns+` FROM notifications WHERE id = ? AND user_id = ?
+	`, id, userId))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get notification", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
+
+// MarkAllNotificationsRead marks every unread notification read, or only
+// those of one ?type=.
+func MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	query := "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL"
+	args := []interface{}{time.Now().UTC(), userId}
+	if kind := r.URL.Query().Get("type"); kind != "" {
+		if !isNotificationType(kind) {
+			http.Error(w, "Unknown notification type", http.StatusBadRequest)
+			return
+		}
+		query += " AND type = ?"
+		args = append(args, kind)
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to mark notifications read", http.StatusInternalServerError)
+		return
+	}
+	marked, _ := result.RowsAffected()
+
+	unread, err := unreadNotificationCount(userId)
+	if err != nil {
+		http.Error(w, "Failed to count unread notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"marked":       marked,
+		"unread_count": unread,
+	})
+}
+
+type notificationPreference struct {
+	notificationType
+	Enabled bool `json:"enabled"`
+}
+
+func notificationPreferences(userId int) ([]notificationPreference, error) {
+	preferences := make([]notificationPreference, 0, len(notificationTypes))
+	for _, t := range notificationTypes {
+		enabled, err := notificationEnabled(db, userId, t.Type)
+		if err != nil {
+			return nil, err
+		}
+		preferences = append(preferences, notificationPreference{t, enabled})
+	}
+	return preferences, nil
+}
+
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	preferences, err := notificationPreferences(getUserIdFromSession(r))
+	if err != nil {
+		http.Error(w, "Failed to get notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+// UpdateNotificationPreferences takes a map of type to enabled, like
+// {"post_liked": false}. Types left out keep their setting.
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	var req map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	for kind := range req {
+		if !isNotificationType(kind) {
+			http.Error(w, "Unknown notification type "+kind, http.StatusBadRequest)
+			return
+		}
+	}
+
+	userId := getUserIdFromSession(r)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for kind, enabled := range req {
+		_, err := tx.Exec(`
+			INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+			ON CONFLICT(user_id, type) DO UPDATE SET enabled = excluded.enabled
+		`, userId, kind, enabled)
+		if err != nil {
+			http.Error(w, "Failed to update notification preferences", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	preferences, err := notificationPreferences(userId)
+	if err != nil {
+		http.Error(w, "Failed to get notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
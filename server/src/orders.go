@@ -0,0 +1,569 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Order struct {
+	Id             int        `json:"id"`
+	UserId         int        `json:"-"`
+	Symbol         string     `json:"symbol"`
+	Quantity       int        `json:"quantity"`
+	TradeType      string     `json:"trade_type"`
+	OrderType      string     `json:"order_type"`
+	LimitPrice     *Money     `json:"limit_price"`
+	StopPrice      *Money     `json:"stop_price"`
+	Triggered      bool       `json:"triggered"`
+	Status         string     `json:"status"`
+	ReservedCash   Money      `json:"reserved_cash"`
+	ReservedShares int        `json:"reserved_shares"`
+	Rationale      string     `json:"rationale"`
+	FillPrice      *Money     `json:"fill_price"`
+	StatusReason   string     `json:"status_reason,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	FilledAt       *time.Time `json:"filled_at"`
+	// CompetitionId is only filled in on order events.
+	CompetitionId int `json:"competition_id,omitempty"`
+}
+
+const orderColumns = `id, user_id, symbol, quantity, trade_type, order_type, limit_price, stop_price,
+	triggered, status, reserved_cash, reserved_shares, COALESCE(rationale, ''), fill_price,
+	COALESCE(status_reason, ''), created_at, updated_at, filled_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (Order, error) {
+	var o Order
+	var limitPrice, stopPrice, fillPrice sql.NullInt64
+	var filledAt sql.NullTime
+	err := row.Scan(&o.Id, &o.UserId, &o.Symbol, &o.Quantity, &o.TradeType, &o.OrderType, &limitPrice, &stopPrice,
+		&o.Triggered, &o.Status, &o.ReservedCash, &o.ReservedShares, &o.Rationale, &fillPrice,
+		&o.StatusReason, &o.CreatedAt, &o.UpdatedAt, &filledAt)
+	if err != nil {
+		return o, err
+	}
+
+	o.LimitPrice = nullMoney(limitPrice)
+	o.StopPrice = nullMoney(stopPrice)
+	o.FillPrice = nullMoney(fillPrice)
+	if filledAt.Valid {
+		o.FilledAt = &filledAt.Time
+	}
+
+	return o, nil
+}
+
+func isValidOrderType(orderType string) bool {
+	return orderType == "limit" || orderType == "stop" || orderType == "stop_limit"
+}
+
+func validateOrderPrices(orderType string, limitPrice, stopPrice *Money) error {
+	needsLimit := orderType == "limit" || orderType == "stop_limit"
+	needsStop := orderType == "stop" || orderType == "stop_limit"
+
+	if needsLimit && (limitPrice == nil || *limitPrice <= 0) {
+		return fmt.Errorf("limit_price must be greater than 0 for %s orders", orderType)
+	}
+	if !needsLimit && limitPrice != nil {
+		return fmt.Errorf("limit_price is not allowed for %s orders", orderType)
+	}
+	if needsStop && (stopPrice == nil || *stopPrice <= 0) {
+		return fmt.Errorf("stop_price must be greater than 0 for %s orders", orderType)
+	}
+	if !needsStop && stopPrice != nil {
+		return fmt.Errorf("stop_price is not allowed for %s orders", orderType)
+	}
+
+	return nil
+}
+
+// orderReservation is what an open order holds back while it waits: cash at
+// its worst expected price plus fees for buys, the shares themselves for sells.
+func orderReservation(tradeType string, quantity int, limitPrice, stopPrice *Money) (Money, int) {
+	if tradeType == "sell" {
+		return 0, quantity
+	}
+
+	price := stopPrice
+	if limitPrice != nil {
+		price = limitPrice
+	}
+	return price.Times(quantity) + cfg.Fees.feesFor(tradeType, quantity, *price).Total(), 0
+}
+
+// reserveForOrder works out and checks what a new or amended order must hold.
+// Margin accounts only reserve what they actually have; anything beyond that
+// is borrowed and checked against margin when the order fills.
+func reserveForOrder(tx *sql.Tx, userId int, symbol, tradeType string, quantity int, limitPrice, stopPrice *Money) (Money, int, error) {
+	cash, shares := orderReservation(tradeType, quantity, limitPrice, stopPrice)
+
+	margin, err := isMarginAccount(tx, userId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if margin {
+		availableCash, err := availableBalance(tx, userId)
+		if err != nil {
+			return 0, 0, err
+		}
+		held, err := availableShares(tx, userId, symbol)
+		if err != nil {
+			return 0, 0, err
+		}
+		return min(cash, max(availableCash, 0)), min(shares, max(held, 0)), nil
+	}
+
+	return cash, shares, checkReservation(tx, userId, symbol, cash, shares)
+}
+
+func checkReservation(tx *sql.Tx, userId int, symbol string, cash Money, shares int) error {
+	if cash > 0 {
+		available, err := availableBalance(tx, userId)
+		if err != nil {
+			return err
+		}
+		if available < cash {
+			return ErrInsufficientBalance
+		}
+	}
+
+	if shares > 0 {
+		available, err := availableShares(tx, userId, symbol)
+		if err != nil {
+			return err
+		}
+		if available < shares {
+			return ErrInsufficientShares
+		}
+	}
+
+	return nil
+}
+
+func placeOrder(userId int, symbol string, quantity int, tradeType, orderType string, limitPrice, stopPrice *Money, rationale string) (Order, error) {
+	// A queued market buy holds cash at the latest quote. It may fill higher
+	// at the open, and is rejected then if the account can't cover it.
+	reservePrice := limitPrice
+	if orderType == "market" && tradeType == "buy" {
+		price, err := fetchStockPrice(symbol)
+		if err != nil {
+			return Order{}, err
+		}
+		reservePrice = &price
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
+
+	if err := checkTradable(tx, symbol); err != nil {
+		return Order{}, err
+	}
+
+	cash, shares, err := reserveForOrder(tx, userId, symbol, tradeType, quantity, reservePrice, stopPrice)
+	if err != nil {
+		return Order{}, err
+	}
+	if err := bumpAccountVersion(tx, userId); err != nil {
+		return Order{}, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO orders (user_id, symbol, quantity, trade_type, order_type, limit_price, stop_price,
+			reserved_cash, reserved_shares, rationale)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userId, symbol, quantity, tradeType, orderType, limitPrice, stopPrice, cash, shares, rationale)
+	if err != nil {
+		return Order{}, err
+	}
+
+	id, _ := result.LastInsertId()
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", id))
+	if err != nil {
+		return Order{}, err
+	}
+
+	return order, tx.Commit()
+}
+
+func GetOrders(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+
+	query := "SELECT " + orderColumns + " FROM orders WHERE user_id = ?"
+	args := []interface{}{userId}
+	if status != "all" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			http.Error(w, "Failed to scan order row", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, order)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func AmendOrder(w http.ResponseWriter, r *http.Request) {
+	userId, competition, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+	if competition != nil && !competition.isOpen(time.Now().UTC()) {
+		http.Error(w, "Competition is not open for trading", http.StatusConflict)
+		return
+	}
+	orderId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	var amendReq struct {
+		Quantity   *int   `json:"quantity"`
+		LimitPrice *Money `json:"limit_price"`
+		StopPrice  *Money `json:"stop_price"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&amendReq); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ? AND user_id = ?", orderId, userId))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	if order.Status != "open" {
+		http.Error(w, "Only open orders can be amended", http.StatusConflict)
+		return
+	}
+	if order.OrderType == "market" {
+		http.Error(w, "Queued market orders can't be amended, cancel and place a new one", http.StatusConflict)
+		return
+	}
+
+	if amendReq.Quantity != nil {
+		if *amendReq.Quantity <= 0 {
+			http.Error(w, "Quantity must be greater than 0", http.StatusBadRequest)
+			return
+		}
+		order.Quantity = *amendReq.Quantity
+	}
+	if amendReq.LimitPrice != nil {
+		order.LimitPrice = amendReq.LimitPrice
+	}
+	if amendReq.StopPrice != nil {
+		order.StopPrice = amendReq.StopPrice
+	}
+
+	if err := validateOrderPrices(order.OrderType, order.LimitPrice, order.StopPrice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Release the old reservation first so the order only competes with others.
+	_, err = tx.Exec("UPDATE orders SET reserved_cash = 0, reserved_shares = 0 WHERE id = ?", order.Id)
+	if err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+
+	cash, shares, err := reserveForOrder(tx, userId, order.Symbol, order.TradeType, order.Quantity, order.LimitPrice, order.StopPrice)
+	if err == ErrInsufficientBalance || err == ErrInsufficientShares {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to check available funds", http.StatusInternalServerError)
+		return
+	}
+	if err := bumpAccountVersion(tx, userId); err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET quantity = ?, limit_price = ?, stop_price = ?, reserved_cash = ?, reserved_shares = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, order.Quantity, order.LimitPrice, order.StopPrice, cash, shares, order.Id)
+	if err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+
+	order, err = scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", order.Id))
+	if err != nil {
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	publishOrder(order)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func CancelOrder(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+	orderId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', reserved_cash = 0, reserved_shares = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND status = 'open'
+	`, orderId, userId)
+	if err != nil {
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Open order not found", http.StatusNotFound)
+		return
+	}
+
+	if order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", orderId)); err == nil {
+		publishOrder(order)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Order cancelled",
+		"order_id": orderId,
+	})
+}
+
+// orderFillPrice reports whether the order should fill at price, and flags
+// stop-limit orders whose stop has just been crossed.
+func orderFillPrice(order Order, price Money) (fill bool, triggered bool) {
+	buy := order.TradeType == "buy"
+
+	stopCrossed := func() bool {
+		if buy {
+			return price >= *order.StopPrice
+		}
+		return price <= *order.StopPrice
+	}
+	limitMet := func() bool {
+		if buy {
+			return price <= *order.LimitPrice
+		}
+		return price >= *order.LimitPrice
+	}
+
+	switch order.OrderType {
+	case "market":
+		return true, false
+	case "limit":
+		return limitMet(), false
+	case "stop":
+		return stopCrossed(), false
+	case "stop_limit":
+		triggered = order.Triggered || stopCrossed()
+		return triggered && limitMet(), triggered && !order.Triggered
+	}
+
+	return false, false
+}
+
+// evaluateOpenOrders fills whatever open orders the latest quotes reach. It
+// does nothing while the market is closed, which is when queued market orders
+// wait.
+func evaluateOpenOrders() {
+	if !marketCalendar.IsOpen(time.Now()) {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+orderColumns+` FROM orders
+		WHERE status = 'open' AND user_id NOT IN (`+closedCompetitionAccounts+`)
+			AND symbol NOT IN (SELECT symbol FROM instruments WHERE tradable = 0)
+		ORDER BY created_at, id
+	`, time.Now().UTC())
+	if err != nil {
+		fmt.Println("Error querying open orders:", err)
+		return
+	}
+
+	var orders []Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			fmt.Println("Error scanning open order:", err)
+			rows.Close()
+			return
+		}
+		orders = append(orders, order)
+	}
+	rows.Close()
+
+	prices := make(map[string]Money)
+	for _, order := range orders {
+		price, ok := prices[order.Symbol]
+		if !ok {
+			price, err = fetchStockPrice(order.Symbol)
+			if err != nil {
+				fmt.Printf("Error fetching price for %s: %v\n", order.Symbol, err)
+				continue
+			}
+			prices[order.Symbol] = price
+		}
+
+		fill, triggered := orderFillPrice(order, price)
+		if triggered {
+			_, err := db.Exec("UPDATE orders SET triggered = 1, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'open'", order.Id)
+			if err != nil {
+				fmt.Printf("Error triggering order %d: %v\n", order.Id, err)
+			}
+		}
+		if !fill {
+			continue
+		}
+
+		if err := fillOrder(order, price); err != nil {
+			fmt.Printf("Error filling order %d: %v\n", order.Id, err)
+		}
+	}
+}
+
+func fillOrder(order Order, price Money) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Closing the order first releases its reservation to pay for the fill.
+	result, err := tx.Exec(`
+		UPDATE orders
+		SET status = 'filled', fill_price = ?, filled_at = CURRENT_TIMESTAMP, reserved_cash = 0,
+			reserved_shares = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'open'
+	`, price, order.Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil // cancelled or filled in the meantime
+	}
+
+	fill, err := executeTrade(tx, order.UserId, order.Symbol, order.Quantity, order.TradeType, price, order.Rationale, nil, true)
+	if err == ErrInsufficientBalance || err == ErrInsufficientShares || err == ErrInsufficientMargin {
+		tx.Rollback()
+		return rejectOrder(order.Id, err.Error())
+	} else if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if filled, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", order.Id)); err == nil {
+		publishOrder(filled)
+	}
+	publishFill(fill, order.Id)
+	notifyFill(fill, order.Id)
+
+	fmt.Printf("Filled order %d: %s %d %s at $%s\n", order.Id, order.TradeType, order.Quantity, order.Symbol, price)
+	return nil
+}
+
+func rejectOrder(orderId int, reason string) error {
+	result, err := db.Exec(`
+		UPDATE orders
+		SET status = 'rejected', status_reason = ?, reserved_cash = 0, reserved_shares = 0,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'open'
+	`, reason, orderId)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", orderId))
+	if err != nil {
+		return nil
+	}
+	publishOrder(order)
+
+	ownerId, competitionId, err := accountOwner(db, order.UserId)
+	if err != nil {
+		fmt.Println("Error looking up account owner for order notification:", err)
+		return nil
+	}
+	data := map[string]interface{}{
+		"order_id": order.Id,
+		"symbol":   order.Symbol,
+		"reason":   reason,
+	}
+	if competitionId != 0 {
+		data["competition_id"] = competitionId
+	}
+	notify(ownerId, "order_rejected", fmt.Sprintf("Order %d to %s %d %s was rejected: %s",
+		order.Id, order.TradeType, order.Quantity, order.Symbol, reason), data)
+	return nil
+}
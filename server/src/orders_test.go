@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestOrderFillPrice(t *testing.T) {
+	price := func(m Money) *Money { return &m }
+
+	tests := []struct {
+		name          string
+		order         Order
+		price         Money
+		fill, trigger bool
+	}{
+		{"market", Order{OrderType: "market", TradeType: "buy"}, 10000, true, false},
+		{"buy limit above", Order{OrderType: "limit", TradeType: "buy", LimitPrice: price(10000)}, 10001, false, false},
+		{"buy limit at", Order{OrderType: "limit", TradeType: "buy", LimitPrice: price(10000)}, 10000, true, false},
+		{"sell limit below", Order{OrderType: "limit", TradeType: "sell", LimitPrice: price(10000)}, 9999, false, false},
+		{"sell limit above", Order{OrderType: "limit", TradeType: "sell", LimitPrice: price(10000)}, 10001, true, false},
+		{"buy stop below", Order{OrderType: "stop", TradeType: "buy", StopPrice: price(10000)}, 9999, false, false},
+		{"buy stop crossed", Order{OrderType: "stop", TradeType: "buy", StopPrice: price(10000)}, 10000, true, false},
+		{"sell stop above", Order{OrderType: "stop", TradeType: "sell", StopPrice: price(10000)}, 10001, false, false},
+		{"sell stop crossed", Order{OrderType: "stop", TradeType: "sell", StopPrice: price(10000)}, 9000, true, false},
+		{"stop limit not triggered", Order{OrderType: "stop_limit", TradeType: "buy", StopPrice: price(10000), LimitPrice: price(10500)}, 9000, false, false},
+		{"stop limit triggered within limit", Order{OrderType: "stop_limit", TradeType: "buy", StopPrice: price(10000), LimitPrice: price(10500)}, 10200, true, true},
+		{"stop limit triggered past limit", Order{OrderType: "stop_limit", TradeType: "buy", StopPrice: price(10000), LimitPrice: price(10500)}, 11000, false, true},
+		{"triggered stop limit back within limit", Order{OrderType: "stop_limit", TradeType: "buy", StopPrice: price(10000), LimitPrice: price(10500), Triggered: true}, 9000, true, false},
+		{"sell stop limit triggered", Order{OrderType: "stop_limit", TradeType: "sell", StopPrice: price(10000), LimitPrice: price(9500)}, 9800, true, true},
+		{"sell stop limit gapped through", Order{OrderType: "stop_limit", TradeType: "sell", StopPrice: price(10000), LimitPrice: price(9500)}, 9000, false, true},
+	}
+	for _, tt := range tests {
+		fill, trigger := orderFillPrice(tt.order, tt.price)
+		if fill != tt.fill || trigger != tt.trigger {
+			t.Errorf("%s at $%s: fill %v, triggered %v, want %v, %v", tt.name, tt.price, fill, trigger, tt.fill, tt.trigger)
+		}
+	}
+}
+
+func TestFillOrder(t *testing.T) {
+	setupTestDB(t)
+	userId := createTestUser(t, "limits")
+
+	limit := Money(10000)
+	order, err := placeOrder(userId, "AAPL", 10, "buy", "limit", &limit, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := limit.Times(10) + cfg.Fees.feesFor("buy", 10, limit).Total(); order.ReservedCash != want {
+		t.Errorf("limit buy reserves $%s, want $%s", order.ReservedCash, want)
+	}
+
+	// The order fills at the better price it was offered, and only once.
+	for i := 0; i < 2; i++ {
+		if err := fillOrder(order, 9500); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var status string
+	var reserved Money
+	var fillPrice Money
+	if err := db.QueryRow("SELECT status, reserved_cash, fill_price FROM orders WHERE id = ?", order.Id).Scan(&status, &reserved, &fillPrice); err != nil {
+		t.Fatal(err)
+	}
+	if status != "filled" || reserved != 0 || fillPrice != 9500 {
+		t.Errorf("order is %s at $%s holding $%s, want filled at $95.00 holding nothing", status, fillPrice, reserved)
+	}
+
+	var trades, posts, held int
+	var balance Money
+	err = db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM trades WHERE user_id = ?),
+			(SELECT COUNT(*) FROM posts WHERE user_id = ?),
+			(SELECT quantity FROM portfolio WHERE user_id = ? AND symbol = 'AAPL'),
+			(SELECT balance FROM users WHERE id = ?)
+	`, userId, userId, userId, userId).Scan(&trades, &posts, &held, &balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trades != 1 || posts != 1 || held != 10 {
+		t.Errorf("%d trades and %d posts holding %d AAPL, want 1 of each holding 10", trades, posts, held)
+	}
+	if want := cfg.StartingBalance - Money(9500).Times(10) - cfg.Fees.feesFor("buy", 10, 9500).Total(); balance != want {
+		t.Errorf("balance $%s, want $%s", balance, want)
+	}
+
+	// A sell order holds its shares, so nothing else can sell them meanwhile.
+	sellLimit := Money(20000)
+	if _, err := placeOrder(userId, "AAPL", 6, "sell", "limit", &sellLimit, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := placeOrder(userId, "AAPL", 5, "sell", "limit", &sellLimit, nil, ""); err != ErrInsufficientShares {
+		t.Errorf("selling reserved shares: %v, want %v", err, ErrInsufficientShares)
+	}
+}
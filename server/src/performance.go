@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// accountValuation is a user's cash and positions valued at the latest daily
+// price, falling back to average cost for symbols we have no price for.
+// Competition accounts carry their owner's username and their competition.
+type accountValuation struct {
+	UserId        int
+	Username      string
+	CompetitionId int
+	Cash          Money
+	LongValue     Money
+	ShortValue    Money
+}
+
+func (v accountValuation) Equity() Money {
+	return v.Cash + v.LongValue - v.ShortValue
+}
+
+// accountValuations values one user, or every user when userId is 0.
+func accountValuations(q queryer, userId int) ([]accountValuation, error) {
+	rows, err := q.Query(`
+		SELECT u.id, COALESCE(owner.username, u.username), COALESCE(ce.competition_id, 0), u.balance,
+			COALESCE(SUM(CASE WHEN pos.quantity > 0 THEN pos.quantity * pos.price END), 0),
+			COALESCE(SUM(CASE WHEN pos.quantity < 0 THEN -pos.quantity * pos.price END), 0)
+		FROM users u
+		LEFT JOIN competition_entries ce ON ce.account_id = u.id
+		LEFT JOIN users owner ON owner.id = ce.user_id
+		LEFT JOIN (
+			SELECT p.user_id, p.quantity, COALESCE(dsp.price, p.average_price) AS price
+			FROM portfolio p
+			LEFT JOIN (
+				SELECT dsp.symbol, dsp.price
+				FROM daily_stock_prices dsp
+				INNER JOIN (
+					SELECT symbol, MAX(updated_at) AS latest_update
+					FROM daily_stock_prices
+					GROUP BY symbol
+				) latest ON dsp.symbol = latest.symbol AND dsp.updated_at = latest.latest_update
+			) dsp ON dsp.symbol = p.symbol
+		) pos ON pos.user_id = u.id
+		WHERE ? = 0 OR u.id = ?
+		GROUP BY u.id
+	`, userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var valuations []accountValuation
+	for rows.Next() {
+		var v accountValuation
+		if err := rows.Scan(&v.UserId, &v.Username, &v.CompetitionId, &v.Cash, &v.LongValue, &v.ShortValue); err != nil {
+			return nil, err
+		}
+		valuations = append(valuations, v)
+	}
+	return valuations, rows.Err()
+}
+
+type equityPoint struct {
+	Date       time.Time
+	Cash       Money
+	LongValue  Money
+	ShortValue Money
+	Equity     Money
+	NetFlow    Money
+}
+
+// snapshotEquities records today's close for every account. Rerunning it on
+// the same day overwrites that day's values.
+func snapshotEquities() {
+	fmt.Printf("Snapshotting account equity at %s\n", time.Now().Format(time.RFC3339))
+
+	valuations, err := accountValuations(db, 0)
+	if err != nil {
+		fmt.Println("Error valuing accounts:", err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("Error starting snapshot transaction:", err)
+		return
+	}
+	defer tx.Rollback()
+
+	today := truncateToDate(time.Now().UTC())
+	flows, err := netFlowsOn(tx, 0, today)
+	if err != nil {
+		fmt.Println("Error summing net flows:", err)
+		return
+	}
+
+	for _, v := range valuations {
+		_, err := tx.Exec(`
+			INSERT INTO equity_snapshots (user_id, date, cash, long_value, short_value, equity, net_flow)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, date) DO UPDATE SET
+				cash = excluded.cash, long_value = excluded.long_value,
+				short_value = excluded.short_value, equity = excluded.equity, net_flow = excluded.net_flow
+		`, v.UserId, today.Format(dateLayout), v.Cash, v.LongValue, v.ShortValue, v.Equity(), flows[v.UserId])
+		if err != nil {
+			fmt.Printf("Error snapshotting user %d: %v\n", v.UserId, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Error committing equity snapshots:", err)
+		return
+	}
+	fmt.Printf("Snapshotted %d accounts\n", len(valuations))
+}
+
+func loadEquityHistory(userId int, from, to time.Time) ([]equityPoint, error) {
+	rows, err := db.Query(`
+		SELECT date, cash, long_value, short_value, equity, net_flow
+		FROM equity_snapshots
+		WHERE user_id = ? AND date >= ? AND date <= ?
+		ORDER BY date ASC
+	`, userId, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []equityPoint
+	for rows.Next() {
+		var p equityPoint
+		if err := rows.Scan(&p.Date, &p.Cash, &p.LongValue, &p.ShortValue, &p.Equity, &p.NetFlow); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// periodReturns are the day-over-day returns between consecutive points, with
+// each point's net flow taken out so deposits don't count as performance.
+func periodReturns(points []equityPoint) []float64 {
+	var returns []float64
+	for i := 1; i < len(points); i++ {
+		if points[i-1].Equity <= 0 {
+			continue
+		}
+		returns = append(returns, (points[i].Equity-points[i].NetFlow).Float64()/points[i-1].Equity.Float64()-1)
+	}
+	return returns
+}
+
+func timeWeightedReturn(returns []float64) float64 {
+	growth := 1.0
+	for _, r := range returns {
+		growth *= 1 + r
+	}
+	return growth - 1
+}
+
+// moneyWeightedReturn is the internal rate of return over the whole period,
+// treating the first equity as the opening investment and the last as the
+// closing value. It is found by bisection on a daily rate and compounded back
+// up to the period, so it lines up with the time-weighted figure.
+func moneyWeightedReturn(points []equityPoint) (float64, bool) {
+	if len(points) < 2 || points[0].Equity <= 0 {
+		return 0, false
+	}
+
+	start := points[0].Date
+	last := points[len(points)-1]
+	days := last.Date.Sub(start).Hours() / 24
+	if days <= 0 {
+		return 0, false
+	}
+
+	npv := func(rate float64) float64 {
+		total := -points[0].Equity.Float64()
+		for _, p := range points[1:] {
+			total -= p.NetFlow.Float64() / math.Pow(1+rate, p.Date.Sub(start).Hours()/24)
+		}
+		return total + last.Equity.Float64()/math.Pow(1+rate, days)
+	}
+
+	low, high := -0.99, 1.0
+	if npv(low)*npv(high) > 0 {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (low + high) / 2
+		if npv(low)*npv(mid) <= 0 {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+
+	return math.Pow(1+(low+high)/2, days) - 1, true
+}
+
+// maxDrawdown is the largest peak-to-trough fall of the flow-adjusted equity
+// curve, as a fraction of the peak.
+func maxDrawdown(returns []float64) float64 {
+	index, peak, worst := 1.0, 1.0, 0.0
+	for _, r := range returns {
+		index *= 1 + r
+		peak = math.Max(peak, index)
+		worst = math.Max(worst, (peak-index)/peak)
+	}
+	return worst
+}
+
+// annualizedVolatility is the sample standard deviation of daily returns,
+// scaled by the square root of 252 trading days.
+func annualizedVolatility(returns []float64) (float64, bool) {
+	if len(returns) < 2 {
+		return 0, false
+	}
+
+	var mean float64
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+
+	var variance float64
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	variance /= float64(len(returns) - 1)
+
+	return math.Sqrt(variance) * math.Sqrt(252), true
+}
+
+func GetPortfolioHistory(w http.ResponseWriter, r *http.Request) {
+	userId, _, ok := accountForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, err := parseDateRange(r.URL.Query(), 90)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := loadEquityHistory(userId, from, to)
+	if err != nil {
+		fmt.Println("Error loading equity history:", err)
+		http.Error(w, "Failed to fetch portfolio history", http.StatusInternalServerError)
+		return
+	}
+
+	// Snapshots are taken after the close, so value today live rather than
+	// leave the curve ending yesterday.
+	today := truncateToDate(time.Now().UTC())
+	if !to.Before(today) {
+		valuations, err := accountValuations(db, userId)
+		if err != nil || len(valuations) == 0 {
+			fmt.Println("Error valuing account:", err)
+			http.Error(w, "Failed to fetch portfolio history", http.StatusInternalServerError)
+			return
+		}
+		flows, err := netFlowsOn(db, userId, today)
+		if err != nil {
+			fmt.Println("Error summing net flows:", err)
+			http.Error(w, "Failed to fetch portfolio history", http.StatusInternalServerError)
+			return
+		}
+		v := valuations[0]
+		live := equityPoint{Date: today, Cash: v.Cash, LongValue: v.LongValue, ShortValue: v.ShortValue, Equity: v.Equity(), NetFlow: flows[userId]}
+		if n := len(points); n > 0 && points[n-1].Date.Equal(today) {
+			points[n-1] = live
+		} else {
+			points = append(points, live)
+		}
+	}
+
+	history := []map[string]interface{}{}
+	for _, p := range points {
+		history = append(history, map[string]interface{}{
+			"date":       p.Date.Format(dateLayout),
+			"cash":       p.Cash,
+			"longValue":  p.LongValue,
+			"shortValue": p.ShortValue,
+			"equity":     p.Equity,
+			"netFlow":    p.NetFlow,
+		})
+	}
+
+	response := map[string]interface{}{
+		"from":                from.Format(dateLayout),
+		"to":                  to.Format(dateLayout),
+		"points":              history,
+		"timeWeightedReturn":  nil,
+		"moneyWeightedReturn": nil,
+		"maxDrawdown":         nil,
+		"volatility":          nil,
+	}
+
+	// All figures are percentages; volatility is annualized.
+	returns := periodReturns(points)
+	if len(returns) > 0 {
+		response["timeWeightedReturn"] = timeWeightedReturn(returns) * 100
+		response["maxDrawdown"] = maxDrawdown(returns) * 100
+	}
+	if mwr, ok := moneyWeightedReturn(points); ok {
+		response["moneyWeightedReturn"] = mwr * 100
+	}
+	if vol, ok := annualizedVolatility(returns); ok {
+		response["volatility"] = vol * 100
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QuoteCache sits in front of the QuoteProvider. It is safe for concurrent use,
+// keeps at most MaxEntries symbols (least recently used are evicted first) and
+// lets only one request per symbol reach the provider at a time.
+type QuoteCache struct {
+	provider   QuoteProvider
+	maxEntries int
+	defaultTTL time.Duration
+	now        func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	ttls     map[string]time.Duration
+	inflight map[string]*quoteCall
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+	failures  atomic.Uint64
+}
+
+type quoteCacheEntry struct {
+	symbol    string
+	quote     Quote
+	fetchedAt time.Time
+}
+
+type quoteCall struct {
+	done  chan struct{}
+	quote Quote
+	err   error
+}
+
+type QuoteCacheStats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Failures  uint64 `json:"failures"`
+}
+
+var quoteCache *QuoteCache
+
+type QuoteCacheOptions struct {
+	MaxEntries int                 `json:"max_entries"`
+	DefaultTTL Duration            `json:"default_ttl"`
+	SymbolTTLs map[string]Duration `json:"symbol_ttls"`
+}
+
+func newQuoteCache(provider QuoteProvider, opts QuoteCacheOptions) *QuoteCache {
+	c := &QuoteCache{
+		provider:   provider,
+		maxEntries: opts.MaxEntries,
+		defaultTTL: opts.DefaultTTL.Duration,
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		ttls:       make(map[string]time.Duration),
+		inflight:   make(map[string]*quoteCall),
+	}
+	for symbol, ttl := range opts.SymbolTTLs {
+		c.ttls[symbol] = ttl.Duration
+	}
+	return c
+}
+
+func (c *QuoteCache) ttlFor(symbol string) time.Duration {
+	if ttl, ok := c.ttls[symbol]; ok {
+		return ttl
+	}
+	return c.defaultTTL
+}
+
+func (c *QuoteCache) SetTTL(symbol string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttls[symbol] = ttl
+}
+
+// Get returns a fresh enough cached quote or fetches one. Concurrent misses
+// for the same symbol share a single provider call.
+func (c *QuoteCache) Get(symbol string) (Quote, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[symbol]; ok {
+		entry := element.Value.(*quoteCacheEntry)
+		if c.now().Sub(entry.fetchedAt) < c.ttlFor(symbol) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return entry.quote, nil
+		}
+	}
+
+	c.misses.Add(1)
+	if call, ok := c.inflight[symbol]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.quote, call.err
+	}
+
+	call := &quoteCall{done: make(chan struct{})}
+	c.inflight[symbol] = call
+	c.mu.Unlock()
+
+	call.quote, call.err = c.provider.Quote(symbol)
+
+	c.mu.Lock()
+	delete(c.inflight, symbol)
+	if call.err == nil {
+		c.store(symbol, call.quote)
+	} else {
+		c.failures.Add(1)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.quote, call.err
+}
+
+// store must be called with mu held.
+func (c *QuoteCache) store(symbol string, quote Quote) {
+	entry := &quoteCacheEntry{symbol: symbol, quote: quote, fetchedAt: c.now()}
+	if element, ok := c.entries[symbol]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[symbol] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*quoteCacheEntry).symbol)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *QuoteCache) Invalidate(symbol string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[symbol]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, symbol)
+	}
+}
+
+func (c *QuoteCache) Stats() QuoteCacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return QuoteCacheStats{
+		Entries:   entries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Failures:  c.failures.Load(),
+	}
+}
+
+func GetQuoteCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quoteCache.Stats())
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Quote prices are rounded to the cent on the way in; see Money.
+type Quote struct {
+	Symbol string
+	Price  Money
+	Time   time.Time
+}
+
+// QuoteProvider is the only way the server learns about market prices.
+// Handlers and jobs call fetchStockPrice and never talk to a vendor directly.
+type QuoteProvider interface {
+	Name() string
+	Quote(symbol string) (Quote, error)
+}
+
+var ErrUnknownSymbol = errors.New("unknown symbol")
+
+var quoteProvider QuoteProvider
+
+type QuoteProviderOptions struct {
+	Provider        string  `json:"provider"`
+	AlphaVantageKey string  `json:"alphavantage_key"`
+	SimulatedSeed   int64   `json:"simulated_seed"`
+	ReplayFile      string  `json:"replay_file"`
+	ReplaySpeed     float64 `json:"replay_speed"`
+}
+
+func newQuoteProvider(opts QuoteProviderOptions) (QuoteProvider, error) {
+	switch opts.Provider {
+	case "alphavantage":
+		if opts.AlphaVantageKey == "" {
+			return nil, fmt.Errorf("an Alpha Vantage API key is required for the alphavantage provider (use the simulated provider to run offline)")
+		}
+		return &AlphaVantageProvider{
+			APIKey: opts.AlphaVantageKey,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "simulated":
+		return &SimulatedProvider{Seed: opts.SimulatedSeed, Now: time.Now}, nil
+	case "replay":
+		if opts.ReplayFile == "" {
+			return nil, fmt.Errorf("a replay file is required for the replay provider")
+		}
+		return newReplayProvider(opts.ReplayFile, opts.ReplaySpeed, time.Now)
+	default:
+		return nil, fmt.Errorf("unknown quote provider %q", opts.Provider)
+	}
+}
+
+// fetchQuote is the single entry point for prices; it always goes through the
+// quote cache rather than hitting the provider directly.
+func fetchQuote(symbol string) (Quote, error) {
+	return quoteCache.Get(symbol)
+}
+
+func fetchStockPrice(symbol string) (Money, error) {
+	quote, err := fetchQuote(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return quote.Price, nil
+}
+
+type AlphaVantageProvider struct {
+	APIKey string
+	Client *http.Client
+}
+
+func (p *AlphaVantageProvider) Name() string {
+	return "alphavantage"
+}
+
+func (p *AlphaVantageProvider) Quote(symbol string) (Quote, error) {
+	params := url.Values{}
+	params.Set("function", "GLOBAL_QUOTE")
+	params.Set("symbol", symbol)
+	params.Set("apikey", p.APIKey)
+
+	resp, err := p.Client.Get("https://www.alphavantage.co/query?" + params.Encode())
+	if err != nil {
+		return Quote{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Quote{}, fmt.Errorf("alphavantage: unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	var result struct {
+		GlobalQuote struct {
+			Symbol string `json:"01. symbol"`
+			Price  string `json:"05. price"`
+		} `json:"Global Quote"`
+		Note         string `json:"Note"`
+		Information  string `json:"Information"`
+		ErrorMessage string `json:"Error Message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return Quote{}, fmt.Errorf("alphavantage: invalid response: %w", err)
+	}
+
+	switch {
+	case result.ErrorMessage != "":
+		return Quote{}, fmt.Errorf("alphavantage: %s", result.ErrorMessage)
+	case result.Note != "":
+		return Quote{}, fmt.Errorf("alphavantage: %s", result.Note)
+	case result.Information != "":
+		return Quote{}, fmt.Errorf("alphavantage: %s", result.Information)
+	case result.GlobalQuote.Price == "":
+		return Quote{}, ErrUnknownSymbol
+	}
+
+	price, err := ParseMoney(result.GlobalQuote.Price)
+	if err != nil {
+		return Quote{}, fmt.Errorf("alphavantage: invalid price %q", result.GlobalQuote.Price)
+	}
+
+	return Quote{Symbol: symbol, Price: price, Time: time.Now()}, nil
+}
+
+// SimulatedProvider derives prices from the symbol, the seed and the time, so
+// the same inputs always produce the same quote and no network is needed.
+type SimulatedProvider struct {
+	Seed int64
+	Now  func() time.Time
+}
+
+func (p *SimulatedProvider) Name() string {
+	return "simulated"
+}
+
+func (p *SimulatedProvider) Quote(symbol string) (Quote, error) {
+	if symbol == "" {
+		return Quote{}, ErrUnknownSymbol
+	}
+
+	now := p.Now()
+	return Quote{Symbol: symbol, Price: MoneyFromFloat(p.priceAt(symbol, now)), Time: now}, nil
+}
+
+func (p *SimulatedProvider) priceAt(symbol string, t time.Time) float64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%s", p.Seed, symbol)
+	sum := h.Sum64()
+
+	base := 20 + float64(sum%48000)/100
+	phase := float64(sum>>16%1000) / 1000 * 2 * math.Pi
+	days := float64(t.Unix()) / 86400
+
+	// A slow trend plus a faster intraday wobble keeps prices moving but bounded.
+	move := 0.15*math.Sin(2*math.Pi*days/90+phase) + 0.02*math.Sin(2*math.Pi*days*24/6.5+phase*3)
+	return math.Round(base*(1+move)*100) / 100
+}
+
+// ReplayProvider plays back a CSV of symbol,timestamp,price rows. The recording
+// starts at its first timestamp when the provider is created and advances with
+// the wall clock scaled by Speed; after the last row the final prices hold.
+type ReplayProvider struct {
+	quotes map[string][]Quote
+	start  time.Time
+	origin time.Time
+	speed  float64
+	now    func() time.Time
+}
+
+func newReplayProvider(path string, speed float64, now func() time.Time) (*ReplayProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	p := &ReplayProvider{quotes: make(map[string][]Quote), speed: speed, now: now}
+	line := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line++
+
+		price, err := ParseMoney(record[2])
+		if err != nil {
+			if line == 1 {
+				continue // header row
+			}
+			return nil, fmt.Errorf("%s:%d: invalid price %q", path, line, record[2])
+		}
+
+		ts, err := parseReplayTime(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		symbol := strings.TrimSpace(record[0])
+		p.quotes[symbol] = append(p.quotes[symbol], Quote{Symbol: symbol, Price: price, Time: ts})
+		if p.origin.IsZero() || ts.Before(p.origin) {
+			p.origin = ts
+		}
+	}
+
+	if len(p.quotes) == 0 {
+		return nil, fmt.Errorf("%s: no quotes to replay", path)
+	}
+
+	for _, series := range p.quotes {
+		sort.Slice(series, func(i, j int) bool { return series[i].Time.Before(series[j].Time) })
+	}
+	p.start = now()
+
+	return p, nil
+}
+
+func parseReplayTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+func (p *ReplayProvider) Name() string {
+	return "replay"
+}
+
+func (p *ReplayProvider) clock() time.Time {
+	elapsed := p.now().Sub(p.start)
+	return p.origin.Add(time.Duration(float64(elapsed) * p.speed))
+}
+
+func (p *ReplayProvider) Quote(symbol string) (Quote, error) {
+	series, ok := p.quotes[symbol]
+	if !ok {
+		return Quote{}, ErrUnknownSymbol
+	}
+
+	at := p.clock()
+	i := sort.Search(len(series), func(i int) bool { return series[i].Time.After(at) })
+	if i == 0 {
+		return Quote{}, fmt.Errorf("no replay quote for %s before %s", symbol, at.Format(time.RFC3339))
+	}
+
+	return series[i-1], nil
+}
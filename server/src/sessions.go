@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const sessionCookieName = "session_token"
+const sessionDuration = 24 * time.Hour
+
+type contextKey string
+
+const userIdContextKey contextKey = "user_id"
+
+// Tokens are only ever stored hashed, so a leaked data.db can't be replayed as cookies.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func createSession(userId int) (string, time.Time, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(sessionDuration).UTC()
+	_, err = db.Exec(`
+		INSERT INTO sessions (token_hash, user_id, expires_at)
+		VALUES (?, ?, ?)
+	`, hashSessionToken(token), userId, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+func lookupSession(token string) (int, error) {
+	var userId int
+	err := db.QueryRow(`
+		SELECT user_id FROM sessions
+		WHERE token_hash = ? AND revoked = 0 AND expires_at > ?
+	`, hashSessionToken(token), time.Now().UTC()).Scan(&userId)
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+func deleteSession(token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashSessionToken(token))
+	return err
+}
+
+func revokeUserSessions(userId int) error {
+	_, err := db.Exec("UPDATE sessions SET revoked = 1 WHERE user_id = ?", userId)
+	return err
+}
+
+func purgeExpiredSessions() {
+	result, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ? OR revoked = 1", time.Now().UTC())
+	if err != nil {
+		fmt.Println("Error purging expired sessions:", err)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		fmt.Printf("Purged %d expired or revoked sessions\n", n)
+	}
+}
+
+// setSessionCookie hands the browser a session token. Scripts never get to
+// read it; the client asks /userdata whether it is signed in.
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   cfg.SecureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	setSessionCookie(w, "", time.Now().Add(-time.Hour))
+}
+
+func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			if err == http.ErrNoCookie {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if cookie.Value == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		userId, err := lookupSession(cookie.Value)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to verify session", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIdContextKey, userId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+func getUserIdFromSession(r *http.Request) int {
+	userId, ok := r.Context().Value(userIdContextKey).(int)
+	if !ok {
+		return 0
+	}
+	return userId
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionCookiesMatch(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		setupTestDB(t)
+		cfg.SecureCookies = secure
+
+		userId := createTestUser(t, "cookie")
+		hashed, err := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hashed, userId); err != nil {
+			t.Fatal(err)
+		}
+
+		login := httptest.NewRecorder()
+		PostLogin(login, httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"cookie","password":"secret123"}`)))
+		if login.Code != http.StatusOK {
+			t.Fatalf("login: status %d", login.Code)
+		}
+
+		logoutRequest := httptest.NewRequest("POST", "/logout", nil)
+		for _, c := range login.Result().Cookies() {
+			logoutRequest.AddCookie(c)
+		}
+		logout := httptest.NewRecorder()
+		Logout(logout, logoutRequest)
+
+		for name, w := range map[string]*httptest.ResponseRecorder{"login": login, "logout": logout} {
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+				t.Fatalf("%s set cookies %v, want just %s", name, cookies, sessionCookieName)
+			}
+			if !cookies[0].HttpOnly {
+				t.Errorf("%s cookie is readable from scripts", name)
+			}
+			if cookies[0].Secure != secure {
+				t.Errorf("%s cookie Secure = %v with secure_cookies %v", name, cookies[0].Secure, secure)
+			}
+		}
+	}
+}
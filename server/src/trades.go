@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+var ErrInsufficientShares = errors.New("insufficient shares to sell")
+var ErrAccountChanged = errors.New("account changed during trade")
+
+// maxTradeAttempts bounds how often a market trade is re-priced after losing
+// a race with another write to the same account.
+const maxTradeAttempts = 3
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func isValidTradeType(tradeType string) bool {
+	return tradeType == "buy" || tradeType == "sell"
+}
+
+// Cash and shares held by open orders can't be spent by anything else.
+func reservedCash(q queryer, userId int) (Money, error) {
+	var reserved Money
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(reserved_cash), 0) FROM orders
+		WHERE user_id = ? AND status = 'open'
+	`, userId).Scan(&reserved)
+	return reserved, err
+}
+
+func reservedShares(q queryer, userId int, symbol string) (int, error) {
+	var reserved int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(reserved_shares), 0) FROM orders
+		WHERE user_id = ? AND symbol = ? AND status = 'open'
+	`, userId, symbol).Scan(&reserved)
+	return reserved, err
+}
+
+func availableBalance(q queryer, userId int) (Money, error) {
+	var balance Money
+	if err := q.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&balance); err != nil {
+		return 0, err
+	}
+
+	reserved, err := reservedCash(q, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance - reserved, nil
+}
+
+func availableShares(q queryer, userId int, symbol string) (int, error) {
+	var quantity int
+	err := q.QueryRow("SELECT quantity FROM portfolio WHERE user_id = ? AND symbol = ?", userId, symbol).Scan(&quantity)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	reserved, err := reservedShares(q, userId, symbol)
+	if err != nil {
+		return 0, err
+	}
+
+	return quantity - reserved, nil
+}
+
+// accountVersion is bumped by every write that spends or moves an account's
+// cash or shares.
+func accountVersion(q queryer, userId int) (int64, error) {
+	var version int64
+	err := q.QueryRow("SELECT version FROM users WHERE id = ?", userId).Scan(&version)
+	return version, err
+}
+
+func bumpAccountVersion(tx *sql.Tx, userId int) error {
+	_, err := tx.Exec("UPDATE users SET version = version + 1 WHERE id = ?", userId)
+	return err
+}
+
+type tradeFill struct {
+	TradeId    int64
+	PostId     int64
+	UserId     int
+	Symbol     string
+	Quantity   int
+	TradeType  string
+	Price      Money
+	Rationale  string
+	Fees       tradeFees
+	NewBalance Money
+	// RealizedPnL is only meaningful when ClosedQuantity > 0.
+	RealizedPnL    Money
+	ClosedQuantity int
+	// OwnerId is the user behind the account. Competition trades have a
+	// CompetitionId and no PostId, since they stay out of the public feed.
+	OwnerId       int
+	CompetitionId int
+}
+
+// executeTrade applies a fill at price to the user's cash, trades, lots,
+// portfolio and, when post is set and outside competitions, the public feed.
+// Margin accounts may sell short or borrow cash as long as they stay above
+// initial margin. selection names the lots to close on specific-lot accounts
+// and is nil otherwise.
+func executeTrade(tx *sql.Tx, userId int, symbol string, quantity int, tradeType string, price Money, rationale string, selection []lotSelection, post bool) (tradeFill, error) {
+	fill := tradeFill{UserId: userId, Symbol: symbol, Quantity: quantity, TradeType: tradeType, Price: price, Rationale: rationale}
+
+	// Exact: price is whole cents.
+	totalCost := price.Times(quantity)
+	fill.Fees = cfg.Fees.feesFor(tradeType, quantity, price)
+
+	var balance Money
+	if err := tx.QueryRow("SELECT balance FROM users WHERE id = ?", userId).Scan(&balance); err != nil {
+		return fill, fmt.Errorf("get user balance: %w", err)
+	}
+
+	margin, err := isMarginAccount(tx, userId)
+	if err != nil {
+		return fill, fmt.Errorf("get margin status: %w", err)
+	}
+
+	fill.OwnerId, fill.CompetitionId, err = accountOwner(tx, userId)
+	if err != nil {
+		return fill, fmt.Errorf("get account owner: %w", err)
+	}
+
+	if tradeType == "buy" && !margin {
+		available, err := availableBalance(tx, userId)
+		if err != nil {
+			return fill, fmt.Errorf("get available balance: %w", err)
+		}
+		if available < totalCost+fill.Fees.Total() {
+			return fill, ErrInsufficientBalance
+		}
+	} else if tradeType == "sell" && !margin {
+		available, err := availableShares(tx, userId, symbol)
+		if err != nil {
+			return fill, fmt.Errorf("get available shares: %w", err)
+		}
+		if available < quantity {
+			return fill, ErrInsufficientShares
+		}
+
+		// A minimum commission can come to more than a small sale brings in;
+		// the difference has to come out of cash that's actually there.
+		if shortfall := fill.Fees.Total() - totalCost; shortfall > 0 {
+			cash, err := availableBalance(tx, userId)
+			if err != nil {
+				return fill, fmt.Errorf("get available balance: %w", err)
+			}
+			if cash < shortfall {
+				return fill, ErrInsufficientBalance
+			}
+		}
+	}
+
+	cashChange := totalCost
+	delta := quantity
+	if tradeType == "buy" {
+		cashChange = -totalCost
+	} else {
+		delta = -quantity
+	}
+	newBalance := balance + cashChange - fill.Fees.Total()
+
+	result, err := tx.Exec(`
+		INSERT INTO trades (user_id, symbol, quantity, price, trade_type, commission, regulatory_fee)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userId, symbol, quantity, price, tradeType, fill.Fees.Commission, fill.Fees.Regulatory)
+	if err != nil {
+		return fill, fmt.Errorf("record trade: %w", err)
+	}
+	fill.TradeId, _ = result.LastInsertId()
+
+	memo := fmt.Sprintf("%s %d %s at $%s", tradeType, quantity, symbol, price)
+	if err := postCash(tx, userId, ledgerTrade, accountMarket, cashChange, fill.TradeId, memo); err != nil {
+		return fill, err
+	}
+	if fill.Fees.Commission > 0 {
+		if err := postCash(tx, userId, ledgerCommission, accountFees, -fill.Fees.Commission, fill.TradeId, "Commission on "+memo); err != nil {
+			return fill, err
+		}
+	}
+	if fill.Fees.Regulatory > 0 {
+		if err := postCash(tx, userId, ledgerRegulatoryFee, accountFees, -fill.Fees.Regulatory, fill.TradeId, "Regulatory fee on "+memo); err != nil {
+			return fill, err
+		}
+	}
+
+	fill.RealizedPnL, fill.ClosedQuantity, err = applyLots(tx, userId, symbol, fill.TradeId, delta, price, selection)
+	if err != nil {
+		return fill, err
+	}
+	if fill.ClosedQuantity > 0 {
+		if _, err := tx.Exec("UPDATE trades SET realized_pnl = ? WHERE id = ?", fill.RealizedPnL, fill.TradeId); err != nil {
+			return fill, fmt.Errorf("record realized P&L: %w", err)
+		}
+	}
+
+	var currentQuantity int
+	err = tx.QueryRow("SELECT quantity FROM portfolio WHERE user_id = ? AND symbol = ?", userId, symbol).Scan(&currentQuantity)
+	if err != nil && err != sql.ErrNoRows {
+		return fill, fmt.Errorf("get current portfolio quantity: %w", err)
+	}
+
+	// The portfolio's average price is the cost of whichever lots remain, so
+	// it follows the account's lot method.
+	newQuantity := currentQuantity + delta
+	newAverage, err := lotCostBasis(tx, userId, symbol)
+	if err != nil {
+		return fill, fmt.Errorf("get lot cost basis: %w", err)
+	}
+	if newQuantity == 0 {
+		_, err = tx.Exec("DELETE FROM portfolio WHERE user_id = ? AND symbol = ?", userId, symbol)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO portfolio (user_id, symbol, quantity, average_price)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id, symbol) DO UPDATE SET quantity = excluded.quantity, average_price = excluded.average_price
+		`, userId, symbol, newQuantity, newAverage)
+	}
+	if err != nil {
+		return fill, fmt.Errorf("update portfolio: %w", err)
+	}
+
+	// Only trades that grow a position have to clear initial margin; closing
+	// out is always allowed so that margin calls can be met.
+	if margin && (newQuantity > 0 && newQuantity > currentQuantity || newQuantity < 0 && newQuantity < currentQuantity) {
+		if err := checkInitialMargin(tx, userId, map[string]Money{symbol: price}); err != nil {
+			return fill, err
+		}
+	}
+
+	if post && fill.CompetitionId == 0 {
+		result, err = tx.Exec(`
+			INSERT INTO posts (user_id, symbol, quantity, trade_type, rationale, trade_date)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		`, userId, symbol, quantity, tradeType, rationale)
+		if err != nil {
+			return fill, fmt.Errorf("create post for trade: %w", err)
+		}
+		fill.PostId, _ = result.LastInsertId()
+	}
+	fill.NewBalance = newBalance
+
+	return fill, nil
+}
+
+// precheckTrade turns away trades that can't fill at any price before a quote
+// is fetched for them, and returns the account version it checked.
+func precheckTrade(q queryer, userId int, symbol string, quantity int, tradeType string) (int64, error) {
+	if err := checkTradable(q, symbol); err != nil {
+		return 0, err
+	}
+
+	version, err := accountVersion(q, userId)
+	if err != nil {
+		return 0, fmt.Errorf("get account version: %w", err)
+	}
+
+	if tradeType == "sell" {
+		margin, err := isMarginAccount(q, userId)
+		if err != nil {
+			return 0, fmt.Errorf("get margin status: %w", err)
+		}
+		if !margin {
+			available, err := availableShares(q, userId, symbol)
+			if err != nil {
+				return 0, fmt.Errorf("get available shares: %w", err)
+			}
+			if available < quantity {
+				return 0, ErrInsufficientShares
+			}
+		}
+	}
+
+	return version, nil
+}
+
+// executeMarketTrade fills a market order at a fresh quote. The account is
+// checked, priced and written as one unit: the transaction takes the write
+// lock up front (see openDB), and if the account's version moved while the
+// quote was being fetched the whole trade is retried against the new state.
+func executeMarketTrade(userId int, symbol string, quantity int, tradeType, rationale string, selection []lotSelection) (tradeFill, error) {
+	for attempt := 1; ; attempt++ {
+		fill, err := tryMarketTrade(userId, symbol, quantity, tradeType, rationale, selection)
+		if err != ErrAccountChanged || attempt == maxTradeAttempts {
+			return fill, err
+		}
+	}
+}
+
+func tryMarketTrade(userId int, symbol string, quantity int, tradeType, rationale string, selection []lotSelection) (tradeFill, error) {
+	version, err := precheckTrade(db, userId, symbol, quantity, tradeType)
+	if err != nil {
+		return tradeFill{}, err
+	}
+
+	price, err := fetchStockPrice(symbol)
+	if err != nil {
+		return tradeFill{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return tradeFill{}, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, err := accountVersion(tx, userId)
+	if err != nil {
+		return tradeFill{}, fmt.Errorf("get account version: %w", err)
+	}
+	if current != version {
+		return tradeFill{}, ErrAccountChanged
+	}
+
+	fill, err := executeTrade(tx, userId, symbol, quantity, tradeType, price, rationale, selection, true)
+	if err != nil {
+		return fill, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fill, fmt.Errorf("commit trade: %w", err)
+	}
+	return fill, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var stressSymbols = []string{"AAPL", "MSFT", "TSLA"}
+
+// TestConcurrentTrades fires market trades and limit orders at a handful of
+// accounts from many goroutines at once, then checks that every account
+// still adds up. Account versions are watched throughout and must never go
+// backwards.
+func TestConcurrentTrades(t *testing.T) {
+	setupTestDB(t)
+
+	users, workers, trades := 4, 16, 400
+	if testing.Short() {
+		trades = 100
+	}
+
+	// The first account trades on margin so shorts and borrowing get exercised
+	// alongside the cash accounts' balance and holdings checks.
+	var userIds []int
+	for i := 0; i < users; i++ {
+		userIds = append(userIds, createTestUser(t, fmt.Sprintf("stress%d", i)))
+	}
+	if _, err := db.Exec("INSERT INTO margin_accounts (user_id) VALUES (?)", userIds[0]); err != nil {
+		t.Fatalf("enable margin: %v", err)
+	}
+
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		last := make(map[int]int)
+		for {
+			rows, err := db.Query("SELECT id, version FROM users")
+			if err != nil {
+				t.Errorf("read account versions: %v", err)
+				return
+			}
+			for rows.Next() {
+				var id, version int
+				if err := rows.Scan(&id, &version); err != nil {
+					t.Errorf("scan account version: %v", err)
+				}
+				if version < last[id] {
+					t.Errorf("user %d: version went from %d back to %d", id, last[id], version)
+				}
+				last[id] = version
+			}
+			rows.Close()
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	var filled, placed, rejected, conflicts atomic.Int64
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			for range jobs {
+				userId := userIds[rng.Intn(len(userIds))]
+				symbol := stressSymbols[rng.Intn(len(stressSymbols))]
+				quantity := 1 + rng.Intn(20)
+				tradeType := "buy"
+				if rng.Intn(2) == 0 {
+					tradeType = "sell"
+				}
+
+				var err error
+				if rng.Intn(5) == 0 {
+					var price Money
+					if price, err = fetchStockPrice(symbol); err == nil {
+						_, err = placeOrder(userId, symbol, quantity, tradeType, "limit", &price, nil, "stress")
+					}
+					if err == nil {
+						placed.Add(1)
+					}
+				} else {
+					_, err = executeMarketTrade(userId, symbol, quantity, tradeType, "stress", nil)
+					if err == nil {
+						filled.Add(1)
+					}
+				}
+
+				switch err {
+				case nil:
+				case ErrInsufficientBalance, ErrInsufficientShares, ErrInsufficientMargin:
+					rejected.Add(1)
+				case ErrAccountChanged:
+					conflicts.Add(1)
+				default:
+					t.Errorf("user %d %s %d %s: %v", userId, tradeType, quantity, symbol, err)
+				}
+			}
+		}(rand.New(rand.NewSource(int64(w) + 1)))
+	}
+
+	for i := 0; i < trades; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(stop)
+	<-watched
+
+	t.Logf("%d trades filled, %d orders placed, %d rejected, %d gave up after %d attempts",
+		filled.Load(), placed.Load(), rejected.Load(), conflicts.Load(), maxTradeAttempts)
+	if filled.Load() == 0 {
+		t.Error("no trades filled")
+	}
+
+	for _, userId := range userIds {
+		violations, err := checkAccountInvariants(userId, userId == userIds[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range violations {
+			t.Error(v)
+		}
+	}
+}
+
+// checkAccountInvariants rebuilds an account from its trades and compares the
+// result with what is stored. Cash accounts must also never have spent cash or
+// shares they didn't have.
+func checkAccountInvariants(userId int, margin bool) ([]string, error) {
+	var violations []string
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf("user %d: ", userId)+fmt.Sprintf(format, args...))
+	}
+
+	var balance, flows, ledger Money
+	var tradeCount, postCount int
+	err := db.QueryRow(`
+		SELECT u.balance,
+			COALESCE((SELECT SUM(CASE trade_type WHEN 'buy' THEN -quantity * price ELSE quantity * price END
+				- commission - regulatory_fee) FROM trades WHERE user_id = u.id), 0),
+			COALESCE((SELECT SUM(amount) FROM ledger_entries WHERE user_id = u.id AND account = 'cash'), 0),
+			(SELECT COUNT(*) FROM trades WHERE user_id = u.id),
+			(SELECT COUNT(*) FROM posts WHERE user_id = u.id)
+		FROM users u WHERE u.id = ?
+	`, userId).Scan(&balance, &flows, &ledger, &tradeCount, &postCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if balance != cfg.StartingBalance+flows {
+		fail("balance $%s, but starting balance, trades and fees give $%s", balance, cfg.StartingBalance+flows)
+	}
+	if balance != ledger {
+		fail("balance $%s, but the ledger gives $%s", balance, ledger)
+	}
+	if postCount != tradeCount {
+		fail("%d trades but %d posts", tradeCount, postCount)
+	}
+
+	reserved, err := reservedCash(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !margin && balance < reserved {
+		fail("balance $%s is below the $%s reserved by open orders", balance, reserved)
+	}
+
+	var negativeLots int
+	if err := db.QueryRow("SELECT COUNT(*) FROM lots WHERE user_id = ? AND remaining < 0", userId).Scan(&negativeLots); err != nil {
+		return nil, err
+	}
+	if negativeLots > 0 {
+		fail("%d lots have negative shares remaining", negativeLots)
+	}
+
+	for _, symbol := range stressSymbols {
+		var traded, held, inLots int
+		err := db.QueryRow(`
+			SELECT
+				COALESCE((SELECT SUM(CASE trade_type WHEN 'buy' THEN quantity ELSE -quantity END)
+					FROM trades WHERE user_id = ? AND symbol = ?), 0),
+				COALESCE((SELECT quantity FROM portfolio WHERE user_id = ? AND symbol = ?), 0),
+				COALESCE((SELECT SUM(CASE side WHEN 'long' THEN remaining ELSE -remaining END)
+					FROM lots WHERE user_id = ? AND symbol = ?), 0)
+		`, userId, symbol, userId, symbol, userId, symbol).Scan(&traded, &held, &inLots)
+		if err != nil {
+			return nil, err
+		}
+
+		if held != traded {
+			fail("holds %d %s, but trades add up to %d", held, symbol, traded)
+		}
+		if inLots != held {
+			fail("holds %d %s, but open lots add up to %d", held, symbol, inLots)
+		}
+
+		if !margin {
+			if held < 0 {
+				fail("holds %d %s without a margin account", held, symbol)
+			}
+			reservedHeld, err := reservedShares(db, userId, symbol)
+			if err != nil {
+				return nil, err
+			}
+			if held < reservedHeld {
+				fail("holds %d %s, but open orders reserve %d", held, symbol, reservedHeld)
+			}
+		}
+	}
+
+	return violations, nil
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxWatchlists = 20
+const maxWatchlistSymbols = 100
+const maxWatchlistNameLength = 50
+
+var errWatchlistFull = fmt.Errorf("a watchlist can hold at most %d symbols", maxWatchlistSymbols)
+
+type Watchlist struct {
+	Id        int             `json:"id"`
+	Name      string          `json:"name"`
+	Position  int             `json:"position"`
+	Items     []WatchlistItem `json:"items"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// WatchlistItem carries the latest quote when one could be fetched.
+type WatchlistItem struct {
+	Symbol  string    `json:"symbol"`
+	Name    string    `json:"name"`
+	Price   *Money    `json:"price"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+func loadWatchlistItems(q queryer, watchlistId int) ([]WatchlistItem, error) {
+	rows, err := q.Query(`
+		SELECT wi.symbol, COALESCE(i.name, wi.symbol), wi.added_at
+		FROM watchlist_items wi
+		LEFT JOIN instruments i ON i.symbol = wi.symbol
+		WHERE wi.watchlist_id = ?
+		ORDER BY wi.position
+	`, watchlistId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []WatchlistItem{}
+	for rows.Next() {
+		var item WatchlistItem
+		if err := rows.Scan(&item.Symbol, &item.Name, &item.AddedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func loadWatchlist(q queryer, userId, watchlistId int) (Watchlist, error) {
+	var list Watchlist
+	err := q.QueryRow(`
+		SELECT id, name, position, created_at FROM watchlists WHERE id = ? AND user_id = ?
+	`, watchlistId, userId).Scan(&list.Id, &list.Name, &list.Position, &list.CreatedAt)
+	if err != nil {
+		return list, err
+	}
+	list.Items, err = loadWatchlistItems(q, list.Id)
+	return list, err
+}
+
+// priceWatchlists fills in quotes, fetching each symbol once. A symbol whose
+// quote can't be fetched is listed without a price.
+func priceWatchlists(lists []Watchlist) {
+	prices := make(map[string]*Money)
+	for _, list := range lists {
+		for i, item := range list.Items {
+			price, ok := prices[item.Symbol]
+			if !ok {
+				if quote, err := fetchQuote(item.Symbol); err == nil {
+					price = &quote.Price
+				}
+				prices[item.Symbol] = price
+			}
+			list.Items[i].Price = price
+		}
+	}
+}
+
+// watchlistSymbols normalizes and de-duplicates symbols, keeping their order,
+// and checks each one is a known instrument.
+func watchlistSymbols(symbols []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, symbol := range symbols {
+		symbol = normalizeSymbol(symbol)
+		if seen[symbol] {
+			continue
+		}
+		if _, err := resolveInstrument(symbol); err == ErrUnknownSymbol {
+			return nil, fmt.Errorf("%w %s", ErrUnknownSymbol, symbol)
+		} else if err != nil {
+			return nil, err
+		}
+		seen[symbol] = true
+		normalized = append(normalized, symbol)
+	}
+	if len(normalized) > maxWatchlistSymbols {
+		return nil, errWatchlistFull
+	}
+	return normalized, nil
+}
+
+func replaceWatchlistItems(tx *sql.Tx, watchlistId int, symbols []string) error {
+	if _, err := tx.Exec("DELETE FROM watchlist_items WHERE watchlist_id = ?", watchlistId); err != nil {
+		return err
+	}
+	for i, symbol := range symbols {
+		_, err := tx.Exec(`
+			INSERT INTO watchlist_items (watchlist_id, symbol, position) VALUES (?, ?, ?)
+		`, watchlistId, symbol, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validWatchlistName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && len(name) <= maxWatchlistNameLength
+}
+
+// watchlistNameTaken checks for another of the user's watchlists with name.
+func watchlistNameTaken(q queryer, userId int, name string, exceptId int) (bool, error) {
+	var count int
+	err := q.QueryRow(`
+		SELECT COUNT(*) FROM watchlists WHERE user_id = ? AND name = ? AND id != ?
+	`, userId, name, exceptId).Scan(&count)
+	return count > 0, err
+}
+
+func GetWatchlists(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	rows, err := db.Query(`
+		SELECT id, name, position, created_at FROM watchlists WHERE user_id = ? ORDER BY position, id
+	`, userId)
+	if err != nil {
+		http.Error(w, "Failed to fetch watchlists", http.StatusInternalServerError)
+		return
+	}
+
+	lists := []Watchlist{}
+	for rows.Next() {
+		var list Watchlist
+		if err := rows.Scan(&list.Id, &list.Name, &list.Position, &list.CreatedAt); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to scan watchlist row", http.StatusInternalServerError)
+			return
+		}
+		lists = append(lists, list)
+	}
+	rows.Close()
+
+	for i := range lists {
+		if lists[i].Items, err = loadWatchlistItems(db, lists[i].Id); err != nil {
+			http.Error(w, "Failed to fetch watchlist symbols", http.StatusInternalServerError)
+			return
+		}
+	}
+	priceWatchlists(lists)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lists)
+}
+
+func GetWatchlist(w http.ResponseWriter, r *http.Request) {
+	watchlistId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid watchlist id", http.StatusBadRequest)
+		return
+	}
+
+	list, err := loadWatchlist(db, getUserIdFromSession(r), watchlistId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Watchlist not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch watchlist", http.StatusInternalServerError)
+		return
+	}
+	priceWatchlists([]Watchlist{list})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// CreateWatchlist adds a watchlist after the user's others, optionally with
+// its first symbols.
+func CreateWatchlist(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	var req struct {
+		Name    string   `json:"name"`
+		Symbols []string `json:"symbols"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	name, ok := validWatchlistName(req.Name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Name is required and must be at most %d characters", maxWatchlistNameLength), http.StatusBadRequest)
+		return
+	}
+	symbols, err := watchlistSymbols(req.Symbols)
+	if errors.Is(err, ErrUnknownSymbol) || err == errWatchlistFull {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		fmt.Println("Error checking watchlist symbols:", err)
+		http.Error(w, "Failed to create watchlist", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var count, position int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(position) + 1, 0) FROM watchlists WHERE user_id = ?
+	`, userId).Scan(&count, &position)
+	if err != nil {
+		http.Error(w, "Failed to create watchlist", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxWatchlists {
+		http.Error(w, fmt.Sprintf("You can have at most %d watchlists", maxWatchlists), http.StatusConflict)
+		return
+	}
+	if taken, err := watchlistNameTaken(tx, userId, name, 0); err != nil {
+		http.Error(w, "Failed to create watchlist", http.StatusInternalServerError)
+		return
+	} else if taken {
+		http.Error(w, "A watchlist with that name already exists", http.StatusConflict)
+		return
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO watchlists (user_id, name, position) VALUES (?, ?, ?)
+	`, userId, name, position)
+	if err != nil {
+		http.Error(w, "Failed to create watchlist", http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+	if err := replaceWatchlistItems(tx, int(id), symbols); err != nil {
+		http.Error(w, "Failed to add watchlist symbols", http.StatusInternalServerError)
+		return
+	}
+
+	list, err := loadWatchlist(tx, userId, int(id))
+	if err != nil {
+		http.Error(w, "Failed to fetch watchlist", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+	priceWatchlists([]Watchlist{list})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+// UpdateWatchlist renames a watchlist and, when symbols is given, replaces
+// its symbols in that order, which is how items are reordered.
+func UpdateWatchlist(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	watchlistId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid watchlist id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name    *string   `json:"name"`
+		Symbols *[]string `json:"symbols"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var symbols []string
+	if req.Symbols != nil {
+		symbols, err = watchlistSymbols(*req.Symbols)
+		if errors.Is(err, ErrUnknownSymbol) || err == errWatchlistFull {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			fmt.Println("Error checking watchlist symbols:", err)
+			http.Error(w, "Failed to update watchlist", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	list, err := loadWatchlist(tx, userId, watchlistId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Watchlist not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch watchlist", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Name != nil {
+		name, ok := validWatchlistName(*req.Name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Name is required and must be at most %d characters", maxWatchlistNameLength), http.StatusBadRequest)
+			return
+		}
+		if taken, err := watchlistNameTaken(tx, userId, name, list.Id); err != nil {
+			http.Error(w, "Failed to update watchlist", http.StatusInternalServerError)
+			return
+		} else if taken {
+			http.Error(w, "A watchlist with that name already exists", http.StatusConflict)
+			return
+		}
+		if _, err := tx.Exec("UPDATE watchlists SET name = ? WHERE id = ?", name, list.Id); err != nil {
+			http.Error(w, "Failed to update watchlist", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.Symbols != nil {
+		if err := replaceWatchlistItems(tx, list.Id, symbols); err != nil {
+			http.Error(w, "Failed to update watchlist symbols", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if list, err = loadWatchlist(tx, userId, list.Id); err != nil {
+		http.Error(w, "Failed to fetch watchlist", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+	priceWatchlists([]Watchlist{list})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func DeleteWatchlist(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	watchlistId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid watchlist id", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM watchlists WHERE id = ? AND user_id = ?", watchlistId, userId)
+	if err != nil {
+		http.Error(w, "Failed to delete watchlist", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Watchlist not found", http.StatusNotFound)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM watchlist_items WHERE watchlist_id = ?", watchlistId); err != nil {
+		http.Error(w, "Failed to delete watchlist", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Watchlist deleted",
+		"watchlist_id": watchlistId,
+	})
+}
+
+// AddWatchlistSymbol appends a symbol to the end of a watchlist. Adding one
+// that is already there leaves it where it is.
+func AddWatchlistSymbol(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	watchlistId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid watchlist id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Symbol string `json:"symbol"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	symbol := normalizeSymbol(req.Symbol)
+	if _, err := resolveInstrument(symbol); err == ErrUnknownSymbol {
+		http.Error(w, "Unknown symbol", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		fmt.Println("Error resolving instrument:", err)
+		http.Error(w, "Failed to add symbol", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	list, err := loadWatchlist(tx, userId, watchlistId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Watchlist not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch watchlist", http.StatusInternalServerError)
+		return
+	}
+	if len(list.Items) >= maxWatchlistSymbols {
+		http.Error(w, errWatchlistFull.Error(), http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO watchlist_items (watchlist_id, symbol, position)
+		SELECT ?, ?, COALESCE(MAX(position) + 1, 0) FROM watchlist_items WHERE watchlist_id = ?
+	`, list.Id, symbol, list.Id)
+	if err != nil {
+		http.Error(w, "Failed to add symbol", http.StatusInternalServerError)
+		return
+	}
+
+	if list, err = loadWatchlist(tx, userId, list.Id); err != nil {
+		http.Error(w, "Failed to fetch watchlist", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+	priceWatchlists([]Watchlist{list})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func RemoveWatchlistSymbol(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+	watchlistId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid watchlist id", http.StatusBadRequest)
+		return
+	}
+	symbol := normalizeSymbol(mux.Vars(r)["symbol"])
+
+	result, err := db.Exec(`
+		DELETE FROM watchlist_items
+		WHERE watchlist_id = (SELECT id FROM watchlists WHERE id = ? AND user_id = ?) AND symbol = ?
+	`, watchlistId, userId, symbol)
+	if err != nil {
+		http.Error(w, "Failed to remove symbol", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Symbol not found in watchlist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Symbol removed",
+		"watchlist_id": watchlistId,
+		"symbol":       symbol,
+	})
+}
+
+// ReorderWatchlists takes every one of the user's watchlist ids in the order
+// they should be shown.
+func ReorderWatchlists(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIdFromSession(r)
+
+	var req struct {
+		Ids []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM watchlists WHERE user_id = ?", userId)
+	if err != nil {
+		http.Error(w, "Failed to fetch watchlists", http.StatusInternalServerError)
+		return
+	}
+	owned := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to scan watchlist row", http.StatusInternalServerError)
+			return
+		}
+		owned[id] = true
+	}
+	rows.Close()
+
+	seen := make(map[int]bool)
+	for _, id := range req.Ids {
+		if !owned[id] || seen[id] {
+			http.Error(w, "Ids must list each of your watchlists exactly once", http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(owned) {
+		http.Error(w, "Ids must list each of your watchlists exactly once", http.StatusBadRequest)
+		return
+	}
+
+	for position, id := range req.Ids {
+		if _, err := tx.Exec("UPDATE watchlists SET position = ? WHERE id = ?", position, id); err != nil {
+			http.Error(w, "Failed to reorder watchlists", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ids": req.Ids})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsMaxMessageSize = 64 * 1024
+const wsWriteTimeout = 10 * time.Second
+const wsPingInterval = 30 * time.Second
+
+// wsUpgrader turns away browsers on origins CORS doesn't allow. Clients that
+// send no Origin at all aren't browsers, so there is no page to protect.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || isAllowedOrigin(origin)
+	},
+}
+
+// upgradeWebSocket switches the request over to a websocket. When it fails
+// the upgrader has already answered the request.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(wsMaxMessageSize)
+	return conn, nil
+}